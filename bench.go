@@ -0,0 +1,595 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// claws bench opens many connections to a WebSocket server, sends messages
+// at a target rate over them, and reports the time taken to connect, the
+// throughput and the round-trip time of the messages echoed by the server.
+
+const (
+	// time waited for the last messages to be echoed, after sending them
+	benchDrainTimeout = 2 * time.Second
+	// maximum number of messages of a connection waiting to be echoed; the
+	// round-trip time of the other ones is not measured
+	benchMaxPending = 10000
+)
+
+// benchOptions are the options of claws bench.
+type benchOptions struct {
+	Connections int
+	// messages per second, over all the connections
+	Rate     float64
+	Duration time.Duration
+	// total number of messages to send, 0 if unlimited
+	Messages int64
+	Message  string
+	Report   time.Duration
+	JSON     bool
+}
+
+func defineBenchFlags(fs *flag.FlagSet, o *benchOptions) {
+	fs.IntVar(&o.Connections, "c", 10, "Number of concurrent connections.")
+	fs.Float64Var(&o.Rate, "rate", 10, "Messages to send per second, over all the connections.\nOnly the connections are opened when 0.")
+	fs.DurationVar(&o.Duration, "d", 10*time.Second, "Duration of the benchmark.\nUnlimited when 0, if -n is used.")
+	fs.Int64Var(&o.Messages, "n", 0, "Number of messages to send, after which the benchmark ends.\nUnlimited when 0.")
+	fs.StringVar(&o.Message, "m", "", "Message to send, which can contain placeholders,\nor @NAME to send a template.")
+	fs.DurationVar(&o.Report, "report", 5*time.Second, "Interval between progress reports.\nDisabled when 0.")
+	fs.BoolVar(&o.JSON, "json", false, "Write the reports as JSON, one per line.")
+}
+
+const benchHelpPrefix = `COMMAND
+
+  claws bench [OPTION...] WEBSOCKET_URL
+  claws bench -P PROFILE [OPTION...]
+
+Opens the given number of connections, sends the message at the target rate
+over them and reports the time taken to connect, the messages sent and
+received, and the round-trip time of the messages echoed by the server.
+The connection options are taken from the configuration file, the profile
+and the flags, like for the interactive client.
+
+OPTIONS
+
+`
+
+// BenchCommand runs `claws bench`.
+func BenchCommand(args []string) error {
+	b, err := newBench(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return b.run()
+}
+
+// bench is a running benchmark.
+type bench struct {
+	// NOTE: the counters must be accessed atomically, and are kept at the
+	// start of the struct to be 64-bit aligned on 32-bit platforms.
+	sent      int64
+	received  int64
+	bytesSent int64
+	bytesRecv int64
+	// messages left to send, if the number of messages is limited
+	remaining int64
+	seq       int64
+
+	opts benchOptions
+	oSet SettingsBase
+	// URL given, shown instead of the resolved one
+	endpoint string
+	wsOpts   WsOptions
+	text     string
+	encoder  BinaryEncoder
+	te       templateExpander
+	start    time.Time
+	// closed when the benchmark ends
+	done chan struct{}
+
+	mu          sync.Mutex
+	opened      int
+	failed      int
+	closed      int
+	connect     []time.Duration
+	rtt         []time.Duration
+	intervalRTT []time.Duration
+	errors      map[string]int
+	nErrors     int
+	// values at the time of the last report
+	lastReport   time.Time
+	lastSent     int64
+	lastReceived int64
+}
+
+// newBench prepares the benchmark described by the command line arguments.
+func newBench(args []string) (*bench, error) {
+	b := &bench{
+		done:   make(chan struct{}),
+		errors: make(map[string]int),
+	}
+	b.te.seq = func() int64 {
+		return atomic.AddInt64(&b.seq, 1)
+	}
+
+	oSet, fs, url, err := parseCommandFlags("claws bench", benchHelpPrefix, args, func(fs *flag.FlagSet) {
+		defineBenchFlags(fs, &b.opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.oSet = oSet
+	if fs.NArg() > 1 {
+		return nil, errors.New("only one WebSocket URL can be given")
+	}
+	if fs.NArg() == 1 {
+		url = fs.Arg(0)
+	}
+
+	o := &b.opts
+	switch {
+	case url == "":
+		return nil, errors.New("the WebSocket URL is missing")
+	case o.Connections <= 0:
+		return nil, errors.New("the number of connections must be positive")
+	case o.Rate < 0:
+		return nil, errors.New("the rate must not be negative")
+	case o.Rate > 0 && o.Message == "":
+		return nil, errors.New("the message to send is missing; use -m")
+	case o.Rate == 0 && o.Messages > 0:
+		return nil, errors.New("-n can't be used when no messages are sent")
+	case o.Duration <= 0 && o.Messages <= 0:
+		return nil, errors.New("either the duration or the number of messages must be given")
+	}
+	b.remaining = o.Messages
+
+	b.oSet.LastWebsocketURL = url
+	b.endpoint = url
+	if err := interpolateSettings(&b.oSet); err != nil {
+		return nil, err
+	}
+	if b.wsOpts, err = b.oSet.WsOptions(); err != nil {
+		return nil, err
+	}
+	b.wsOpts.DisplayURL = url
+
+	b.text = o.Message
+	if strings.HasPrefix(o.Message, "@") {
+		if b.text, err = b.oSet.Template(o.Message[1:]); err != nil {
+			return nil, err
+		}
+	}
+	if len(templatePrompts(b.text)) > 0 {
+		return nil, errors.New("the message can't contain prompts")
+	}
+	if name := b.oSet.BinaryEncoder; name != "" {
+		if b.encoder = binaryEncoders[name]; b.encoder == nil {
+			return nil, fmt.Errorf("unknown encoder %q", name)
+		}
+	}
+	if o.Rate > 0 {
+		// report errors in the message before connecting
+		te := templateExpander{seq: func() int64 { return 0 }}
+		text, err := te.expand(b.text)
+		if err == nil && b.encoder != nil {
+			_, err = b.encoder([]byte(text), b.oSet)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// run runs the benchmark, until its duration has elapsed, all the messages
+// have been sent or it is interrupted, and prints the reports.
+func (b *bench) run() error {
+	o := b.opts
+	b.start = time.Now()
+	b.lastReport = b.start
+	if !o.JSON {
+		msgs := "no messages"
+		if o.Rate > 0 {
+			msgs = fmt.Sprintf("%g messages/s", o.Rate)
+		}
+		fmt.Printf("Benchmarking %s: %d connections, %s\n", b.endpoint, o.Connections, msgs)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < o.Connections; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			b.runConn(i)
+		}(i)
+	}
+	chFinished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(chFinished)
+	}()
+
+	var chReport, chEnd <-chan time.Time
+	if o.Report > 0 {
+		ticker := time.NewTicker(o.Report)
+		defer ticker.Stop()
+		chReport = ticker.C
+	}
+	if o.Duration > 0 {
+		timer := time.NewTimer(o.Duration)
+		defer timer.Stop()
+		chEnd = timer.C
+	}
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, os.Interrupt)
+	defer signal.Stop(chSig)
+
+	fnEnd := func() {
+		close(b.done)
+		chEnd, chSig = nil, nil
+	}
+	for running := true; running; {
+		select {
+		case <-chReport:
+			b.print(b.report(false))
+		case <-chEnd:
+			fnEnd()
+		case <-chSig:
+			fnEnd()
+		case <-chFinished:
+			running = false
+		}
+	}
+
+	b.print(b.report(true))
+	if b.opened == 0 {
+		return errors.New("no connections could be opened")
+	}
+	return nil
+}
+
+// runConn opens a connection and sends its share of the messages over it.
+func (b *bench) runConn(i int) {
+	// messages waiting to be echoed, with the times they were sent
+	var mu sync.Mutex
+	echoes := make(map[string][]time.Time)
+	pending, matched := 0, 0
+	chClosed := make(chan struct{})
+	var closeOnce sync.Once
+
+	fnRdr := func(msg *WsMsg, err error) {
+		if err != nil {
+			// the read pump stops after an error
+			b.addError(err)
+			closeOnce.Do(func() {
+				b.connClosed()
+				close(chClosed)
+			})
+			return
+		}
+
+		now := time.Now()
+		atomic.AddInt64(&b.received, 1)
+		atomic.AddInt64(&b.bytesRecv, int64(len(msg.Msg)))
+		key := string(msg.Msg)
+		mu.Lock()
+		times, ok := echoes[key]
+		if ok {
+			if len(times) > 1 {
+				echoes[key] = times[1:]
+			} else {
+				delete(echoes, key)
+			}
+			pending--
+			matched++
+		}
+		mu.Unlock()
+		if ok {
+			b.addRTT(now.Sub(times[0]))
+		}
+	}
+
+	var ws WebSocket
+	start := time.Now()
+	if errs := ws.WsOpen(b.oSet.LastWebsocketURL, b.wsOpts, fnRdr); len(errs) > 0 {
+		b.connFailed(errs[0])
+		return
+	}
+	b.connOpened(time.Since(start))
+	defer ws.WsClose()
+	for _, msg := range b.oSet.OnConnect {
+		ws.Write(WsMsg{Type: websocket.TextMessage, Msg: []byte(msg)})
+	}
+
+	if b.opts.Rate <= 0 {
+		select {
+		case <-b.done:
+		case <-chClosed:
+		}
+		return
+	}
+
+	msgType := websocket.TextMessage
+	if b.encoder != nil {
+		msgType = websocket.BinaryMessage
+	}
+	// the connections send their messages in turn
+	interval := time.Duration(float64(time.Second) * float64(b.opts.Connections) / b.opts.Rate)
+	next := start.Add(interval * time.Duration(i) / time.Duration(b.opts.Connections))
+	timer := time.NewTimer(time.Until(next))
+	defer timer.Stop()
+
+	for sending := true; sending; {
+		select {
+		case <-b.done:
+			sending = false
+			continue
+		case <-chClosed:
+			return
+		case <-timer.C:
+		}
+		if b.opts.Messages > 0 && atomic.AddInt64(&b.remaining, -1) < 0 {
+			break
+		}
+
+		data, err := b.nextMessage()
+		if err != nil {
+			b.addError(err)
+		} else {
+			mu.Lock()
+			if pending < benchMaxPending {
+				echoes[string(data)] = append(echoes[string(data)], time.Now())
+				pending++
+			}
+			mu.Unlock()
+			if !ws.Write(WsMsg{Type: msgType, Msg: data}) {
+				return
+			}
+			atomic.AddInt64(&b.sent, 1)
+			atomic.AddInt64(&b.bytesSent, int64(len(data)))
+		}
+
+		// messages which are late by more than a second are not sent in
+		// bursts
+		now := time.Now()
+		if next = next.Add(interval); next.Before(now.Add(-time.Second)) {
+			next = now
+		}
+		timer.Reset(next.Sub(now))
+	}
+
+	// wait for the last messages to be echoed, unless the server doesn't
+	// echo them
+	deadline := time.Now().Add(benchDrainTimeout)
+	for time.Now().Before(deadline) {
+		mu.Lock()
+		done := pending == 0 || matched == 0
+		mu.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-chClosed:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func (b *bench) nextMessage() ([]byte, error) {
+	text, err := b.te.expand(b.text)
+	if err != nil {
+		return nil, err
+	}
+	if b.encoder != nil {
+		return b.encoder([]byte(text), b.oSet)
+	}
+	return []byte(text), nil
+}
+
+func (b *bench) connOpened(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.opened++
+	b.connect = append(b.connect, d)
+}
+
+func (b *bench) connFailed(err error) {
+	var respErr WebSocketResponseError
+	if errors.As(err, &respErr) && respErr.Resp != nil {
+		err = fmt.Errorf("%w (%s)", err, respErr.Resp.Status)
+	}
+	b.addError(err)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failed++
+}
+
+func (b *bench) connClosed() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed++
+}
+
+func (b *bench) addError(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.errors[err.Error()]++
+	b.nErrors++
+}
+
+func (b *bench) addRTT(d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.rtt = append(b.rtt, d)
+	b.intervalRTT = append(b.intervalRTT, d)
+}
+
+// benchReport is a report of claws bench. Periodic reports cover the time
+// since the previous report, while the final one covers the whole benchmark.
+// Rates are per second, and times are in milliseconds.
+type benchReport struct {
+	Final bool
+	// seconds since the start of the benchmark, and covered by the report
+	Elapsed  float64
+	Interval float64
+
+	Connections struct {
+		Open   int
+		Failed int
+		// closed by the server or because of an error
+		Closed int
+	}
+	ConnectTime latencyStats
+
+	Sent          int64
+	Received      int64
+	SentRate      float64
+	ReceivedRate  float64
+	BytesSent     int64
+	BytesReceived int64
+	RTT           latencyStats
+
+	Errors      int
+	ErrorCounts map[string]int
+}
+
+type latencyStats struct {
+	Count int
+	Min   float64
+	Mean  float64
+	P50   float64
+	P90   float64
+	P99   float64
+	Max   float64
+}
+
+// newLatencyStats returns the statistics of the durations, sorting them.
+func newLatencyStats(ds []time.Duration) latencyStats {
+	ls := latencyStats{Count: len(ds)}
+	if len(ds) == 0 {
+		return ls
+	}
+	sort.Slice(ds, func(i, j int) bool { return ds[i] < ds[j] })
+	fnMs := func(d time.Duration) float64 {
+		return float64(d) / float64(time.Millisecond)
+	}
+	// nearest-rank percentiles
+	fnPerc := func(p float64) float64 {
+		return fnMs(ds[int(math.Ceil(p/100*float64(len(ds))))-1])
+	}
+
+	var sum time.Duration
+	for _, d := range ds {
+		sum += d
+	}
+	ls.Min = fnMs(ds[0])
+	ls.Mean = fnMs(sum / time.Duration(len(ds)))
+	ls.P50 = fnPerc(50)
+	ls.P90 = fnPerc(90)
+	ls.P99 = fnPerc(99)
+	ls.Max = fnMs(ds[len(ds)-1])
+	return ls
+}
+
+func (ls latencyStats) String() string {
+	if ls.Count == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("min %.2fms, mean %.2fms, p50 %.2fms, p90 %.2fms, p99 %.2fms, max %.2fms",
+		ls.Min, ls.Mean, ls.P50, ls.P90, ls.P99, ls.Max)
+}
+
+func (b *bench) report(final bool) benchReport {
+	now := time.Now()
+	sent, received := atomic.LoadInt64(&b.sent), atomic.LoadInt64(&b.received)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	r := benchReport{
+		Final:         final,
+		Elapsed:       now.Sub(b.start).Seconds(),
+		ConnectTime:   newLatencyStats(b.connect),
+		BytesSent:     atomic.LoadInt64(&b.bytesSent),
+		BytesReceived: atomic.LoadInt64(&b.bytesRecv),
+		Errors:        b.nErrors,
+		ErrorCounts:   b.errors,
+	}
+	r.Connections.Open = b.opened - b.closed
+	r.Connections.Failed = b.failed
+	r.Connections.Closed = b.closed
+
+	if final {
+		r.Interval = r.Elapsed
+		r.Sent, r.Received = sent, received
+		r.RTT = newLatencyStats(b.rtt)
+	} else {
+		r.Interval = now.Sub(b.lastReport).Seconds()
+		r.Sent, r.Received = sent-b.lastSent, received-b.lastReceived
+		r.RTT = newLatencyStats(b.intervalRTT)
+	}
+	if r.Interval > 0 {
+		r.SentRate = float64(r.Sent) / r.Interval
+		r.ReceivedRate = float64(r.Received) / r.Interval
+	}
+	b.intervalRTT = nil
+	b.lastReport, b.lastSent, b.lastReceived = now, sent, received
+	return r
+}
+
+func (b *bench) print(r benchReport) {
+	if b.opts.JSON {
+		// the error counts are still being updated
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		json.NewEncoder(os.Stdout).Encode(r)
+		return
+	}
+
+	if !r.Final {
+		fmt.Printf("[%6.1fs] %d open, sent %d (%.1f/s), received %d (%.1f/s), rtt p50 %.2fms p99 %.2fms, %d errors\n",
+			r.Elapsed, r.Connections.Open, r.Sent, r.SentRate, r.Received, r.ReceivedRate, r.RTT.P50, r.RTT.P99, r.Errors)
+		return
+	}
+
+	fmt.Printf("\nDuration:      %.1fs\n", r.Elapsed)
+	fmt.Printf("Connections:   %d opened, %d failed, %d closed before the end\n",
+		r.Connections.Open+r.Connections.Closed, r.Connections.Failed, r.Connections.Closed)
+	fmt.Printf("Connect time:  %v\n", r.ConnectTime)
+	fmt.Printf("Sent:          %d messages (%.1f/s), %d bytes\n", r.Sent, r.SentRate, r.BytesSent)
+	fmt.Printf("Received:      %d messages (%.1f/s), %d bytes\n", r.Received, r.ReceivedRate, r.BytesReceived)
+	fmt.Printf("Round trip:    %v (%d echoes)\n", r.RTT, r.RTT.Count)
+	fmt.Printf("Errors:        %d\n", r.Errors)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	msgs := make([]string, 0, len(r.ErrorCounts))
+	for msg := range r.ErrorCounts {
+		msgs = append(msgs, msg)
+	}
+	sort.Slice(msgs, func(i, j int) bool {
+		if ci, cj := r.ErrorCounts[msgs[i]], r.ErrorCounts[msgs[j]]; ci != cj {
+			return ci > cj
+		}
+		return msgs[i] < msgs[j]
+	})
+	for _, msg := range msgs {
+		fmt.Printf("  %6d  %s\n", r.ErrorCounts[msg], msg)
+	}
+}
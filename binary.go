@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BinaryDecoder converts the payload of a binary message into readable text.
+type BinaryDecoder func(msg []byte, oSet SettingsBase) (string, error)
+
+// binaryDecoders contains the decoders which can be chosen for binary
+// messages, using the BinaryDecoder setting.
+var binaryDecoders = map[string]BinaryDecoder{
+	"msgpack":  decodeMsgpack,
+	"cbor":     decodeCBOR,
+	"protobuf": decodeProtobuf,
+}
+
+// BinaryEncoder converts a message written by the user, in JSON, into the
+// payload of a binary message.
+type BinaryEncoder func(msg []byte, oSet SettingsBase) ([]byte, error)
+
+// binaryEncoders contains the encoders which can be chosen for the messages
+// sent by the user, using the BinaryEncoder setting.
+var binaryEncoders = map[string]BinaryEncoder{
+	"msgpack":  encodeMsgpack,
+	"cbor":     encodeCBOR,
+	"protobuf": encodeProtobuf,
+}
+
+// binaryDecoderNames returns the sorted names of the available decoders.
+func binaryDecoderNames() []string {
+	names := make([]string, 0, len(binaryDecoders))
+	for name := range binaryDecoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// binaryEncoderNames returns the sorted names of the available encoders.
+func binaryEncoderNames() []string {
+	names := make([]string, 0, len(binaryEncoders))
+	for name := range binaryEncoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// The following types are used, together with nil, bool, int64, uint64,
+// float64, *big.Int, string, []byte and []interface{}, to represent the
+// values decoded from binary formats.
+type (
+	// mapEntry is a key-value pair of a map. Maps are stored as []mapEntry,
+	// to keep the original ordering and allow keys which are not strings.
+	mapEntry struct {
+		Key   interface{}
+		Value interface{}
+	}
+	// taggedValue is a CBOR tagged data item.
+	taggedValue struct {
+		Tag   uint64
+		Value interface{}
+	}
+	// extValue is a MessagePack extension type.
+	extValue struct {
+		Type int8
+		Data []byte
+	}
+	// simpleValue is a CBOR simple value with no assigned meaning.
+	simpleValue uint8
+	// undefinedValue is the CBOR undefined value.
+	undefinedValue struct{}
+)
+
+// formatTree renders a decoded value in a JSON-like syntax, following the same
+// layout used for JSON formatting.
+func formatTree(v interface{}) string {
+	buf := new(bytes.Buffer)
+	printTree(buf, v, "")
+	return buf.String()
+}
+
+func printTree(buf *bytes.Buffer, v interface{}, indent string) {
+	indent += "  "
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case int64:
+		buf.WriteString(strconv.FormatInt(v, 10))
+	case uint64:
+		buf.WriteString(strconv.FormatUint(v, 10))
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			buf.WriteString("NaN")
+		case math.IsInf(v, 0):
+			if v < 0 {
+				buf.WriteByte('-')
+			}
+			buf.WriteString("Infinity")
+		default:
+			buf.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		}
+	case *big.Int:
+		buf.WriteString(v.String())
+	case string:
+		writeJSONString(buf, v)
+	case []byte:
+		buf.WriteString("h'")
+		buf.WriteString(hex.EncodeToString(v))
+		buf.WriteByte('\'')
+	case time.Time:
+		buf.WriteString("time(")
+		writeJSONString(buf, v.UTC().Format(time.RFC3339Nano))
+		buf.WriteByte(')')
+	case taggedValue:
+		buf.WriteString(strconv.FormatUint(v.Tag, 10))
+		buf.WriteByte('(')
+		printTree(buf, v.Value, indent[:len(indent)-2])
+		buf.WriteByte(')')
+	case extValue:
+		fmt.Fprintf(buf, "ext(%d, h'%s')", v.Type, hex.EncodeToString(v.Data))
+	case simpleValue:
+		fmt.Fprintf(buf, "simple(%d)", v)
+	case undefinedValue:
+		buf.WriteString("undefined")
+	case []mapEntry:
+		switch len(v) {
+		case 0:
+			buf.WriteString("{}")
+		case 1:
+			buf.WriteByte('{')
+			printTreeKey(buf, v[0].Key)
+			buf.WriteString(": ")
+			printTree(buf, v[0].Value, indent)
+			buf.WriteByte('}')
+		default:
+			buf.WriteString("{\n")
+			for i, e := range v {
+				buf.WriteString(indent)
+				printTreeKey(buf, e.Key)
+				buf.WriteString(": ")
+				printTree(buf, e.Value, indent)
+				if i != len(v)-1 {
+					buf.WriteByte(',')
+				}
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(indent[:len(indent)-2])
+			buf.WriteByte('}')
+		}
+	case []interface{}:
+		switch len(v) {
+		case 0:
+			buf.WriteString("[]")
+		case 1:
+			buf.WriteByte('[')
+			printTree(buf, v[0], indent)
+			buf.WriteByte(']')
+		default:
+			buf.WriteString("[\n")
+			for i, el := range v {
+				buf.WriteString(indent)
+				printTree(buf, el, indent)
+				if i != len(v)-1 {
+					buf.WriteByte(',')
+				}
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(indent[:len(indent)-2])
+			buf.WriteByte(']')
+		}
+	default:
+		buf.WriteString("(INVALID)")
+	}
+}
+
+// printTreeKey prints a map key. Keys which are not strings are printed as
+// they would be as values, but always on a single line.
+func printTreeKey(buf *bytes.Buffer, k interface{}) {
+	if s, ok := k.(string); ok {
+		writeJSONString(buf, s)
+		return
+	}
+	s := formatTree(k)
+	buf.WriteString(strings.Join(strings.Fields(s), " "))
+}
+
+func writeJSONString(buf *bytes.Buffer, s string) {
+	e := json.NewEncoder(buf)
+	e.SetEscapeHTML(false)
+	e.Encode(s)
+	// remove newline added by Encode
+	buf.Truncate(buf.Len() - 1)
+}
+
+// parseJSONTree parses a JSON value into the types used to represent decoded
+// binary values, keeping the order of object keys. Integers are represented as
+// int64 or uint64, other numbers as float64.
+func parseJSONTree(msg []byte) (interface{}, error) {
+	d := json.NewDecoder(bytes.NewReader(msg))
+	d.UseNumber()
+	v, err := readJSONTree(d)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.Token(); err != io.EOF {
+		return nil, errors.New("invalid data after JSON value")
+	}
+	return v, nil
+}
+
+func readJSONTree(d *json.Decoder) (interface{}, error) {
+	t, err := d.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := t.(type) {
+	case json.Delim:
+		switch t {
+		case '[':
+			res := []interface{}{}
+			for d.More() {
+				v, err := readJSONTree(d)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, v)
+			}
+			_, err := d.Token()
+			return res, err
+		case '{':
+			res := []mapEntry{}
+			for d.More() {
+				k, err := d.Token()
+				if err != nil {
+					return nil, err
+				}
+				v, err := readJSONTree(d)
+				if err != nil {
+					return nil, err
+				}
+				res = append(res, mapEntry{Key: k, Value: v})
+			}
+			_, err := d.Token()
+			return res, err
+		}
+		return nil, fmt.Errorf("unexpected %v", t)
+	case json.Number:
+		if n, err := strconv.ParseInt(string(t), 10, 64); err == nil {
+			return n, nil
+		}
+		if n, err := strconv.ParseUint(string(t), 10, 64); err == nil {
+			return n, nil
+		}
+		return t.Float64()
+	default:
+		// nil, bool, string
+		return t, nil
+	}
+}
+
+// binReader is a helper to read from a byte slice while decoding binary
+// formats.
+type binReader struct {
+	b   []byte
+	pos int
+	// nesting of the value being read
+	depth int
+}
+
+// maxBinaryDepth is the maximum nesting of the values in decoded messages,
+// so that hostile messages can't exhaust the stack.
+const maxBinaryDepth = 1000
+
+var (
+	errUnexpectedEnd = errors.New("unexpected end of data")
+	errTooDeep       = fmt.Errorf("values nested more than %d levels deep", maxBinaryDepth)
+)
+
+// enter must be called when starting to read a value, which may contain
+// other values, and leave when done.
+func (r *binReader) enter() error {
+	if r.depth >= maxBinaryDepth {
+		return errTooDeep
+	}
+	r.depth++
+	return nil
+}
+
+func (r *binReader) leave() {
+	r.depth--
+}
+
+func (r *binReader) remaining() int {
+	return len(r.b) - r.pos
+}
+
+func (r *binReader) byte() (byte, error) {
+	if r.pos >= len(r.b) {
+		return 0, errUnexpectedEnd
+	}
+	r.pos++
+	return r.b[r.pos-1], nil
+}
+
+func (r *binReader) bytes(n uint64) ([]byte, error) {
+	if n > uint64(r.remaining()) {
+		return nil, errUnexpectedEnd
+	}
+	res := r.b[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return res, nil
+}
+
+// uint reads a big-endian unsigned integer of n bytes.
+func (r *binReader) uint(n int) (uint64, error) {
+	b, err := r.bytes(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+// checkLength makes sure that a container of n elements, each taking at least
+// one byte, can fit in the remaining data.
+func (r *binReader) checkLength(n uint64) error {
+	if n > uint64(r.remaining()) {
+		return errUnexpectedEnd
+	}
+	return nil
+}
+
+// end returns an error if there is unread data in r.
+func (r *binReader) end() error {
+	if r.remaining() > 0 {
+		return fmt.Errorf("%d bytes of trailing data", r.remaining())
+	}
+	return nil
+}
+
+// binWriter is a helper to write binary formats.
+type binWriter struct {
+	bytes.Buffer
+}
+
+// writeUint writes v as a big-endian unsigned integer of n bytes.
+func (w *binWriter) writeUint(n int, v uint64) {
+	for i := n - 1; i >= 0; i-- {
+		w.WriteByte(byte(v >> (8 * i)))
+	}
+}
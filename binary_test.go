@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/types/descriptorpb"
+)
+
+func TestBinaryDecode(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode BinaryDecoder
+		data   string
+		want   string
+	}{
+		{"msgpack", decodeMsgpack, "c0", "null"},
+		{"msgpack", decodeMsgpack, "c3", "true"},
+		{"msgpack", decodeMsgpack, "7f", "127"},
+		{"msgpack", decodeMsgpack, "e0", "-32"},
+		{"msgpack", decodeMsgpack, "cd0100", "256"},
+		{"msgpack", decodeMsgpack, "cfffffffffffffffff", "18446744073709551615"},
+		{"msgpack", decodeMsgpack, "d3ffffffffffffff7f", "-129"},
+		{"msgpack", decodeMsgpack, "cb3ff8000000000000", "1.5"},
+		{"msgpack", decodeMsgpack, "a668c3a96c6c6f", `"héllo"`},
+		{"msgpack", decodeMsgpack, "c4020aff", "h'0aff'"},
+		{"msgpack", decodeMsgpack, "92c2c0", "[\n  false,\n  null\n]"},
+		{"msgpack", decodeMsgpack, "81a16101", `{"a": 1}`},
+		{"msgpack", decodeMsgpack, "82a16101a1629101", "{\n  \"a\": 1,\n  \"b\": [1]\n}"},
+		{"msgpack", decodeMsgpack, "d40107", "ext(1, h'07')"},
+		{"cbor", decodeCBOR, "f6", "null"},
+		{"cbor", decodeCBOR, "f7", "undefined"},
+		{"cbor", decodeCBOR, "f5", "true"},
+		{"cbor", decodeCBOR, "1903e8", "1000"},
+		{"cbor", decodeCBOR, "3863", "-100"},
+		{"cbor", decodeCBOR, "f93e00", "1.5"},
+		{"cbor", decodeCBOR, "fb7ff0000000000000", "Infinity"},
+		{"cbor", decodeCBOR, "6161", `"a"`},
+		{"cbor", decodeCBOR, "4401020304", "h'01020304'"},
+		{"cbor", decodeCBOR, "7f61616162ff", `"ab"`},
+		{"cbor", decodeCBOR, "5f410142020340ff", "h'010203'"},
+		{"cbor", decodeCBOR, "5fff", "h''"},
+		{"cbor", decodeCBOR, "9f0102ff", "[\n  1,\n  2\n]"},
+		{"cbor", decodeCBOR, "a2616101616202", "{\n  \"a\": 1,\n  \"b\": 2\n}"},
+		{"cbor", decodeCBOR, "a10102", "{1: 2}"},
+		{"cbor", decodeCBOR, "d8200b", "32(11)"},
+		{"cbor", decodeCBOR, "f0", "simple(16)"},
+	}
+	for _, tt := range tests {
+		data, err := hex.DecodeString(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := tt.decode(data, SettingsBase{})
+		if err != nil {
+			t.Errorf("%s: %s: %v", tt.name, tt.data, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: %s decoded as %s, want %s", tt.name, tt.data, got, tt.want)
+		}
+	}
+}
+
+// binaryRoundTrips are JSON messages which can be encoded and decoded back.
+var binaryRoundTrips = []string{
+	`null`,
+	`true`,
+	`0`,
+	`127`,
+	`128`,
+	`65536`,
+	`4294967296`,
+	`18446744073709551615`,
+	`-1`,
+	`-33`,
+	`-129`,
+	`-32769`,
+	`-2147483649`,
+	`1.5`,
+	`""`,
+	`"héllo"`,
+	`"` + strings.Repeat("x", 300) + `"`,
+	`[]`,
+	`[1, "a", [true, null]]`,
+	`{}`,
+	`{"b": 1, "a": {"c": [2, 3]}}`,
+	`[` + strings.Repeat(`0,`, 20) + `0]`,
+}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	codecs := []struct {
+		name   string
+		encode BinaryEncoder
+		decode BinaryDecoder
+	}{
+		{"msgpack", encodeMsgpack, decodeMsgpack},
+		{"cbor", encodeCBOR, decodeCBOR},
+	}
+	for _, c := range codecs {
+		for _, msg := range binaryRoundTrips {
+			tree, err := parseJSONTree([]byte(msg))
+			if err != nil {
+				t.Fatalf("%s: %v", msg, err)
+			}
+			data, err := c.encode([]byte(msg), SettingsBase{})
+			if err != nil {
+				t.Errorf("%s: encoding %s: %v", c.name, msg, err)
+				continue
+			}
+			got, err := c.decode(data, SettingsBase{})
+			if err != nil {
+				t.Errorf("%s: decoding %s: %v", c.name, msg, err)
+				continue
+			}
+			if want := formatTree(tree); got != want {
+				t.Errorf("%s: %s decoded as %s, want %s", c.name, msg, got, want)
+			}
+		}
+	}
+}
+
+func TestBinaryDecodeTruncated(t *testing.T) {
+	codecs := []struct {
+		name   string
+		encode BinaryEncoder
+		decode BinaryDecoder
+	}{
+		{"msgpack", encodeMsgpack, decodeMsgpack},
+		{"cbor", encodeCBOR, decodeCBOR},
+	}
+	for _, c := range codecs {
+		for _, msg := range binaryRoundTrips {
+			data, err := c.encode([]byte(msg), SettingsBase{})
+			if err != nil {
+				t.Fatalf("%s: encoding %s: %v", c.name, msg, err)
+			}
+			for i := 0; i < len(data); i++ {
+				if _, err := c.decode(data[:i], SettingsBase{}); err == nil {
+					t.Errorf("%s: %x, truncated from %x, decoded without errors", c.name, data[:i], data)
+				}
+			}
+			if _, err := c.decode(append(data, 0), SettingsBase{}); err == nil {
+				t.Errorf("%s: %x with trailing data decoded without errors", c.name, data)
+			}
+		}
+	}
+}
+
+func TestBinaryDecodeInvalid(t *testing.T) {
+	decoders := []struct {
+		name   string
+		decode BinaryDecoder
+	}{
+		{"msgpack", decodeMsgpack},
+		{"cbor", decodeCBOR},
+		{"protobuf", decodeProtobuf},
+	}
+	for _, d := range decoders {
+		// any input of up to two bytes must be handled without panicking
+		for i := 0; i < 1<<16; i++ {
+			d.decode([]byte{byte(i >> 8), byte(i)}, SettingsBase{})
+			if i < 256 {
+				d.decode([]byte{byte(i)}, SettingsBase{})
+			}
+		}
+		// huge lengths with no data
+		for _, data := range [][]byte{
+			{0xdb, 0xff, 0xff, 0xff, 0xff},
+			{0xdd, 0xff, 0xff, 0xff, 0xff},
+			{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+			{0x0a, 0xff, 0xff, 0xff, 0xff, 0x0f},
+		} {
+			d.decode(data, SettingsBase{})
+		}
+	}
+
+	// truncated values and trailing data
+	tests := []struct {
+		name   string
+		decode BinaryDecoder
+		data   string
+	}{
+		{"msgpack", decodeMsgpack, ""},
+		{"msgpack", decodeMsgpack, "cd01"},
+		{"msgpack", decodeMsgpack, "a568c3a9"},
+		{"msgpack", decodeMsgpack, "92c2"},
+		{"msgpack", decodeMsgpack, "81a161"},
+		{"msgpack", decodeMsgpack, "c0c0"},
+		{"msgpack", decodeMsgpack, "c1"},
+		{"cbor", decodeCBOR, ""},
+		{"cbor", decodeCBOR, "19"},
+		{"cbor", decodeCBOR, "4401"},
+		{"cbor", decodeCBOR, "9f01"},
+		{"cbor", decodeCBOR, "a161"},
+		{"cbor", decodeCBOR, "f6f6"},
+		{"cbor", decodeCBOR, "ff"},
+		// indefinite lengths are only valid for strings, arrays and maps
+		{"cbor", decodeCBOR, "1f"},
+		{"cbor", decodeCBOR, "3f"},
+		{"cbor", decodeCBOR, "df01"},
+		// the chunks of indefinite-length strings must be definite-length
+		// strings of the same type
+		{"cbor", decodeCBOR, "5f"},
+		{"cbor", decodeCBOR, "5f5f4101ffff"},
+		{"cbor", decodeCBOR, "7f7f6161ffff"},
+		{"cbor", decodeCBOR, "7f01ff"},
+		{"cbor", decodeCBOR, "7f4161ff"},
+		{"cbor", decodeCBOR, "5f6161ff"},
+	}
+	for _, tt := range tests {
+		data, err := hex.DecodeString(tt.data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, err := tt.decode(data, SettingsBase{}); err == nil {
+			t.Errorf("%s: %q decoded as %s without errors", tt.name, tt.data, got)
+		}
+	}
+}
+
+func TestBinaryDecodeDepth(t *testing.T) {
+	tests := []struct {
+		name   string
+		decode BinaryDecoder
+		// a value containing itself
+		nested byte
+	}{
+		{"msgpack", decodeMsgpack, 0x91},
+		{"cbor array", decodeCBOR, 0x81},
+		{"cbor tag", decodeCBOR, 0xc1},
+	}
+	for _, tt := range tests {
+		data := bytes.Repeat([]byte{tt.nested}, 1<<20)
+		if _, err := tt.decode(data, SettingsBase{}); !errors.Is(err, errTooDeep) {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, errTooDeep)
+		}
+	}
+
+	// protobuf messages nested too deeply are shown as bytes
+	data := protowire.AppendVarint(protowire.AppendTag(nil, 1, protowire.VarintType), 1)
+	for i := 0; i < 2*maxBinaryDepth; i++ {
+		data = protowire.AppendBytes(protowire.AppendTag(nil, 1, protowire.BytesType), data)
+	}
+	if _, err := decodeProtobuf(data, SettingsBase{}); err != nil {
+		t.Errorf("protobuf: %v", err)
+	}
+}
+
+func TestProtobufWithoutSchema(t *testing.T) {
+	var data []byte
+	data = protowire.AppendVarint(protowire.AppendTag(data, 1, protowire.VarintType), 150)
+	data = protowire.AppendString(protowire.AppendTag(data, 2, protowire.BytesType), "testing")
+	nested := protowire.AppendFixed32(protowire.AppendTag(nil, 1, protowire.Fixed32Type), 7)
+	data = protowire.AppendBytes(protowire.AppendTag(data, 3, protowire.BytesType), nested)
+	data = protowire.AppendBytes(protowire.AppendTag(data, 4, protowire.BytesType), []byte{0xff, 0x00})
+
+	got, err := decodeProtobuf(data, SettingsBase{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"1:varint": 150`, `"2:bytes": "testing"`, `"1:fixed32": 7`, `"4:bytes": h'ff00'`} {
+		if !strings.Contains(got, want) {
+			t.Errorf("%s does not contain %s", got, want)
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		// prefixes can be valid messages, but must not make it panic
+		decodeProtobuf(data[:i], SettingsBase{})
+	}
+}
+
+func TestProtobufRoundTrip(t *testing.T) {
+	// the descriptors of descriptor.proto are used as the schema
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{
+		protodesc.ToFileDescriptorProto(descriptorpb.File_google_protobuf_descriptor_proto),
+	}}
+	b, err := proto.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "descriptor.pb")
+	if err := os.WriteFile(file, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var oSet SettingsBase
+	oSet.Protobuf.DescriptorSet = file
+	oSet.Protobuf.Message = "google.protobuf.FieldDescriptorProto"
+	oSet.Protobuf.SendMessage = oSet.Protobuf.Message
+
+	data, err := encodeProtobuf([]byte(`{"name": "id", "number": 3, "label": "LABEL_REPEATED"}`), oSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := decodeProtobuf(data, oSet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`"name":"id"`, `"number":3`, `"label":"LABEL_REPEATED"`} {
+		if !strings.Contains(compactSpace(got), want) {
+			t.Errorf("%s does not contain %s", got, want)
+		}
+	}
+
+	for i := 0; i < len(data); i++ {
+		decodeProtobuf(data[:i], oSet)
+	}
+	if _, err := encodeProtobuf([]byte(`{"number": "x"}`), oSet); err == nil {
+		t.Error("invalid message encoded without errors")
+	}
+}
+
+// compactSpace removes the whitespace from s.
+func compactSpace(s string) string {
+	return strings.Join(strings.Fields(s), "")
+}
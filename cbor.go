@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// decodeCBOR decodes a CBOR payload.
+func decodeCBOR(msg []byte, oSet SettingsBase) (string, error) {
+	r := &binReader{b: msg}
+	v, err := readCBOR(r)
+	if err != nil {
+		return "", err
+	}
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	return formatTree(v), nil
+}
+
+// CBOR major types
+const (
+	cborUint = iota
+	cborNegInt
+	cborBytes
+	cborText
+	cborArray
+	cborMap
+	cborTag
+	cborSimple
+)
+
+// cborIndefinite is the additional information value signaling an
+// indefinite-length item (or the "break" stop code for major type 7).
+const cborIndefinite = 31
+
+// errCBORBreak is returned by readCBOR when it encounters a "break" stop code.
+var errCBORBreak = errors.New("unexpected CBOR break")
+
+// readCBORHead reads the initial byte and the argument of a data item.
+func readCBORHead(r *binReader) (major byte, info byte, arg uint64, err error) {
+	c, err := r.byte()
+	if err != nil {
+		return
+	}
+	major, info = c>>5, c&0x1f
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		arg, err = r.uint(1 << (info - 24))
+	case info == cborIndefinite:
+		// only strings, arrays and maps can have an indefinite length, and
+		// for major type 7 it is the break stop code
+		if major == cborUint || major == cborNegInt || major == cborTag {
+			err = fmt.Errorf("invalid indefinite length for CBOR major type %d", major)
+		}
+	default:
+		err = fmt.Errorf("invalid CBOR additional information %d", info)
+	}
+	return
+}
+
+func readCBOR(r *binReader) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	major, info, arg, err := readCBORHead(r)
+	if err != nil {
+		return nil, err
+	}
+	indefinite := info == cborIndefinite
+
+	switch major {
+	case cborUint:
+		return arg, nil
+
+	case cborNegInt:
+		if arg <= math.MaxInt64 {
+			return -1 - int64(arg), nil
+		}
+		n := new(big.Int).SetUint64(arg)
+		return n.Sub(n.Neg(n), big.NewInt(1)), nil
+
+	case cborBytes, cborText:
+		var b []byte
+		if indefinite {
+			// concatenation of definite-length chunks of the same type.
+			for {
+				cmajor, cinfo, n, err := readCBORHead(r)
+				if err != nil {
+					return nil, err
+				}
+				if cmajor == cborSimple && cinfo == cborIndefinite {
+					break
+				}
+				if cmajor != major || cinfo == cborIndefinite {
+					return nil, errors.New("invalid chunk in indefinite-length CBOR string")
+				}
+				chunk, err := r.bytes(n)
+				if err != nil {
+					return nil, err
+				}
+				b = append(b, chunk...)
+			}
+		} else if b, err = r.bytes(arg); err != nil {
+			return nil, err
+		}
+		if major == cborText {
+			return string(b), nil
+		}
+		if b == nil {
+			b = []byte{}
+		}
+		return b, nil
+
+	case cborArray:
+		res := []interface{}{}
+		if !indefinite {
+			if err := r.checkLength(arg); err != nil {
+				return nil, err
+			}
+			res = make([]interface{}, 0, arg)
+		}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			v, err := readCBOR(r)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, v)
+		}
+		return res, nil
+
+	case cborMap:
+		res := []mapEntry{}
+		if !indefinite {
+			if err := r.checkLength(arg); err != nil {
+				return nil, err
+			}
+			res = make([]mapEntry, 0, arg)
+		}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			k, err := readCBOR(r)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			v, err := readCBOR(r)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, mapEntry{Key: k, Value: v})
+		}
+		return res, nil
+
+	case cborTag:
+		v, err := readCBOR(r)
+		if err != nil {
+			return nil, err
+		}
+		return taggedValue{Tag: arg, Value: v}, nil
+
+	case cborSimple:
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22:
+			return nil, nil
+		case 23:
+			return undefinedValue{}, nil
+		case 25:
+			return halfToFloat(uint16(arg)), nil
+		case 26:
+			return float64(math.Float32frombits(uint32(arg))), nil
+		case 27:
+			return math.Float64frombits(arg), nil
+		case cborIndefinite:
+			return nil, errCBORBreak
+		}
+		return simpleValue(arg), nil
+	}
+
+	return nil, fmt.Errorf("invalid CBOR data item (major type %d, additional information %d)", major, info)
+}
+
+// halfToFloat converts an IEEE 754 half-precision float to a float64.
+func halfToFloat(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var v float64
+	switch exp {
+	case 0:
+		v = math.Ldexp(mant, -24)
+	case 0x1f:
+		if mant == 0 {
+			v = math.Inf(1)
+		} else {
+			v = math.NaN()
+		}
+	default:
+		v = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		return -v
+	}
+	return v
+}
+
+// encodeCBOR encodes a JSON message as CBOR.
+func encodeCBOR(msg []byte, oSet SettingsBase) ([]byte, error) {
+	v, err := parseJSONTree(msg)
+	if err != nil {
+		return nil, err
+	}
+	w := new(binWriter)
+	if err := writeCBOR(w, v); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+// writeCBORHead writes the initial byte and the argument of a data item,
+// using the shortest encoding.
+func writeCBORHead(w *binWriter, major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		w.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		w.WriteByte(major | 24)
+		w.writeUint(1, arg)
+	case arg <= math.MaxUint16:
+		w.WriteByte(major | 25)
+		w.writeUint(2, arg)
+	case arg <= math.MaxUint32:
+		w.WriteByte(major | 26)
+		w.writeUint(4, arg)
+	default:
+		w.WriteByte(major | 27)
+		w.writeUint(8, arg)
+	}
+}
+
+func writeCBOR(w *binWriter, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(cborSimple<<5 | 22)
+	case bool:
+		if v {
+			w.WriteByte(cborSimple<<5 | 21)
+		} else {
+			w.WriteByte(cborSimple<<5 | 20)
+		}
+	case int64:
+		if v >= 0 {
+			writeCBORHead(w, cborUint, uint64(v))
+		} else {
+			writeCBORHead(w, cborNegInt, uint64(-1-v))
+		}
+	case uint64:
+		writeCBORHead(w, cborUint, v)
+	case float64:
+		w.WriteByte(cborSimple<<5 | 27)
+		w.writeUint(8, math.Float64bits(v))
+	case string:
+		writeCBORHead(w, cborText, uint64(len(v)))
+		w.WriteString(v)
+	case []byte:
+		writeCBORHead(w, cborBytes, uint64(len(v)))
+		w.Write(v)
+	case []interface{}:
+		writeCBORHead(w, cborArray, uint64(len(v)))
+		for _, el := range v {
+			if err := writeCBOR(w, el); err != nil {
+				return err
+			}
+		}
+	case []mapEntry:
+		writeCBORHead(w, cborMap, uint64(len(v)))
+		for _, e := range v {
+			if err := writeCBOR(w, e.Key); err != nil {
+				return err
+			}
+			if err := writeCBOR(w, e.Value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: cannot encode value of type %T", v)
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"github.com/jroimartin/gocui"
+	"github.com/nsf/termbox-go"
+)
+
+// composeHeight returns the number of lines of the cmd view, which grows with
+// the lines of the message being composed, up to a third of the screen.
+func composeHeight(v *gocui.View, maxY int) int {
+	lines := len(v.BufferLines())
+	if max := maxY / 3; lines > max {
+		lines = max
+	}
+	if lines < 1 {
+		lines = 1
+	}
+	return lines
+}
+
+// cursorLine returns the line of the buffer the cursor is on, and the number
+// of lines in the buffer.
+func cursorLine(v *gocui.View) (y, lines int) {
+	_, cy := v.Cursor()
+	_, oy := v.Origin()
+	lines = len(v.BufferLines())
+	if lines < 1 {
+		lines = 1
+	}
+	return cy + oy, lines
+}
+
+// insertNewLine adds a new line to the message being composed.
+func insertNewLine(pSt *State) {
+	pSt.ExecuteFunc(func(g *gocui.Gui) error {
+		v, err := g.View("cmd")
+		if err != nil {
+			return err
+		}
+		v.EditNewLine()
+		return nil
+	})
+}
+
+// editorCommand returns the command used to edit messages: $VISUAL, $EDITOR,
+// or a default one.
+func editorCommand() []string {
+	for _, env := range []string{"VISUAL", "EDITOR"} {
+		if cmd := strings.Fields(os.Getenv(env)); len(cmd) > 0 {
+			return cmd
+		}
+	}
+	if runtime.GOOS == "windows" {
+		return []string{"notepad"}
+	}
+	return []string{"vi"}
+}
+
+// editMessage opens the message being composed in the editor, suspending the
+// interface, and sends the text which is saved, unless it is empty.
+func editMessage(pSt *State) {
+	pSt.ExecuteFunc(func(g *gocui.Gui) error {
+		v, err := g.View("cmd")
+		if err != nil {
+			return err
+		}
+
+		text, err := runEditor(strings.TrimSuffix(v.Buffer(), "\n"), pSt.Settings.Clone().JSONFormatting)
+		if err != nil {
+			pSt.PrintError(err)
+			return nil
+		}
+		if strings.TrimSpace(text) == "" {
+			setText(v, "")
+			pSt.PrintDebug("Empty message, not sent")
+			return nil
+		}
+
+		setText(v, text)
+		submitBuffer(pSt, v)
+		return nil
+	})
+}
+
+// runEditor edits text using the editor, returning the saved text. If json is
+// set, the file has a .json extension, so that editors can highlight it.
+func runEditor(text string, json bool) (string, error) {
+	ext := ".txt"
+	if json {
+		ext = ".json"
+	}
+	f, err := os.CreateTemp("", "claws-*"+ext)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.WriteString(text)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cmdLine := append(editorCommand(), f.Name())
+	cmd := exec.Command(cmdLine[0], cmdLine[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+
+	// the terminal is given back to the editor while it runs. Reinitialising
+	// termbox makes the interface be drawn again from scratch.
+	termbox.Close()
+	err = cmd.Run()
+	if ierr := termbox.Init(); ierr != nil {
+		return "", errors.New("reinitialising the terminal: " + ierr.Error())
+	}
+	if err != nil {
+		return "", errors.New("running " + cmdLine[0] + ": " + err.Error())
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return "", err
+	}
+	// editors usually add a newline at the end of the file
+	text = strings.Replace(string(data), "\r\n", "\n", -1)
+	return strings.TrimRight(text, "\n"), nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/andybalholm/brotli"
+)
+
+// decompressors contains the compression formats which can be chosen using
+// the Decompression setting, other than "auto".
+var decompressors = map[string]func(io.Reader) (io.Reader, error){
+	"gzip": func(r io.Reader) (io.Reader, error) {
+		return gzip.NewReader(r)
+	},
+	"zlib": func(r io.Reader) (io.Reader, error) {
+		return zlib.NewReader(r)
+	},
+	"deflate": func(r io.Reader) (io.Reader, error) {
+		return flate.NewReader(r), nil
+	},
+	"brotli": func(r io.Reader) (io.Reader, error) {
+		return brotli.NewReader(r), nil
+	},
+}
+
+// decompressionNames returns the sorted names of the possible values of the
+// Decompression setting.
+func decompressionNames() []string {
+	names := []string{"auto"}
+	for name := range decompressors {
+		names = append(names, name)
+	}
+	sort.Strings(names[1:])
+	return names
+}
+
+// maxDecompressedSize is the maximum size of a decompressed message.
+const maxDecompressedSize = 64 << 20
+
+// detectCompression returns the compression format of msg, based on its magic
+// bytes, or an empty string if it is not recognised. Only gzip and zlib can be
+// detected.
+func detectCompression(msg []byte) string {
+	switch {
+	case len(msg) >= 3 && msg[0] == 0x1f && msg[1] == 0x8b && msg[2] == 8:
+		return "gzip"
+	// compression method 8 (deflate) and valid header checksum
+	case len(msg) >= 2 && msg[0]&0x0f == 8 && msg[0]>>4 <= 7 &&
+		(uint(msg[0])<<8|uint(msg[1]))%31 == 0:
+		return "zlib"
+	}
+	return ""
+}
+
+// decompressMessage decompresses msg according to the Decompression setting.
+// If the message is decompressed, header describes the compression format and
+// ratio; otherwise, msg is returned unchanged with an empty header.
+// When auto-detecting, messages which fail to decompress are returned
+// unchanged without an error, as the detection may be wrong.
+func decompressMessage(msg []byte, oSet SettingsBase) ([]byte, string, error) {
+	format := oSet.Decompression
+	if format == "auto" {
+		format = detectCompression(msg)
+	}
+	if _, ok := decompressors[format]; !ok {
+		return msg, "", nil
+	}
+
+	res, err := decompress(msg, format)
+	if err != nil {
+		if oSet.Decompression == "auto" {
+			err = nil
+		}
+		return msg, "", err
+	}
+
+	header := fmt.Sprintf("[%s %d -> %d bytes", format, len(msg), len(res))
+	if len(msg) > 0 {
+		header += fmt.Sprintf(", ratio %.2f", float64(len(res))/float64(len(msg)))
+	}
+	return res, header + "] ", nil
+}
+
+func decompress(msg []byte, format string) ([]byte, error) {
+	r, err := decompressors[format](bytes.NewReader(msg))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", format, err)
+	}
+	res, err := io.ReadAll(io.LimitReader(r, maxDecompressedSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", format, err)
+	}
+	if len(res) > maxDecompressedSize {
+		return nil, fmt.Errorf("%s: decompressed message larger than %d bytes", format, maxDecompressedSize)
+	}
+	return res, nil
+}
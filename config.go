@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// settingsVersion is the version of the layout of the configuration file.
+// It must be increased, and a migration added to settingsMigrations, whenever
+// a setting is renamed, moved or changes type.
+const settingsVersion = 2
+
+// settingsMigrations contains the functions which migrate the top-level
+// values of a configuration file from the version at their index to the
+// following one.
+var settingsMigrations = [settingsVersion]func(values map[string]json.RawMessage) error{
+	// files written before the version was introduced have the same layout
+	// as version 1.
+	0: func(values map[string]json.RawMessage) error { return nil },
+	// LastActions, shared by all the connections, was replaced by History,
+	// which has a list for each URL. The actions are assigned to the last URL
+	// which was connected to.
+	1: func(values map[string]json.RawMessage) error {
+		actions, ok := values["LastActions"]
+		if !ok {
+			return nil
+		}
+		delete(values, "LastActions")
+		var url string
+		json.Unmarshal(values["LastWebsocketURL"], &url)
+		history, err := json.Marshal(map[string]json.RawMessage{url: actions})
+		values["History"] = history
+		return err
+	},
+}
+
+// settingsFile contains the information about a configuration file found
+// while reading it.
+type settingsFile struct {
+	exists bool
+	// top-level values, after the migrations
+	values map[string]json.RawMessage
+	// keys which don't correspond to any setting
+	unknown []unknownKey
+	// problems which don't prevent the file from being used
+	warnings []string
+}
+
+// unknownKey is a key of the configuration file which doesn't correspond to
+// any setting. Unknown keys are kept when the file is rewritten.
+type unknownKey struct {
+	// path of the key: the names of the fields and map keys (strings) and
+	// indexes of arrays (ints) leading to it
+	path  []interface{}
+	value json.RawMessage
+}
+
+func (k unknownKey) String() string { return formatConfigPath(k.path) }
+
+// configError is an invalid value in a configuration file.
+type configError struct {
+	Path     string
+	Expected string
+	Got      string
+}
+
+func (e *configError) Error() string {
+	return fmt.Sprintf("%s: expected %s, got %s", e.Path, e.Expected, e.Got)
+}
+
+// configErrors are all the invalid values found in a configuration file.
+type configErrors []*configError
+
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "\n\t" + err.Error()
+	}
+	return fmt.Sprintf("%d invalid values:%s", len(e), strings.Join(lines, ""))
+}
+
+// parseSettings decodes data, the contents of a configuration file, into
+// oSet. Only the settings which are in data are set. The file is migrated to
+// the current version and validated: if values have the wrong type, a
+// configErrors is returned, reporting all of them.
+func parseSettings(data []byte, oSet *SettingsBase) (sf settingsFile, err error) {
+	sf.exists = true
+	if err = json.Unmarshal(data, &sf.values); err != nil {
+		return sf, describeJSONError(data, err)
+	}
+	if sf.values == nil {
+		return sf, errors.New("expected an object, got null")
+	}
+
+	var version int
+	if raw, ok := sf.values["Version"]; ok {
+		if err = json.Unmarshal(raw, &version); err != nil || version < 0 {
+			return sf, configErrors{{"Version", "non-negative integer", describeJSON(raw)}}
+		}
+	}
+	if version > settingsVersion {
+		sf.warnings = append(sf.warnings, fmt.Sprintf(
+			"the file was written by a newer version of claws (configuration version %d, supported up to %d)",
+			version, settingsVersion))
+	}
+	for ; version < settingsVersion; version++ {
+		if err = settingsMigrations[version](sf.values); err != nil {
+			return sf, fmt.Errorf("migrating from version %d: %w", version, err)
+		}
+		sf.values["Version"] = json.RawMessage(strconv.Itoa(version + 1))
+	}
+
+	var errs configErrors
+	checkConfigObject(nil, sf.values, reflect.TypeOf(*oSet), &errs, &sf.unknown)
+	if len(errs) > 0 {
+		return sf, errs
+	}
+	for _, k := range sf.unknown {
+		sf.warnings = append(sf.warnings, fmt.Sprintf("unknown key %s; it is kept but ignored", k))
+	}
+
+	data, err = json.Marshal(sf.values)
+	if err == nil {
+		err = json.Unmarshal(data, oSet)
+	}
+	return sf, err
+}
+
+// describeJSONError adds the position of syntax errors to err.
+func describeJSONError(data []byte, err error) error {
+	var serr *json.SyntaxError
+	if !errors.As(err, &serr) {
+		return err
+	}
+	before := data[:serr.Offset]
+	line := bytes.Count(before, []byte{'\n'}) + 1
+	col := len(before) - bytes.LastIndexByte(before, '\n')
+	return fmt.Errorf("line %d, column %d: %w", line, col, err)
+}
+
+// checkConfigValue checks that raw can be decoded into a value of type t,
+// adding the values which can't to errs and the keys which don't correspond
+// to any field of a struct to unknown.
+func checkConfigValue(path []interface{}, raw json.RawMessage, t reflect.Type, errs *configErrors, unknown *[]unknownKey) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || string(raw) == "null" {
+		// leaves the setting unchanged
+		return
+	}
+	fnError := func(expected string) {
+		*errs = append(*errs, &configError{formatConfigPath(path), expected, describeJSON(raw)})
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		var values map[string]json.RawMessage
+		if raw[0] != '{' || json.Unmarshal(raw, &values) != nil {
+			fnError("object")
+			return
+		}
+		if t.Kind() == reflect.Struct {
+			checkConfigObject(path, values, t, errs, unknown)
+			return
+		}
+		for _, k := range sortedKeys(values) {
+			checkConfigValue(appendPath(path, k), values[k], t.Elem(), errs, unknown)
+		}
+	case reflect.Slice:
+		var values []json.RawMessage
+		if raw[0] != '[' || json.Unmarshal(raw, &values) != nil {
+			fnError("array")
+			return
+		}
+		for i, v := range values {
+			checkConfigValue(appendPath(path, i), v, t.Elem(), errs, unknown)
+		}
+	default:
+		if json.Unmarshal(raw, reflect.New(t).Interface()) != nil {
+			fnError(describeType(t))
+		}
+	}
+}
+
+// checkConfigObject checks the values of a JSON object which is decoded into
+// a struct of type t.
+func checkConfigObject(path []interface{}, values map[string]json.RawMessage, t reflect.Type, errs *configErrors, unknown *[]unknownKey) {
+	fields := configFields(t)
+	for _, k := range sortedKeys(values) {
+		field, ok := lookupConfigField(fields, k)
+		if !ok {
+			*unknown = append(*unknown, unknownKey{appendPath(path, k), values[k]})
+			continue
+		}
+		checkConfigValue(appendPath(path, field.Name), values[k], field.Type, errs, unknown)
+	}
+}
+
+// lookupConfigField returns the field of fields into which the value of key
+// is decoded.
+func lookupConfigField(fields map[string]reflect.StructField, key string) (reflect.StructField, bool) {
+	if f, ok := fields[key]; ok {
+		return f, true
+	}
+	// encoding/json matches the names of the fields case-insensitively
+	for name, f := range fields {
+		if strings.EqualFold(name, key) {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// configFields returns the fields of struct type t which are decoded from
+// JSON, including the ones of embedded structs, by name.
+func configFields(t reflect.Type) map[string]reflect.StructField {
+	fields := make(map[string]reflect.StructField)
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		switch {
+		case f.Tag.Get("json") == "-":
+		case f.Anonymous && f.Type.Kind() == reflect.Struct:
+			for name, f := range configFields(f.Type) {
+				if _, ok := fields[name]; !ok {
+					fields[name] = f
+				}
+			}
+		case f.PkgPath == "":
+			// exported
+			fields[f.Name] = f
+		}
+	}
+	return fields
+}
+
+func appendPath(path []interface{}, el interface{}) []interface{} {
+	return append(path[:len(path):len(path)], el)
+}
+
+func formatConfigPath(path []interface{}) string {
+	var sb strings.Builder
+	for _, el := range path {
+		switch el := el.(type) {
+		case int:
+			fmt.Fprintf(&sb, "[%d]", el)
+		case string:
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			sb.WriteString(el)
+		}
+	}
+	return sb.String()
+}
+
+func sortedKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func describeType(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return "integer"
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "non-negative integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	}
+	return t.String()
+}
+
+// describeJSON describes the type and value of a JSON value, for errors.
+func describeJSON(raw json.RawMessage) string {
+	s := string(raw)
+	if len(s) > 40 {
+		s = s[:37] + "..."
+	}
+	switch raw[0] {
+	case '"':
+		return "string " + s
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case 't', 'f':
+		return "boolean " + s
+	case 'n':
+		return "null"
+	}
+	return "number " + s
+}
+
+// addUnknownKeys adds the unknown keys to data, a configuration file encoded
+// by writeSettingsFile, indenting it again. The keys inside objects which
+// don't exist any longer are dropped.
+func addUnknownKeys(data []byte, unknown []unknownKey) ([]byte, error) {
+	tree, err := parseJSONTree(data)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range unknown {
+		tree = insertJSONTree(tree, k.path, k.value)
+	}
+
+	buf := new(bytes.Buffer)
+	writeJSONTree(buf, tree)
+	res := new(bytes.Buffer)
+	if err := json.Indent(res, buf.Bytes(), "", "\t"); err != nil {
+		return nil, err
+	}
+	res.WriteByte('\n')
+	return res.Bytes(), nil
+}
+
+func insertJSONTree(v interface{}, path []interface{}, value json.RawMessage) interface{} {
+	switch v := v.(type) {
+	case []mapEntry:
+		name, ok := path[0].(string)
+		if !ok {
+			return v
+		}
+		if len(path) == 1 {
+			return append(v, mapEntry{Key: name, Value: value})
+		}
+		for i := range v {
+			if v[i].Key == name {
+				v[i].Value = insertJSONTree(v[i].Value, path[1:], value)
+				break
+			}
+		}
+	case []interface{}:
+		if i, ok := path[0].(int); ok && i < len(v) && len(path) > 1 {
+			v[i] = insertJSONTree(v[i], path[1:], value)
+		}
+	}
+	return v
+}
+
+// writeJSONTree writes a value returned by parseJSONTree, or a
+// json.RawMessage, as compact JSON.
+func writeJSONTree(buf *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case []mapEntry:
+		buf.WriteByte('{')
+		for i, e := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONString(buf, e.Key.(string))
+			buf.WriteByte(':')
+			writeJSONTree(buf, e.Value)
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, el := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeJSONTree(buf, el)
+		}
+		buf.WriteByte(']')
+	case json.RawMessage:
+		json.Compact(buf, v)
+	case string:
+		writeJSONString(buf, v)
+	default:
+		// nil, bool and numbers
+		b, _ := json.Marshal(v)
+		buf.Write(b)
+	}
+}
+
+// CheckConfig validates the configuration files, printing the problems
+// found. If files is empty, configFile (claws.json if empty, see
+// getConfigFile) and the project-local configuration file are checked. It
+// returns false if any file is invalid.
+func CheckConfig(configFile string, files []string) bool {
+	defaults := len(files) == 0
+	if defaults {
+		file := configFile
+		if file == "" {
+			var err error
+			if file, err = getConfigFile(); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return false
+			}
+		}
+		files = append(files, file)
+		if local := findLocalConfig(); local != "" && !sameFile(local, file) {
+			files = append(files, local)
+		}
+	}
+
+	ok := true
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if defaults && os.IsNotExist(err) {
+			fmt.Printf("%s: does not exist, the default settings are used\n", file)
+			continue
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			ok = false
+			continue
+		}
+		var oSet SettingsBase
+		sf, err := parseSettings(data, &oSet)
+		if err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			ok = false
+			continue
+		}
+		if filepath.Base(file) == localConfigName {
+			_, localWarnings := readLocalConfig(sf.values, oSet)
+			sf.warnings = append(sf.warnings, localWarnings...)
+		}
+		for _, w := range sf.warnings {
+			fmt.Printf("%s: warning: %s\n", file, w)
+		}
+		fmt.Printf("%s: ok\n", file)
+	}
+	return ok
+}
+
+// ConfigCommand runs `claws config`, whose only subcommand is check.
+func ConfigCommand(args []string) error {
+	const usage = "usage: claws config check [-config FILE] [FILE...]"
+	if len(args) == 0 || args[0] != "check" {
+		return errors.New(usage)
+	}
+	fs := flag.NewFlagSet("claws config check", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config", "", "Path of the configuration file to check when no files are given.\nDefaults to $CLAWS_CONFIG, or claws.json in $XDG_CONFIG_HOME or ~/.config.")
+	err := fs.Parse(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !CheckConfig(*configFile, fs.Args()) {
+		return errors.New("the configuration is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSettingsMigration(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		history map[string][]string
+		// unknown keys, and the start of the warnings
+		unknown  []string
+		warnings []string
+	}{
+		{
+			name:    "LastActions moved to the last URL",
+			data:    `{"LastWebsocketURL": "ws://a", "LastActions": ["x", "y"]}`,
+			history: map[string][]string{"ws://a": {"x", "y"}},
+		},
+		{
+			name:    "version 1",
+			data:    `{"Version": 1, "LastWebsocketURL": "ws://a", "LastActions": ["x"]}`,
+			history: map[string][]string{"ws://a": {"x"}},
+		},
+		{
+			name:    "no URL",
+			data:    `{"LastActions": ["x"]}`,
+			history: map[string][]string{"": {"x"}},
+		},
+		{
+			name: "no LastActions",
+			data: `{"LastWebsocketURL": "ws://a"}`,
+		},
+		{
+			name:     "LastActions in version 2",
+			data:     `{"Version": 2, "LastActions": ["x"]}`,
+			unknown:  []string{"LastActions"},
+			warnings: []string{"unknown key LastActions"},
+		},
+		{
+			name:     "newer version",
+			data:     `{"Version": 3, "History": {"ws://a": ["x"]}}`,
+			history:  map[string][]string{"ws://a": {"x"}},
+			warnings: []string{"the file was written by a newer version"},
+		},
+	}
+	for _, tt := range tests {
+		var oSet SettingsBase
+		sf, err := parseSettings([]byte(tt.data), &oSet)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(oSet.History, tt.history) {
+			t.Errorf("%s: got history %v, want %v", tt.name, oSet.History, tt.history)
+		}
+		if _, ok := sf.values["LastActions"]; ok && tt.unknown == nil {
+			t.Errorf("%s: LastActions was not removed", tt.name)
+		}
+		if oSet.Version < settingsVersion {
+			t.Errorf("%s: got version %d, want %d", tt.name, oSet.Version, settingsVersion)
+		}
+		var unknown []string
+		for _, k := range sf.unknown {
+			unknown = append(unknown, k.String())
+		}
+		if !reflect.DeepEqual(unknown, tt.unknown) {
+			t.Errorf("%s: got unknown keys %v, want %v", tt.name, unknown, tt.unknown)
+		}
+		if len(sf.warnings) != len(tt.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", tt.name, sf.warnings, tt.warnings)
+			continue
+		}
+		for i, w := range sf.warnings {
+			if !strings.HasPrefix(w, tt.warnings[i]) {
+				t.Errorf("%s: got warning %q, want %q", tt.name, w, tt.warnings[i])
+			}
+		}
+	}
+}
+
+func TestParseSettings(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		// unknown keys, and the start of the warnings
+		unknown  []string
+		warnings []string
+	}{
+		{
+			name: "no version",
+			data: `{"LastWebsocketURL": "ws://a"}`,
+		},
+		{
+			name:    "unknown keys",
+			data:    `{"Version": 1, "Colour": true, "Protobuf": {"Schema": "x"}}`,
+			unknown: []string{"Colour", "Protobuf.Schema"},
+			warnings: []string{
+				"unknown key Colour",
+				"unknown key Protobuf.Schema",
+			},
+		},
+		{
+			name:     "newer version",
+			data:     `{"Version": 99, "LastWebsocketURL": "ws://a"}`,
+			warnings: []string{"the file was written by a newer version"},
+		},
+	}
+	for _, tt := range tests {
+		var oSet SettingsBase
+		sf, err := parseSettings([]byte(tt.data), &oSet)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if oSet.Version < settingsVersion {
+			t.Errorf("%s: got version %d, want %d", tt.name, oSet.Version, settingsVersion)
+		}
+		var unknown []string
+		for _, k := range sf.unknown {
+			unknown = append(unknown, k.String())
+		}
+		if !reflect.DeepEqual(unknown, tt.unknown) {
+			t.Errorf("%s: got unknown keys %v, want %v", tt.name, unknown, tt.unknown)
+		}
+		if len(sf.warnings) != len(tt.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", tt.name, sf.warnings, tt.warnings)
+			continue
+		}
+		for i, w := range sf.warnings {
+			if !strings.HasPrefix(w, tt.warnings[i]) {
+				t.Errorf("%s: got warning %q, want %q", tt.name, w, tt.warnings[i])
+			}
+		}
+	}
+}
+
+func TestParseSettingsErrors(t *testing.T) {
+	tests := []struct {
+		data string
+		// the start of the error
+		err string
+	}{
+		{`[]`, "json: cannot unmarshal array"},
+		{"{\n  \"Version\": 1,\n}", "line 3, column "},
+		{`null`, "expected an object, got null"},
+		{`{"Version": -1}`, "Version: expected non-negative integer"},
+		{`{"PingSeconds": "10"}`, "PingSeconds: expected integer"},
+		{`{"History": {"ws://a": [1]}}`, "History.ws://a[0]: expected string"},
+		{`{"PingSeconds": true, "Headers": "a"}`, "2 invalid values"},
+		{`{"Version": 1, "LastWebsocketURL": "ws://a", "LastActions": 3}`, "History.ws://a: expected array"},
+	}
+	for _, tt := range tests {
+		var oSet SettingsBase
+		_, err := parseSettings([]byte(tt.data), &oSet)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.data, err, tt.err)
+		}
+	}
+}
+
+func TestParseFlagsProfile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "claws.json")
+	data := `{"Profiles": {"p": {"URL": "ws://p", "Headers": ["A: b"]}}}`
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	oSet, err := LoadSettings(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	args, cl := os.Args, flag.CommandLine
+	defer func() { os.Args, flag.CommandLine = args, cl }()
+	os.Args = []string{"claws", "-P", "p", "-H", "C: d", "-j"}
+	flag.CommandLine = flag.NewFlagSet("claws", flag.ContinueOnError)
+
+	opts, err := oSet.ParseFlags("p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts == nil || !reflect.DeepEqual(opts.Headers, []string{"C: d"}) {
+		t.Fatalf("got options %+v, want the header of the flag, which overrides the profile", opts)
+	}
+	if len(oSet.Headers) > 0 {
+		t.Errorf("the settings got the headers %q", oSet.Headers)
+	}
+	if oSet.LastWebsocketURL != "ws://p" || !oSet.JSONFormatting {
+		t.Errorf("got URL %q and JSON formatting %v, want ws://p and true", oSet.LastWebsocketURL, oSet.JSONFormatting)
+	}
+
+	saved, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(saved), "C: d") {
+		t.Errorf("the headers were saved: %s", saved)
+	}
+}
+
+func TestReadLocalConfig(t *testing.T) {
+	tests := []struct {
+		data     string
+		values   []string
+		profiles []string
+		// start of the warnings
+		warnings []string
+	}{
+		{
+			data:   `{"JSONFormatting": true, "Headers": ["A: ${env:B}"], "STOMP": {"Login": "x"}}`,
+			values: []string{"Headers", "JSONFormatting", "STOMP"},
+		},
+		{
+			data:     `{"pipe": {"In": ["cat"]}, "LastWebsocketURL": "ws://a", "History": {}}`,
+			warnings: []string{"History is ignored", "LastWebsocketURL is ignored", "Pipe is ignored"},
+		},
+		{
+			data:     `{"TLS": {"Insecure": true, "CAFile": "/etc/ca.pem"}, "Protobuf": {"DescriptorSet": "a.pb"}}`,
+			values:   []string{"Protobuf", "TLS"},
+			warnings: []string{"Protobuf.DescriptorSet is ignored", "TLS.CAFile is ignored"},
+		},
+		{
+			data:     `{"Proxy": "${cmd:echo x}", "OnConnect": ["${file:/etc/passwd}"], "Timestamp": "$${cmd:x}"}`,
+			values:   []string{"Timestamp"},
+			warnings: []string{"OnConnect is ignored: ${file:/etc/passwd} references", "Proxy is ignored: ${cmd:echo x} references"},
+		},
+		{
+			data:     `{"Profiles": {"a": {"URL": "ws://a", "Pipe": {"Out": ["tee"]}}, "b": {"URL": "ws://b", "MQTT": {"Password": "${cmd:pass}"}}}}`,
+			profiles: []string{"a"},
+			warnings: []string{`profile "a": Pipe is ignored`, `profile "b" is ignored: ${cmd:pass} references`},
+		},
+		{
+			data: `{"Info": "x", "Version": 2, "Templates": {"t": "${cmd:x}"}}`,
+		},
+	}
+	for _, tt := range tests {
+		var oSet SettingsBase
+		sf, err := parseSettings([]byte(tt.data), &oSet)
+		if err != nil {
+			t.Errorf("%s: %v", tt.data, err)
+			continue
+		}
+		lc, warnings := readLocalConfig(sf.values, oSet)
+		var values, profiles []string
+		for key := range lc.values {
+			values = append(values, key)
+		}
+		for name := range lc.profiles {
+			profiles = append(profiles, name)
+		}
+		sort.Strings(values)
+		sort.Strings(profiles)
+		if !reflect.DeepEqual(values, tt.values) {
+			t.Errorf("%s: got values %q, want %q", tt.data, values, tt.values)
+		}
+		if !reflect.DeepEqual(profiles, tt.profiles) {
+			t.Errorf("%s: got profiles %q, want %q", tt.data, profiles, tt.profiles)
+		}
+		if len(warnings) != len(tt.warnings) {
+			t.Errorf("%s: got warnings %q, want %q", tt.data, warnings, tt.warnings)
+			continue
+		}
+		for i, w := range warnings {
+			if !strings.HasPrefix(w, tt.warnings[i]) {
+				t.Errorf("%s: got warning %q, want %q", tt.data, w, tt.warnings[i])
+			}
+		}
+	}
+}
+
+func TestLocalConfigOverlay(t *testing.T) {
+	dir := t.TempDir()
+	file, local := filepath.Join(dir, "claws.json"), filepath.Join(dir, localConfigName)
+	if err := os.WriteFile(file, []byte(`{"PingSeconds": 5, "Headers": ["A: b"], "TLS": {"CAFile": "ca.pem"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(local, []byte(`{"PingSeconds": 10, "TLS": {"Insecure": true}, "Templates": {"t": "x"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	oSet, lc, _, err := readConfigFiles(file, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if oSet.PingSeconds != 10 || !oSet.TLS.Insecure || oSet.TLS.CAFile != "ca.pem" || len(oSet.Headers) != 1 {
+		t.Fatalf("got settings %+v, want those of claws.json with the local values", oSet.ConnectionOptions)
+	}
+
+	s := Settings{SettingsBase: oSet, file: file, localFile: local, local: lc, loaded: oSet.Clone()}
+	if _, err := s.Template("t"); err == nil {
+		t.Errorf("the local template is in the settings")
+	}
+	if clone := s.Clone(); clone.Templates["t"] != "x" {
+		t.Errorf("got templates %v, want the local template", clone.Templates)
+	}
+
+	// PingSeconds is written only once it is changed
+	s.JSONFormatting = true
+	if err := s.Update("JSONFormatting", "PingSeconds", "TLS"); err != nil {
+		t.Fatal(err)
+	}
+	onDisk, _, err := readSettingsFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !onDisk.JSONFormatting || onDisk.PingSeconds != 5 || onDisk.TLS.Insecure || onDisk.Templates != nil {
+		t.Errorf("got %+v on disk, want the values of claws.json", onDisk)
+	}
+	s.PingSeconds = 15
+	if err := s.Update("PingSeconds"); err != nil {
+		t.Fatal(err)
+	}
+	if onDisk, _, _ = readSettingsFile(file); onDisk.PingSeconds != 15 {
+		t.Errorf("got PingSeconds %d on disk, want 15", onDisk.PingSeconds)
+	}
+}
+
+func TestConfigCommandConfigFlag(t *testing.T) {
+	dir := t.TempDir()
+	valid, invalid := filepath.Join(dir, "valid.json"), filepath.Join(dir, "invalid.json")
+	os.WriteFile(valid, []byte(`{"PingSeconds": 5}`), 0o600)
+	os.WriteFile(invalid, []byte(`{"PingSeconds": "x"}`), 0o600)
+	t.Setenv("CLAWS_CONFIG", valid)
+
+	if err := ConfigCommand([]string{"check"}); err != nil {
+		t.Errorf("check: %v", err)
+	}
+	if err := ConfigCommand([]string{"check", "-config", invalid}); err == nil {
+		t.Errorf("check -config %s: the file is valid", invalid)
+	}
+	if err := ConfigCommand([]string{"check", "-config", invalid, valid}); err != nil {
+		t.Errorf("check -config %s %s: %v", invalid, valid, err)
+	}
+}
@@ -20,7 +20,12 @@ func NewLayoutFunc(pSt *State) LayoutFunc {
 		}
 
 		maxX, maxY := pGui.Size()
-		if v, err := pGui.SetView("cmd", 1, maxY-2, maxX, maxY); err != nil {
+		// the cmd view grows with the lines of the message
+		cmdY := maxY - 2
+		if v, err := pGui.View("cmd"); err == nil {
+			cmdY = maxY - 1 - composeHeight(v, maxY)
+		}
+		if v, err := pGui.SetView("cmd", 1, cmdY, maxX, maxY); err != nil {
 			if err != gocui.ErrUnknownView {
 				return err
 			}
@@ -31,7 +36,7 @@ func NewLayoutFunc(pSt *State) LayoutFunc {
 		}
 
 		// View: output for received messages (rest)
-		v, err := pGui.SetView("out", -1, -1, maxX, maxY-2)
+		v, err := pGui.SetView("out", -1, -1, maxX, cmdY)
 		if err != nil {
 			if err != gocui.ErrUnknownView {
 				return err
@@ -89,9 +94,15 @@ func NewLayoutFunc(pSt *State) LayoutFunc {
 			return err
 		}
 
-		modeBox(pSt, pGui)
+		modeBox(pSt, pGui, cmdY)
 
 		if !pSt.FirstDrawDone {
+			for _, w := range pSt.Settings.Warnings() {
+				pSt.PrintDebug("Warning: " + w)
+			}
+			if _, local := pSt.Settings.ConfigFiles(); local != "" {
+				pSt.PrintDebug("Using project configuration " + local)
+			}
 			if pSt.Settings.LastWebsocketURL != "" {
 				pSt.PrintDebug(fmt.Sprintf("The last URL you connected to was %q. Type <Esc>c<Enter> to connect.", pSt.Settings.LastWebsocketURL))
 			}
@@ -102,16 +113,28 @@ func NewLayoutFunc(pSt *State) LayoutFunc {
 	}
 }
 
-func modeBox(pSt *State, g *gocui.Gui) {
-	maxX, maxY := g.Size()
+// modeBox draws the line above the cmd view, which starts at y, with the
+// status of the protocol layer on its right, and the mode indicator on its
+// left.
+func modeBox(pSt *State, g *gocui.Gui, y int) {
+	maxX, _ := g.Size()
 
 	for i := 0; i < maxX; i++ {
-		g.SetRune(i, maxY-2, '─', gocui.ColorWhite, gocui.ColorBlack)
+		g.SetRune(i, y, '─', gocui.ColorWhite, gocui.ColorBlack)
+	}
+	if status := []rune(pSt.layerStatus()); len(status) > 0 && maxX > 10 {
+		if len(status) > maxX-4 {
+			status = append(status[:maxX-5], '…')
+		}
+		x := maxX - len(status) - 2
+		for i, r := range status {
+			g.SetRune(x+i, y, r, gocui.ColorCyan, gocui.ColorBlack)
+		}
 	}
 
 	ch := modeChars[pSt.Mode]
-	g.SetRune(0, maxY-1, ch.Char, gocui.ColorWhite|gocui.AttrBold, ch.BgColor)
-	g.SetRune(1, maxY-1, ' ', gocui.ColorBlack, 0)
+	g.SetRune(0, y+1, ch.Char, gocui.ColorWhite|gocui.AttrBold, ch.BgColor)
+	g.SetRune(1, y+1, ' ', gocui.ColorBlack, 0)
 }
 
 type ActionFunc func(*State, string)
@@ -119,10 +142,18 @@ type ActionFunc func(*State, string)
 // enterActions is the actions that can be done when KeyEnter is pressed
 // (outside of modeEscape), based on the mode.
 var enterActions = [modeMax]ActionFunc{
-	modeInsert:    enterActionSendMessage,
-	modeOverwrite: enterActionSendMessage,
-	modeConnect:   enterActionConnect,
-	modeSetPing:   enterActionSetPing,
+	modeInsert:      enterActionSendMessage,
+	modeOverwrite:   enterActionSendMessage,
+	modeConnect:     enterActionConnect,
+	modeSetPing:     enterActionSetPing,
+	modeSetDecoder:  enterActionSetDecoder,
+	modeSetEncoder:  enterActionSetEncoder,
+	modeSaveProfile: enterActionSaveProfile,
+	modeTemplate:    enterActionTemplate,
+	modeSchedule:    enterActionSchedule,
+	modeWatch:       enterActionWatch,
+	modeSetProtocol: enterActionSetProtocol,
+	modePrompt:      enterActionPrompt,
 }
 
 type EditorFunc func(v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier)
@@ -135,6 +166,9 @@ func NewEditorFunc(pSt *State) EditorFunc {
 			escEditor(pSt, v, key, ch, mod)
 			return
 		}
+		if pSt.search != nil && searchEditor(pSt, v, key, ch, mod) {
+			return
+		}
 
 		if ch != 0 && mod == 0 {
 			v.EditWrite(ch)
@@ -142,6 +176,7 @@ func NewEditorFunc(pSt *State) EditorFunc {
 
 		switch key {
 		case gocui.KeyEsc:
+			pSt.CancelPending()
 			pSt.Mode = modeEscape
 			pSt.KeepAutoscrolling = true
 
@@ -159,12 +194,12 @@ func NewEditorFunc(pSt *State) EditorFunc {
 			v.MoveCursor(-1, 0, false)
 			moveAhead(v)
 		case gocui.KeyArrowRight:
-			x, _ := v.Cursor()
+			x, y := v.Cursor()
 			x2, _ := v.Origin()
 			x += x2
-			buf := v.Buffer()
+			line, _ := v.Line(y)
 			// Position of cursor should be on space that gocui adds at the end if at end
-			if buf != "" && len(strings.TrimRight(buf, "\r\n")) > x {
+			if y, lines := cursorLine(v); len(line) > x || y < lines-1 {
 				v.MoveCursor(1, 0, false)
 			}
 
@@ -177,36 +212,78 @@ func NewEditorFunc(pSt *State) EditorFunc {
 			}
 			v.Overwrite = pSt.Mode == modeOverwrite
 
-		// History browse
+		// Profile and template pickers
+		case gocui.KeyTab:
+			oSet := pSt.Settings.Clone()
+			switch pSt.Mode {
+			case modeConnect:
+				if name := nextName(oSet.ProfileNames(), v.Buffer()); name != "" {
+					setText(v, "@"+name)
+				}
+			case modeTemplate:
+				if name := nextName(oSet.TemplateNames(), v.Buffer()); name != "" {
+					setText(v, name)
+				}
+			}
+
+		// Multi-line messages: <Ctrl-J> adds a new line, as does <Esc><Enter>
+		// (see escEditor)
+		case gocui.KeyCtrlJ:
+			if pSt.Mode == modeInsert || pSt.Mode == modeOverwrite {
+				v.EditNewLine()
+			}
+
+		// History browse, or moving between the lines of the message
 		case gocui.KeyArrowDown:
+			if y, lines := cursorLine(v); y < lines-1 {
+				v.MoveCursor(0, 1, false)
+				return
+			}
 			n := pSt.BrowseActions(-1)
 			setText(v, n)
 		case gocui.KeyArrowUp:
+			if y, _ := cursorLine(v); y > 0 {
+				v.MoveCursor(0, -1, false)
+				return
+			}
 			n := pSt.BrowseActions(1)
 			setText(v, n)
+		case gocui.KeyCtrlR:
+			startSearch(pSt, v)
 
 		case gocui.KeyEnter:
-			buf := v.Buffer()
-			v.Clear()
-			v.SetCursor(0, 0)
+			submitBuffer(pSt, v)
+		}
+	}
+}
 
-			if buf != "" {
-				buf = buf[:len(buf)-1]
-			}
-			if strings.TrimSpace(buf) != "" {
-				pSt.PushAction(buf)
-				pSt.ActionIndex = -1
-			}
+// submitBuffer clears the view, adding its text to the history, and runs the
+// enter action of the current mode.
+func submitBuffer(pSt *State, v *gocui.View) {
+	buf := v.Buffer()
+	v.Clear()
+	v.SetCursor(0, 0)
 
-			enterActions[pSt.Mode](pSt, buf)
-		}
+	if buf != "" {
+		buf = buf[:len(buf)-1]
+	}
+	// the values typed for prompts are often secrets, which must not be
+	// saved to the history
+	if strings.TrimSpace(buf) != "" && pSt.Mode != modePrompt {
+		pSt.PushAction(buf)
+		pSt.ActionIndex = -1
 	}
+
+	enterActions[pSt.Mode](pSt, buf)
 }
 
+// setText replaces the text of the view, moving the cursor to its end.
 func setText(v *gocui.View, text string) {
 	v.Clear()
+	v.SetOrigin(0, 0)
 	v.Write([]byte(text))
-	v.SetCursor(len(text), 0)
+	lines := strings.Split(text, "\n")
+	v.SetCursor(len(lines[len(lines)-1]), len(lines)-1)
 }
 
 // moveAhead makes sure there are at least 8 characters visibile to the left
@@ -221,11 +298,98 @@ func moveAhead(v *gocui.View) {
 			forward += newOX
 			newOX = 0
 		}
-		v.SetOrigin(newOX, 0)
+		_, oY := v.Origin()
+		v.SetOrigin(newOX, oY)
 		v.MoveCursor(forward, 0, false)
 	}
 }
 
+// enterActionSchedule adds a scheduled message, or cancels or lists the
+// schedules of the current connection.
+func enterActionSchedule(pSt *State, buf string) {
+	pSt.Mode = modeInsert
+
+	spec := strings.TrimSpace(buf)
+	switch {
+	case spec == "":
+		pSt.PrintSchedules()
+		return
+	case spec == "-", spec == "-all":
+		n := pSt.wsConn.CancelSchedule(0)
+		pSt.PrintDebug(fmt.Sprintf("%d schedules cancelled.", n))
+		return
+	case spec[0] == '-':
+		id, err := strconv.Atoi(spec[1:])
+		if err != nil || id <= 0 {
+			pSt.PrintError(fmt.Errorf("invalid schedule ID %q", spec[1:]))
+			return
+		}
+		if pSt.wsConn.CancelSchedule(id) == 0 {
+			pSt.PrintError(fmt.Errorf("schedule #%d does not exist", id))
+			return
+		}
+		pSt.PrintDebug(fmt.Sprintf("Schedule #%d cancelled.", id))
+		return
+	}
+
+	sched, err := pSt.AddSchedule(spec)
+	if err != nil {
+		pSt.PrintError(err)
+		return
+	}
+	pSt.PrintDebug(fmt.Sprintf("Schedule %v", sched))
+}
+
+// enterActionWatch adds a watch rule, or removes or lists them.
+func enterActionWatch(pSt *State, buf string) {
+	pSt.Mode = modeInsert
+
+	spec := strings.TrimSpace(buf)
+	switch {
+	case spec == "":
+		pSt.PrintWatches()
+		return
+	case spec == "-", spec == "-all":
+		n := pSt.RemoveWatch(0)
+		pSt.PrintDebug(fmt.Sprintf("%d watch rules removed.", n))
+		return
+	case spec[0] == '-':
+		id, err := strconv.Atoi(spec[1:])
+		if err != nil || id <= 0 {
+			pSt.PrintError(fmt.Errorf("invalid watch rule ID %q", spec[1:]))
+			return
+		}
+		if pSt.RemoveWatch(id) == 0 {
+			pSt.PrintError(fmt.Errorf("watch rule #%d does not exist", id))
+			return
+		}
+		pSt.PrintDebug(fmt.Sprintf("Watch rule #%d removed.", id))
+		return
+	}
+
+	w, err := pSt.AddWatch(spec)
+	if err != nil {
+		pSt.PrintError(err)
+		return
+	}
+	pSt.PrintDebug(fmt.Sprintf("Watch #%d: %s", w.ID, w.Spec))
+}
+
+func enterActionSetProtocol(pSt *State, buf string) {
+	pSt.Mode = modeInsert
+
+	name := strings.TrimSpace(buf)
+	if err := pSt.SetProtocol(name); err != nil {
+		pSt.PrintError(err)
+		return
+	}
+	if name == "" {
+		pSt.PrintDebug("Protocol disabled; messages will be sent as typed from the next connection.")
+		return
+	}
+	pSt.PrintDebug("Protocol set to " + name + "; reconnect (<Esc>c) to use it.")
+}
+
 func enterActionSetPing(pSt *State, buf string) {
 	secs, _ := strconv.Atoi(strings.TrimSpace(buf))
 
@@ -239,11 +403,119 @@ func enterActionSetPing(pSt *State, buf string) {
 	pSt.Mode = modeInsert
 }
 
+func enterActionSetDecoder(pSt *State, buf string) {
+	pSt.Mode = modeInsert
+
+	args, ok := parseCoderArgs(pSt, buf, binaryDecoderNames())
+	if !ok {
+		return
+	}
+	if len(args) == 0 {
+		pSt.SetBinaryDecoder("", nil)
+		pSt.PrintDebug("Binary decoder disabled.")
+		return
+	}
+
+	pSt.SetBinaryDecoder(args[0], args[1:])
+	msg := "Binary decoder set to " + args[0]
+	if oSet := pSt.connSettings(); args[0] == "protobuf" && oSet.Protobuf.Message != "" {
+		msg += fmt.Sprintf(" (message %s from %s)", oSet.Protobuf.Message, oSet.Protobuf.DescriptorSet)
+	}
+	pSt.PrintDebug(msg + ".")
+}
+
+func enterActionSetEncoder(pSt *State, buf string) {
+	pSt.Mode = modeInsert
+
+	args, ok := parseCoderArgs(pSt, buf, binaryEncoderNames())
+	if !ok {
+		return
+	}
+	if len(args) == 0 {
+		pSt.SetBinaryEncoder("", nil)
+		pSt.PrintDebug("Binary encoder disabled; messages will be sent as text.")
+		return
+	}
+
+	pSt.SetBinaryEncoder(args[0], args[1:])
+	msg := "Messages will be encoded as " + args[0]
+	if oSet := pSt.connSettings(); args[0] == "protobuf" {
+		msg += fmt.Sprintf(" (message %s from %s)", oSet.Protobuf.SendMessage, oSet.Protobuf.DescriptorSet)
+	}
+	pSt.PrintDebug(msg + ".")
+}
+
+// parseCoderArgs parses the arguments given to set a binary encoder or
+// decoder: the name, followed (for protobuf) by an optional descriptor set and
+// message name. ok is false if the arguments are invalid.
+func parseCoderArgs(pSt *State, buf string, names []string) (args []string, ok bool) {
+	args = strings.Fields(buf)
+	if len(args) == 0 {
+		return args, true
+	}
+
+	valid := false
+	for _, name := range names {
+		valid = valid || name == args[0]
+	}
+	if !valid {
+		pSt.PrintDebug("Unknown format " + args[0] + "; available formats: " + strings.Join(names, ", "))
+		return nil, false
+	}
+	if args[0] != "protobuf" && len(args) > 1 || len(args) > 3 {
+		pSt.PrintDebug("Usage: protobuf [[DESCRIPTOR_SET] MESSAGE], or " + strings.Join(names, ", "))
+		return nil, false
+	}
+	return args, true
+}
+
 func enterActionSendMessage(pSt *State, buf string) {
 	if strings.TrimSpace(buf) != "" {
-		pSt.PrintFromUser(buf)
-		pSt.WsSendMsg(buf)
+		pSt.SendTemplate(buf)
+	}
+}
+
+func enterActionPrompt(pSt *State, buf string) {
+	pSt.SetPromptValue(buf)
+}
+
+// enterActionTemplate puts the template with the given name in the input
+// field. +NAME saves the last message sent as a template, -NAME deletes it.
+func enterActionTemplate(pSt *State, buf string) {
+	pSt.Mode = modeInsert
+
+	name := strings.TrimSpace(buf)
+	switch {
+	case name == "":
+		return
+	case name[0] == '+':
+		if err := pSt.SaveTemplate(name[1:]); err != nil {
+			pSt.PrintError(err)
+			return
+		}
+		pSt.PrintDebug(fmt.Sprintf("Template %q saved; send it by typing @%[1]s.", name[1:]))
+		return
+	case name[0] == '-':
+		if err := pSt.DeleteTemplate(name[1:]); err != nil {
+			pSt.PrintError(err)
+			return
+		}
+		pSt.PrintDebug(fmt.Sprintf("Template %q deleted.", name[1:]))
+		return
+	}
+
+	oSet := pSt.Settings.Clone()
+	text, err := oSet.Template(name)
+	if err != nil {
+		pSt.PrintError(err)
+		return
 	}
+	pSt.ExecuteFunc(func(g *gocui.Gui) error {
+		if v, err := g.View("cmd"); err == nil {
+			setText(v, text)
+		}
+		return nil
+	})
 }
 
 func enterActionConnect(pSt *State, buf string) {
@@ -251,6 +523,35 @@ func enterActionConnect(pSt *State, buf string) {
 	go pSt.StartConnection(buf)
 }
 
+func enterActionSaveProfile(pSt *State, buf string) {
+	pSt.Mode = modeInsert
+
+	name := strings.TrimSpace(buf)
+	if name == "" {
+		return
+	}
+	if err := pSt.SaveProfile(name); err != nil {
+		pSt.PrintError(err)
+		return
+	}
+	pSt.PrintDebug(fmt.Sprintf("Profile %q saved; use it with claws -P %s or by typing @%[2]s when connecting.", name, name))
+}
+
+// nextName returns the name following the one in buf (optionally in the form
+// @NAME), wrapping around, or the first name.
+func nextName(names []string, buf string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	cur := strings.TrimPrefix(strings.TrimSpace(buf), "@")
+	for i, name := range names {
+		if name == cur {
+			return names[(i+1)%len(names)]
+		}
+	}
+	return names[0]
+}
+
 func moveDown(v *gocui.View) {
 	_, yPos := v.Cursor()
 	if _, err := v.Line(yPos + 1); err == nil {
@@ -302,6 +603,12 @@ func escEditor(pSt *State, v *gocui.View, key gocui.Key, ch rune, mod gocui.Modi
 		pSt.KeepAutoscrolling = false
 		v.SetCursor(0, 0)
 		v.SetOrigin(0, 0)
+	case gocui.KeyEnter:
+		// <Esc><Enter>, which is what most terminals send for <Alt-Enter>,
+		// adds a new line to the message
+		pSt.Mode = modeInsert
+		insertNewLine(pSt)
+		return
 	case gocui.KeyEnd:
 		pSt.KeepAutoscrolling = false
 		lines := len(strings.Split(v.ViewBuffer(), "\n"))
@@ -326,11 +633,52 @@ func escEditor(pSt *State, v *gocui.View, key gocui.Key, ch rune, mod gocui.Modi
 	switch ch {
 	case 'c':
 		pSt.Mode = modeConnect
+		if oSet := pSt.Settings.Clone(); len(oSet.Profiles) > 0 {
+			pSt.PrintDebug("Profiles: " + strings.Join(oSet.ProfileNames(), ", ") + ". Type @PROFILE or press <Tab> to use one.")
+		}
+		return
+	case 'P':
+		pSt.Mode = modeSaveProfile
+		return
+	case 'T':
+		pSt.Mode = modeTemplate
+		if oSet := pSt.Settings.Clone(); len(oSet.Templates) > 0 {
+			pSt.PrintDebug("Templates: " + strings.Join(oSet.TemplateNames(), ", ") + ". Press <Tab> to cycle through them; type +NAME to save the last message sent, -NAME to delete a template.")
+		} else {
+			pSt.PrintDebug("No templates have been saved; type +NAME to save the last message sent as a template.")
+		}
+		return
+	case 'S':
+		pSt.Mode = modeSchedule
+		if len(pSt.wsConn.Schedules()) > 0 {
+			pSt.PrintSchedules()
+		}
+		pSt.PrintDebug("Type INTERVAL [xCOUNT] [~JITTER] MESSAGE to send a message repeatedly (e.g. 5s x10 ~1s ping), -ID to cancel a schedule, - to cancel all of them, or nothing to list them.")
+		return
+	case 'w':
+		pSt.Mode = modeWatch
+		if len(pSt.watches.list()) > 0 {
+			pSt.PrintWatches()
+		}
+		pSt.PrintDebug("Type PATTERN [| ACTION]... to watch the messages received (e.g. .status == error | once), -ID to remove a rule, - to remove all of them, or nothing to list them. Patterns: /REGEX/, .PATH [== VALUE], TEXT; actions: once, quiet, run COMMAND, reply MESSAGE.")
+		return
+	case 'L':
+		pSt.Mode = modeSetProtocol
+		pSt.PrintDebug("Protocols: " + strings.Join(protocolLayerNames(), ", ") + ". Type nothing to send messages as they are typed; the protocol is used from the next connection.")
 		return
 	case 'p':
 		pSt.Mode = modeSetPing
 		return
+	case 'b':
+		pSt.Mode = modeSetDecoder
+		return
+	case 'e':
+		pSt.Mode = modeSetEncoder
+		return
 	case 'q':
+		if pSt.GetWsInfo().IsOpen {
+			pSt.PrintStats()
+		}
 		if err := pSt.WsClose(); len(err) > 0 {
 			for _, e := range err {
 				pSt.PrintError(e)
@@ -338,6 +686,8 @@ func escEditor(pSt *State, v *gocui.View, key gocui.Key, ch rune, mod gocui.Modi
 		}
 		pSt.PrintDebug("WebSocket closed (use C-c to quit)")
 		return
+	case 's':
+		pSt.PrintStats()
 	case 'i':
 		// goes into insert mode
 	case 'h':
@@ -374,6 +724,9 @@ func escEditor(pSt *State, v *gocui.View, key gocui.Key, ch rune, mod gocui.Modi
 		// overwrite mode
 		pSt.Mode = modeOverwrite
 		return
+	case 'v':
+		// edit the message in $EDITOR
+		editMessage(pSt)
 	default:
 		pSt.PrintDebug("No action for key '" + string(ch) + "'")
 		return
@@ -389,9 +742,21 @@ const welcomeScreen = `
 
   Ctrl-C        quit
   <Esc>c        connect to specified websocket
+                (@PROFILE to use a profile)
+  <Esc>P        save connection settings as profile
+  <Esc>T        use or save message templates
+                (send @TEMPLATE to send one)
+  <Esc>S        send a message repeatedly
+  <Esc>w        watch for messages matching a rule
+  <Esc>L        set protocol (e.g. graphql, socketio)
   <Esc>q        close websocket
   <Esc>p        set ping interval (in seconds)
+  <Esc>b        set decoder for binary messages
+  <Esc>e        set encoder for sent messages
+  <Esc>v        edit message in $EDITOR
+  Ctrl-J        new line (<Esc><Enter> also works)
   <Up>/<Down>   navigate history
+  Ctrl-R        search history
 
 
             https://howl.moe/claws
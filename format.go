@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// formatMessage converts the payload of a message into the text to be shown
+// on the console, depending on its type and on the current settings.
+func formatMessage(msg []byte, msgType int, oSet SettingsBase) string {
+	switch msgType {
+	case websocket.BinaryMessage:
+		var decErr string
+		if dec, ok := binaryDecoders[oSet.BinaryDecoder]; ok {
+			res, err := dec(msg, oSet)
+			if err == nil {
+				return "[" + oSet.BinaryDecoder + "] " + res
+			}
+			decErr = " (" + oSet.BinaryDecoder + ": " + err.Error() + ")"
+		}
+		// binary frames which are actually text (often JSON) are shown as
+		// such, marked so they are not confused with text messages.
+		if isText(msg) {
+			return "[binary]" + decErr + " " + formatText(msg, oSet)
+		}
+		if decErr != "" {
+			return "[binary]" + decErr + "\n" + strings.TrimSuffix(hex.Dump(msg), "\n")
+		}
+		return strings.TrimSuffix(hex.Dump(msg), "\n")
+	default:
+		return formatText(msg, oSet)
+	}
+}
+
+// formatText applies JSON formatting to msg, if enabled.
+func formatText(msg []byte, oSet SettingsBase) string {
+	if oSet.JSONFormatting {
+		msg = attemptJSONFormatting(msg)
+	}
+	return strings.TrimSuffix(string(msg), "\n")
+}
+
+// isText reports whether msg is non-empty, valid UTF-8 and does not contain
+// control characters other than whitespace.
+func isText(msg []byte) bool {
+	if len(msg) == 0 || !utf8.Valid(msg) {
+		return false
+	}
+	for _, r := range string(msg) {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -3,9 +3,12 @@ module howl.moe/claws
 go 1.18
 
 require (
+	github.com/andybalholm/brotli v1.1.1
 	github.com/fatih/color v1.7.0
 	github.com/gorilla/websocket v1.4.0
 	github.com/jroimartin/gocui v0.4.0
+	github.com/nsf/termbox-go v0.0.0-20190121233118-02980233997d
+	google.golang.org/protobuf v1.33.0
 	howl.moe/nanojson v0.1.0
 )
 
@@ -14,7 +17,6 @@ require (
 	github.com/mattn/go-colorable v0.0.9 // indirect
 	github.com/mattn/go-isatty v0.0.5 // indirect
 	github.com/mattn/go-runewidth v0.0.4 // indirect
-	github.com/nsf/termbox-go v0.0.0-20190121233118-02980233997d // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	golang.org/x/sys v0.0.0-20190222171317-cd391775e71e // indirect
 )
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// graphQL speaks GraphQL over WebSocket, using either graphql-transport-ws
+// or its predecessor, subscriptions-transport-ws (whose subprotocol is
+// graphql-ws). Both send JSON messages with a type, and the ID and payload
+// of the operation they refer to. The client sends connection_init when
+// connecting, and the user types operations, or commands:
+//
+//	QUERY [VARIABLES]         start an operation, with JSON variables
+//	file PATH [VARIABLES]     start the operation in a file
+//	stop [ID]                 stop an operation, or all of them
+//
+// JSON objects with a query are sent as the payload of an operation, while
+// those with a type are sent as they are.
+type graphQL struct {
+	mu sync.Mutex
+	// legacy is true for subscriptions-transport-ws
+	legacy      bool
+	initPayload json.RawMessage
+
+	// the active operations, with their names
+	ops    map[string]string
+	lastOp int
+}
+
+// graphQLOperation is the payload of the messages starting an operation.
+type graphQLOperation struct {
+	Query         string          `json:"query"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+	OperationName string          `json:"operationName,omitempty"`
+}
+
+// graphQLMessage is a message of the protocol.
+type graphQLMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+func newGraphQL(oSet SettingsBase) (protocolLayer, error) {
+	return newGraphQLLayer(oSet, false)
+}
+
+func newGraphQLLegacy(oSet SettingsBase) (protocolLayer, error) {
+	return newGraphQLLayer(oSet, true)
+}
+
+func newGraphQLLayer(oSet SettingsBase, legacy bool) (*graphQL, error) {
+	var payload json.RawMessage
+	if p := strings.TrimSpace(oSet.GraphQL.InitPayload); p != "" {
+		if !json.Valid([]byte(p)) || p[0] != '{' {
+			return nil, errors.New("the GraphQL connection_init payload must be a JSON object")
+		}
+		payload = json.RawMessage(p)
+	}
+	return &graphQL{
+		legacy:      legacy,
+		initPayload: payload,
+		ops:         make(map[string]string),
+	}, nil
+}
+
+func (gql *graphQL) URL(u string) (string, error) {
+	return u, nil
+}
+
+// Subprotocols returns the subprotocol of the protocol spoken.
+func (gql *graphQL) Subprotocols() []string {
+	if gql.legacy {
+		return []string{"graphql-ws"}
+	}
+	return []string{"graphql-transport-ws"}
+}
+
+func (gql *graphQL) Open() ([]WsMsg, error) {
+	var payload interface{}
+	if gql.initPayload != nil {
+		payload = gql.initPayload
+	}
+	msg, err := graphQLFrame("", "connection_init", payload)
+	if err != nil {
+		return nil, err
+	}
+	return []WsMsg{msg}, nil
+}
+
+func graphQLFrame(id, typ string, payload interface{}) (WsMsg, error) {
+	msg := graphQLMessage{ID: id, Type: typ}
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return WsMsg{}, err
+		}
+		msg.Payload = data
+	}
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return WsMsg{}, err
+	}
+	return WsMsg{Type: websocket.TextMessage, Msg: data}, nil
+}
+
+// graphQLNameRe matches the type and the name, if any, of an operation.
+var graphQLNameRe = regexp.MustCompile(`^\s*(query|mutation|subscription)\b\s*([_A-Za-z][_0-9A-Za-z]*)?`)
+
+// parseGraphQLOperation splits a GraphQL document from the JSON object of
+// variables which follows it, if any: the last block enclosed in braces at
+// the top level of the document is the variables if it is valid JSON, which
+// selection sets never are.
+func parseGraphQLOperation(s string) (graphQLOperation, error) {
+	depth, start, last := 0, -1, -1
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '#':
+			for i < len(s) && s[i] != '\n' {
+				i++
+			}
+		case '"':
+			// skip strings, including block strings
+			if strings.HasPrefix(s[i:], `"""`) {
+				end := strings.Index(s[i+3:], `"""`)
+				if end < 0 {
+					return graphQLOperation{}, errors.New("unterminated block string")
+				}
+				i += end + 5
+				continue
+			}
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' {
+					i++
+				}
+			}
+		case '{':
+			if depth == 0 {
+				start = i
+			}
+			depth++
+		case '}':
+			if depth--; depth < 0 {
+				return graphQLOperation{}, errors.New("unbalanced braces")
+			}
+			if depth == 0 {
+				last = i
+			}
+		}
+	}
+	if depth != 0 {
+		return graphQLOperation{}, errors.New("unbalanced braces")
+	}
+
+	op := graphQLOperation{Query: strings.TrimSpace(s)}
+	if start >= 0 && last > start && strings.TrimSpace(s[last+1:]) == "" {
+		if vars := s[start : last+1]; json.Valid([]byte(vars)) && strings.TrimSpace(s[:start]) != "" {
+			op.Query, op.Variables = strings.TrimSpace(s[:start]), json.RawMessage(vars)
+		}
+	}
+	if op.Query == "" {
+		return graphQLOperation{}, errors.New("the query is missing")
+	}
+	return op, nil
+}
+
+// operationName returns the name of the first operation of a document, or
+// its type if it is anonymous.
+func operationName(op graphQLOperation) string {
+	if op.OperationName != "" {
+		return op.OperationName
+	}
+	m := graphQLNameRe.FindStringSubmatch(op.Query)
+	switch {
+	case m == nil:
+		return "query"
+	case m[2] != "":
+		return m[2]
+	}
+	return m[1]
+}
+
+func (gql *graphQL) Send(msg string) ([]WsMsg, string, error) {
+	gql.mu.Lock()
+	defer gql.mu.Unlock()
+
+	cmd, arg := parsePlaceholder(msg)
+	switch cmd {
+	case "file":
+		path, vars := parsePlaceholder(arg)
+		if path == "" {
+			return nil, "", errors.New("usage: file PATH [VARIABLES]")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, "", err
+		}
+		op := graphQLOperation{Query: strings.TrimSpace(string(data))}
+		if vars != "" {
+			if !json.Valid([]byte(vars)) || vars[0] != '{' {
+				return nil, "", errors.New("the variables must be a JSON object")
+			}
+			op.Variables = json.RawMessage(vars)
+		}
+		return gql.start(op)
+	case "stop":
+		var ids []string
+		if arg == "" {
+			if ids = gql.opIDs(); len(ids) == 0 {
+				return nil, "", errors.New("no active operations")
+			}
+		} else if _, ok := gql.ops[arg]; ok {
+			ids = []string{arg}
+		} else {
+			return nil, "", fmt.Errorf("no active operation with ID %q", arg)
+		}
+		typ := "complete"
+		if gql.legacy {
+			typ = "stop"
+		}
+		var frames []WsMsg
+		for _, id := range ids {
+			f, err := graphQLFrame(id, typ, nil)
+			if err != nil {
+				return nil, "", err
+			}
+			frames = append(frames, f)
+			delete(gql.ops, id)
+		}
+		return frames, "", nil
+	}
+
+	if trimmed := strings.TrimSpace(msg); strings.HasPrefix(trimmed, "{") && json.Valid([]byte(trimmed)) {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal([]byte(trimmed), &obj) == nil {
+			if _, ok := obj["type"]; ok {
+				return []WsMsg{textFrame(trimmed)}, "", nil
+			}
+			var op graphQLOperation
+			if _, ok := obj["query"]; ok && json.Unmarshal([]byte(trimmed), &op) == nil {
+				return gql.start(op)
+			}
+		}
+	}
+	op, err := parseGraphQLOperation(msg)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid GraphQL operation: %w", err)
+	}
+	return gql.start(op)
+}
+
+// start starts an operation.
+func (gql *graphQL) start(op graphQLOperation) ([]WsMsg, string, error) {
+	gql.lastOp++
+	id := strconv.Itoa(gql.lastOp)
+	typ := "subscribe"
+	if gql.legacy {
+		typ = "start"
+	}
+	f, err := graphQLFrame(id, typ, op)
+	if err != nil {
+		return nil, "", err
+	}
+	name := operationName(op)
+	gql.ops[id] = name
+	return []WsMsg{f}, "[op " + id + " " + name + "] ", nil
+}
+
+// opIDs returns the IDs of the active operations, in order.
+func (gql *graphQL) opIDs() []string {
+	ids := make([]string, 0, len(gql.ops))
+	for id := range gql.ops {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, _ := strconv.Atoi(ids[i])
+		b, _ := strconv.Atoi(ids[j])
+		return a < b
+	})
+	return ids
+}
+
+// graphQLErrors returns the messages of the errors in payload: a list of
+// GraphQL errors, or a single one.
+func graphQLErrors(payload json.RawMessage) string {
+	type gqlError struct {
+		Message string `json:"message"`
+	}
+	var list []gqlError
+	if json.Unmarshal(payload, &list) != nil {
+		var single gqlError
+		if json.Unmarshal(payload, &single) != nil || single.Message == "" {
+			return string(payload)
+		}
+		list = []gqlError{single}
+	}
+	msgs := make([]string, len(list))
+	for i, e := range list {
+		msgs[i] = e.Message
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func (gql *graphQL) Receive(msg WsMsg) layerResult {
+	var m graphQLMessage
+	if msg.Type != websocket.TextMessage || json.Unmarshal(msg.Msg, &m) != nil || m.Type == "" {
+		return layerResult{Body: msg.Msg}
+	}
+
+	gql.mu.Lock()
+	defer gql.mu.Unlock()
+
+	header := "[op " + m.ID
+	if name, ok := gql.ops[m.ID]; ok {
+		header += " " + name
+	}
+
+	switch m.Type {
+	case "connection_ack":
+		return layerResult{Info: "GraphQL connection acknowledged"}
+	case "connection_error":
+		return layerResult{Err: errors.New("GraphQL connection refused: " + graphQLErrors(m.Payload))}
+	case "ping":
+		pong, _ := graphQLFrame("", "pong", nil)
+		return layerResult{Replies: []WsMsg{pong}}
+	case "pong", "ka":
+		// heartbeats are hidden
+		return layerResult{}
+	case "next", "data":
+		return layerResult{Header: header + "] ", Body: m.Payload}
+	case "error":
+		delete(gql.ops, m.ID)
+		return layerResult{Err: fmt.Errorf("GraphQL operation %s failed: %s", m.ID, graphQLErrors(m.Payload))}
+	case "complete":
+		delete(gql.ops, m.ID)
+		return layerResult{Info: header[1:] + " complete"}
+	}
+	return layerResult{Body: msg.Msg}
+}
+
+// Status lists the active operations.
+func (gql *graphQL) Status() string {
+	gql.mu.Lock()
+	defer gql.mu.Unlock()
+
+	if len(gql.ops) == 0 {
+		return "GraphQL: no active operations"
+	}
+	ids := gql.opIDs()
+	for i, id := range ids {
+		ids[i] = id + " " + gql.ops[id]
+	}
+	return fmt.Sprintf("GraphQL: %d active operation(s): %s", len(ids), strings.Join(ids, ", "))
+}
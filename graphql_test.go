@@ -0,0 +1,143 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseGraphQLOperation(t *testing.T) {
+	tests := []struct {
+		s         string
+		query     string
+		variables string
+		// the start of the error, if any
+		err string
+	}{
+		{s: "{ me { id } }", query: "{ me { id } }"},
+		{s: "query { me { id } }", query: "query { me { id } }"},
+		{s: `query($id: ID!) { user(id: $id) { name } } {"id": "1"}`, query: "query($id: ID!) { user(id: $id) { name } }", variables: `{"id": "1"}`},
+		{s: "subscription S { ticks }\n{\"n\": 3}\n", query: "subscription S { ticks }", variables: `{"n": 3}`},
+		{s: `{"id": "1"}`, query: `{"id": "1"}`},
+		{s: `query { a(s: "}") } {"x": 1}`, query: `query { a(s: "}") }`, variables: `{"x": 1}`},
+		{s: `query { a(s: "\"{") }`, query: `query { a(s: "\"{") }`},
+		{s: "query { a(s: \"\"\"{ \"quoted\" }\"\"\") }", query: "query { a(s: \"\"\"{ \"quoted\" }\"\"\") }"},
+		{s: "query {\n  a # }\n}", query: "query {\n  a # }\n}"},
+		{s: "query { a } { b }", query: "query { a } { b }"},
+		{s: `query { a } {"x": 1} trailing`, query: `query { a } {"x": 1} trailing`},
+		{s: "", err: "the query is missing"},
+		{s: "query { a ", err: "unbalanced braces"},
+		{s: "query } {", err: "unbalanced braces"},
+		{s: `query { a(s: """) }`, err: "unterminated block string"},
+	}
+	for _, tt := range tests {
+		op, err := parseGraphQLOperation(tt.s)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.s, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if op.Query != tt.query || string(op.Variables) != tt.variables {
+			t.Errorf("%q: got query %q and variables %s, want %q and %s", tt.s, op.Query, op.Variables, tt.query, tt.variables)
+		}
+	}
+}
+
+func TestOperationName(t *testing.T) {
+	tests := []struct {
+		op   graphQLOperation
+		want string
+	}{
+		{graphQLOperation{Query: "{ me }"}, "query"},
+		{graphQLOperation{Query: "query { me }"}, "query"},
+		{graphQLOperation{Query: "  mutation AddUser($n: String) { add(n: $n) }"}, "AddUser"},
+		{graphQLOperation{Query: "subscription{ ticks }"}, "subscription"},
+		{graphQLOperation{Query: "query A { a } query B { b }", OperationName: "B"}, "B"},
+	}
+	for _, tt := range tests {
+		if got := operationName(tt.op); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.op.Query, got, tt.want)
+		}
+	}
+}
+
+func TestGraphQLSession(t *testing.T) {
+	for _, legacy := range []bool{false, true} {
+		layer, err := newGraphQLLayer(SettingsBase{}, legacy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		start, stop, next := "subscribe", "complete", "next"
+		if legacy {
+			start, stop, next = "start", "stop", "data"
+		}
+
+		frames, header, err := layer.Send(`subscription Ticks { ticks } {"n": 2}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `{"id":"1","type":"` + start + `","payload":{"query":"subscription Ticks { ticks }","variables":{"n":2}}}`
+		if len(frames) != 1 || string(frames[0].Msg) != want || header != "[op 1 Ticks] " {
+			t.Errorf("legacy=%v: sent %q with header %q, want %s", legacy, frames, header, want)
+		}
+
+		res := layer.Receive(WsMsg{Type: websocket.TextMessage, Msg: []byte(`{"id":"1","type":"` + next + `","payload":{"data":{"ticks":1}}}`)})
+		if res.Header != "[op 1 Ticks] " || string(res.Body) != `{"data":{"ticks":1}}` {
+			t.Errorf("legacy=%v: received header %q and body %s", legacy, res.Header, res.Body)
+		}
+		if status := layer.Status(); status != "GraphQL: 1 active operation(s): 1 Ticks" {
+			t.Errorf("legacy=%v: got status %q", legacy, status)
+		}
+
+		frames, _, err = layer.Send("stop")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := `{"id":"1","type":"` + stop + `"}`; len(frames) != 1 || string(frames[0].Msg) != want {
+			t.Errorf("legacy=%v: sent %q, want %s", legacy, frames, want)
+		}
+		if _, _, err := layer.Send("stop"); err == nil {
+			t.Errorf("legacy=%v: stopped an operation twice", legacy)
+		}
+	}
+}
+
+func TestGraphQLReceive(t *testing.T) {
+	tests := []struct {
+		msg     string
+		info    string
+		err     string
+		replies []string
+	}{
+		{msg: `{"type":"connection_ack"}`, info: "GraphQL connection acknowledged"},
+		{msg: `{"type":"connection_error","payload":{"message":"denied"}}`, err: "GraphQL connection refused: denied"},
+		{msg: `{"type":"ping"}`, replies: []string{`{"type":"pong"}`}},
+		{msg: `{"type":"ka"}`},
+		{msg: `{"id":"3","type":"error","payload":[{"message":"a"},{"message":"b"}]}`, err: "GraphQL operation 3 failed: a; b"},
+		{msg: `{"id":"3","type":"complete"}`, info: "op 3 complete"},
+	}
+	for _, tt := range tests {
+		layer, err := newGraphQLLayer(SettingsBase{}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := layer.Receive(WsMsg{Type: websocket.TextMessage, Msg: []byte(tt.msg)})
+		var errText string
+		if res.Err != nil {
+			errText = res.Err.Error()
+		}
+		var replies []string
+		for _, r := range res.Replies {
+			replies = append(replies, string(r.Msg))
+		}
+		if res.Info != tt.info || errText != tt.err || strings.Join(replies, "\n") != strings.Join(tt.replies, "\n") || res.Body != nil {
+			t.Errorf("%s: got info %q, error %q, replies %q and body %s", tt.msg, res.Info, errText, replies, res.Body)
+		}
+	}
+}
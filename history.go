@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/jroimartin/gocui"
+)
+
+// historySearch is a reverse incremental search through the history, started
+// using Ctrl-R, similar to the one of bash.
+type historySearch struct {
+	query string
+	// index of the matching action in the history, -1 if none
+	index int
+	// whether the last change of query has no matches
+	failed bool
+	// text of the view before starting the search
+	original string
+}
+
+// match returns the matching action, if any.
+func (h *historySearch) match(actions []string) (string, bool) {
+	if h.index < 0 || h.index >= len(actions) {
+		return "", false
+	}
+	return actions[h.index], true
+}
+
+// findAction returns the index of the first action containing query, starting
+// from index from, or -1 if there is none.
+func findAction(actions []string, query string, from int) int {
+	if from < 0 {
+		from = 0
+	}
+	for i := from; i < len(actions); i++ {
+		if strings.Contains(actions[i], query) {
+			return i
+		}
+	}
+	return -1
+}
+
+func startSearch(pSt *State, v *gocui.View) {
+	pSt.search = &historySearch{
+		index:    -1,
+		original: strings.TrimSuffix(v.Buffer(), "\n"),
+	}
+	drawSearch(pSt, v)
+}
+
+// searchEditor handles the keys pressed while searching through the history.
+// Ctrl-R looks for older matches, Enter sends the matching action, Ctrl-G
+// cancels the search and the other keys which are not used for typing end it,
+// leaving the matching action in the view, and are then handled as usual: it
+// reports whether the key was handled.
+func searchEditor(pSt *State, v *gocui.View, key gocui.Key, ch rune, mod gocui.Modifier) bool {
+	h := pSt.search
+	actions := pSt.Actions()
+
+	fnFind := func(from int) {
+		if i := findAction(actions, h.query, from); i >= 0 {
+			h.index, h.failed = i, false
+		} else {
+			h.failed = true
+		}
+	}
+
+	switch {
+	case key == gocui.KeySpace:
+		ch = ' '
+		fallthrough
+	case ch != 0 && mod == 0:
+		h.query += string(ch)
+		fnFind(h.index)
+	case key == gocui.KeyBackspace, key == gocui.KeyBackspace2:
+		if h.query != "" {
+			_, size := utf8.DecodeLastRuneInString(h.query)
+			h.query = h.query[:len(h.query)-size]
+			h.index = -1
+			fnFind(0)
+		}
+	case key == gocui.KeyCtrlR:
+		fnFind(h.index + 1)
+	case key == gocui.KeyCtrlG:
+		pSt.search = nil
+		setText(v, h.original)
+		return true
+	case key == gocui.KeyEnter:
+		endSearch(pSt, v, actions)
+		submitBuffer(pSt, v)
+		return true
+	default:
+		endSearch(pSt, v, actions)
+		return false
+	}
+
+	drawSearch(pSt, v)
+	return true
+}
+
+// endSearch ends the search, leaving the matching action in the view. The
+// history can then be browsed starting from it.
+func endSearch(pSt *State, v *gocui.View, actions []string) {
+	h := pSt.search
+	pSt.search = nil
+	if match, ok := h.match(actions); ok {
+		setText(v, match)
+		pSt.ActionIndex = h.index
+	} else {
+		setText(v, h.original)
+	}
+}
+
+func drawSearch(pSt *State, v *gocui.View) {
+	h := pSt.search
+	prompt := "reverse-i-search"
+	if h.failed {
+		prompt = "failed " + prompt
+	}
+	match, _ := h.match(pSt.Actions())
+	setText(v, fmt.Sprintf("(%s)`%s': %s", prompt, h.query, match))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// interpolator resolves references in the form ${NAME} (environment
+// variables), ${file:PATH} (contents of a file) and ${cmd:COMMAND} (output of
+// a shell command) in strings. $${ is replaced with a literal ${.
+// The output of commands is cached, so that each command is run only once.
+type interpolator struct {
+	cmdCache map[string]string
+}
+
+func (ip *interpolator) interpolate(s string) (string, error) {
+	var res strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			res.WriteString(s)
+			return res.String(), nil
+		}
+		if i > 0 && s[i-1] == '$' {
+			res.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated reference in %q", s)
+		}
+		val, err := ip.resolve(s[i+2 : i+end])
+		if err != nil {
+			return "", err
+		}
+		res.WriteString(s[:i])
+		res.WriteString(val)
+		s = s[i+end+1:]
+	}
+}
+
+func (ip *interpolator) resolve(ref string) (string, error) {
+	kind, arg, found := strings.Cut(ref, ":")
+	if !found {
+		kind, arg = "env", ref
+	}
+
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(arg)
+		if !ok {
+			return "", fmt.Errorf("${%s}: environment variable is not set", ref)
+		}
+		return v, nil
+	case "file":
+		data, err := os.ReadFile(arg)
+		if err != nil {
+			return "", fmt.Errorf("${%s}: %w", ref, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case "cmd":
+		if v, ok := ip.cmdCache[arg]; ok {
+			return v, nil
+		}
+		var c *exec.Cmd
+		if runtime.GOOS == "windows" {
+			c = exec.Command("cmd", "/C", arg)
+		} else {
+			c = exec.Command("sh", "-c", arg)
+		}
+		var stderr bytes.Buffer
+		c.Stderr = &stderr
+		out, err := c.Output()
+		if err != nil {
+			return "", fmt.Errorf("${%s}: %w: %s", ref, err, strings.TrimSpace(stderr.String()))
+		}
+		v := strings.TrimRight(string(out), "\r\n")
+		if ip.cmdCache == nil {
+			ip.cmdCache = make(map[string]string)
+		}
+		ip.cmdCache[arg] = v
+		return v, nil
+	}
+	return "", fmt.Errorf("${%s}: unknown reference type %q", ref, kind)
+}
+
+// interpolateSettings resolves the references in the URL, headers, proxy,
+// on-connect messages, STOMP and MQTT credentials and GraphQL connection
+// payload of oSet.
+// This must only be done on clones of the settings, so that the resolved
+// values (which may be secrets) are never saved.
+func interpolateSettings(oSet *SettingsBase) error {
+	var ip interpolator
+	var err error
+
+	fnList := func(list []string) error {
+		for i := range list {
+			if list[i], err = ip.interpolate(list[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if oSet.LastWebsocketURL, err = ip.interpolate(oSet.LastWebsocketURL); err != nil {
+		return err
+	}
+	if oSet.Proxy, err = ip.interpolate(oSet.Proxy); err != nil {
+		return err
+	}
+	if oSet.STOMP.Login, err = ip.interpolate(oSet.STOMP.Login); err != nil {
+		return err
+	}
+	if oSet.STOMP.Passcode, err = ip.interpolate(oSet.STOMP.Passcode); err != nil {
+		return err
+	}
+	if oSet.GraphQL.InitPayload, err = ip.interpolate(oSet.GraphQL.InitPayload); err != nil {
+		return err
+	}
+	if oSet.MQTT.Username, err = ip.interpolate(oSet.MQTT.Username); err != nil {
+		return err
+	}
+	if oSet.MQTT.Password, err = ip.interpolate(oSet.MQTT.Password); err != nil {
+		return err
+	}
+	if err := fnList(oSet.Headers); err != nil {
+		return err
+	}
+	return fnList(oSet.OnConnect)
+}
+
+// unsafeReference returns the first reference to a file or a command, or to
+// an unknown type, in values, or an empty string if there is none.
+func unsafeReference(values ...string) string {
+	for _, s := range values {
+		for {
+			i := strings.Index(s, "${")
+			if i < 0 {
+				break
+			}
+			if i > 0 && s[i-1] == '$' {
+				s = s[i+2:]
+				continue
+			}
+			end := strings.IndexByte(s[i:], '}')
+			if end < 0 {
+				break
+			}
+			ref := s[i+2 : i+end]
+			if kind, _, found := strings.Cut(ref, ":"); found && kind != "env" {
+				return "${" + ref + "}"
+			}
+			s = s[i+end+1:]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInterpolate(t *testing.T) {
+	t.Setenv("CLAWS_TEST_TOKEN", "secret")
+	t.Setenv("CLAWS_TEST_EMPTY", "")
+	file := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(file, []byte("from file\r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		s    string
+		want string
+		// the start of the error, if any
+		err string
+	}{
+		{"ws://example.com", "ws://example.com", ""},
+		{"Bearer ${CLAWS_TEST_TOKEN}", "Bearer secret", ""},
+		{"${env:CLAWS_TEST_TOKEN}/${CLAWS_TEST_TOKEN}", "secret/secret", ""},
+		{"[${CLAWS_TEST_EMPTY}]", "[]", ""},
+		{"$${CLAWS_TEST_TOKEN}", "${CLAWS_TEST_TOKEN}", ""},
+		{"$$${CLAWS_TEST_TOKEN}", "$${CLAWS_TEST_TOKEN}", ""},
+		{"$CLAWS_TEST_TOKEN {x}", "$CLAWS_TEST_TOKEN {x}", ""},
+		{"${file:" + file + "}", "from file", ""},
+		{"${cmd:echo hello}", "hello", ""},
+		{"${CLAWS_TEST_UNSET}", "", "${CLAWS_TEST_UNSET}: environment variable is not set"},
+		{"${file:" + file + ".missing}", "", "${file:" + file + ".missing}: "},
+		{"${http:example.com}", "", `${http:example.com}: unknown reference type "http"`},
+		{"a ${CLAWS_TEST_TOKEN", "", "unterminated reference"},
+	}
+	for _, tt := range tests {
+		var ip interpolator
+		got, err := ip.interpolate(tt.s)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.s, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestInterpolateCommandCache(t *testing.T) {
+	var ip interpolator
+	got, err := ip.interpolate("${cmd:echo a}-${cmd:echo a}-${cmd:echo b}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "a-a-b" {
+		t.Errorf("got %q, want %q", got, "a-a-b")
+	}
+	if len(ip.cmdCache) != 2 {
+		t.Errorf("got %d cached commands, want 2", len(ip.cmdCache))
+	}
+}
+
+func TestInterpolateSettings(t *testing.T) {
+	t.Setenv("CLAWS_TEST_HOST", "example.com")
+	t.Setenv("CLAWS_TEST_TOKEN", "secret")
+	var oSet SettingsBase
+	oSet.LastWebsocketURL = "wss://${CLAWS_TEST_HOST}/ws"
+	oSet.Headers = []string{"Authorization: Bearer ${CLAWS_TEST_TOKEN}", "X-Literal: $${CLAWS_TEST_TOKEN}"}
+	oSet.OnConnect = []string{`{"token": "${CLAWS_TEST_TOKEN}"}`}
+	if err := interpolateSettings(&oSet); err != nil {
+		t.Fatal(err)
+	}
+	if oSet.LastWebsocketURL != "wss://example.com/ws" {
+		t.Errorf("got URL %q", oSet.LastWebsocketURL)
+	}
+	if oSet.Headers[0] != "Authorization: Bearer secret" || oSet.Headers[1] != "X-Literal: ${CLAWS_TEST_TOKEN}" {
+		t.Errorf("got headers %q", oSet.Headers)
+	}
+	if oSet.OnConnect[0] != `{"token": "secret"}` {
+		t.Errorf("got on-connect messages %q", oSet.OnConnect)
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// jsonRPC speaks JSON-RPC 2.0. The user types calls, which are sent with a
+// new ID, and the responses are matched to them, showing the time each call
+// took:
+//
+//	METHOD [PARAMS...]         call a method, with positional parameters
+//	METHOD {PARAMS}            call a method, with named parameters
+//	notify METHOD [PARAMS...]  send a notification, which has no response
+//
+// Messages of several lines are sent as a batch, with a call on each line,
+// while JSON objects and arrays are sent as they are.
+type jsonRPC struct {
+	mu      sync.Mutex
+	lastID  int64
+	pending map[string]rpcCall
+}
+
+// rpcCall is a call waiting for its response.
+type rpcCall struct {
+	Method string
+	Sent   time.Time
+}
+
+// rpcMessage is a request, a notification or a response.
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+// rpcMaxPending is the maximum number of calls waiting for their response
+// which are remembered.
+const rpcMaxPending = 10000
+
+func newJSONRPC(oSet SettingsBase) (protocolLayer, error) {
+	return &jsonRPC{pending: make(map[string]rpcCall)}, nil
+}
+
+func (rpc *jsonRPC) URL(u string) (string, error) {
+	return u, nil
+}
+
+func (rpc *jsonRPC) Open() ([]WsMsg, error) {
+	return nil, nil
+}
+
+// parseRPCParams parses the parameters of a call: a JSON object, or a list
+// of values, which are strings if they aren't valid JSON.
+func parseRPCParams(s string) (json.RawMessage, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if strings.HasPrefix(s, "{") && json.Valid([]byte(s)) {
+		return json.RawMessage(s), nil
+	}
+
+	params := []json.RawMessage{}
+	for s != "" {
+		var raw json.RawMessage
+		dec := json.NewDecoder(strings.NewReader(s))
+		if dec.Decode(&raw) == nil {
+			rest := s[dec.InputOffset():]
+			if rest == "" || rest[0] == ' ' || rest[0] == '\t' {
+				params = append(params, raw)
+				s = strings.TrimSpace(rest)
+				continue
+			}
+		}
+		word, rest := parsePlaceholder(s)
+		str, _ := json.Marshal(word)
+		params = append(params, str)
+		s = rest
+	}
+	return json.Marshal(params)
+}
+
+// call returns the request for a call typed by the user, or a notification
+// if the call starts with "notify".
+func (rpc *jsonRPC) call(line string, now time.Time) (rpcMessage, error) {
+	method, arg := parsePlaceholder(line)
+	notify := method == "notify"
+	if notify {
+		method, arg = parsePlaceholder(arg)
+	}
+	if method == "" {
+		return rpcMessage{}, errors.New("usage: METHOD [PARAMS...], or notify METHOD [PARAMS...]")
+	}
+	params, err := parseRPCParams(arg)
+	if err != nil {
+		return rpcMessage{}, err
+	}
+	msg := rpcMessage{JSONRPC: "2.0", Method: method, Params: params}
+	if !notify {
+		rpc.lastID++
+		msg.ID = json.RawMessage(strconv.FormatInt(rpc.lastID, 10))
+		rpc.track(msg.ID, method, now)
+	}
+	return msg, nil
+}
+
+// track remembers a call, until its response is received.
+func (rpc *jsonRPC) track(id json.RawMessage, method string, now time.Time) {
+	if len(rpc.pending) >= rpcMaxPending {
+		for k := range rpc.pending {
+			delete(rpc.pending, k)
+			break
+		}
+	}
+	rpc.pending[string(id)] = rpcCall{Method: method, Sent: now}
+}
+
+// trackRaw remembers the calls in a request typed as JSON.
+func (rpc *jsonRPC) trackRaw(data []byte, now time.Time) {
+	var batch []rpcMessage
+	if json.Unmarshal(data, &batch) != nil {
+		var single rpcMessage
+		if json.Unmarshal(data, &single) != nil {
+			return
+		}
+		batch = []rpcMessage{single}
+	}
+	for _, msg := range batch {
+		if msg.Method != "" && len(msg.ID) > 0 && string(msg.ID) != "null" {
+			rpc.track(msg.ID, msg.Method, now)
+		}
+	}
+}
+
+func (rpc *jsonRPC) Send(msg string) ([]WsMsg, string, error) {
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+	now := time.Now()
+
+	if trimmed := strings.TrimSpace(msg); (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		rpc.trackRaw([]byte(trimmed), now)
+		return []WsMsg{textFrame(trimmed)}, "", nil
+	}
+
+	var calls []rpcMessage
+	for _, line := range strings.Split(msg, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		call, err := rpc.call(line, now)
+		if err != nil {
+			return nil, "", err
+		}
+		calls = append(calls, call)
+	}
+
+	var data []byte
+	var err error
+	switch len(calls) {
+	case 0:
+		return nil, "", errors.New("the method is missing")
+	case 1:
+		data, err = json.Marshal(calls[0])
+	default:
+		data, err = json.Marshal(calls)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	ids := make([]string, 0, len(calls))
+	for _, c := range calls {
+		if c.ID != nil {
+			ids = append(ids, "#"+string(c.ID))
+		}
+	}
+	header := ""
+	switch {
+	case len(calls) > 1:
+		header = "[batch " + strings.Join(ids, ", ") + "] "
+	case len(ids) == 1:
+		header = "[" + ids[0] + "] "
+	}
+	return []WsMsg{textFrame(string(data))}, header, nil
+}
+
+// formatLatency formats the time a call took.
+func formatLatency(d time.Duration) string {
+	if d < time.Millisecond {
+		return d.Round(time.Microsecond).String()
+	}
+	return d.Round(100 * time.Microsecond).String()
+}
+
+// response describes a response, returning the error it contains, if any.
+func (rpc *jsonRPC) response(msg rpcMessage, now time.Time) (string, error) {
+	desc := "#" + string(msg.ID)
+	if call, ok := rpc.pending[string(msg.ID)]; ok {
+		delete(rpc.pending, string(msg.ID))
+		desc += " " + call.Method + ", " + formatLatency(now.Sub(call.Sent))
+	}
+	if msg.Error != nil {
+		return desc, fmt.Errorf("%s: error %d: %s", desc, msg.Error.Code, msg.Error.Message)
+	}
+	return desc, nil
+}
+
+func (rpc *jsonRPC) Receive(msg WsMsg) layerResult {
+	if msg.Type != websocket.TextMessage {
+		return layerResult{Body: msg.Msg}
+	}
+	now := time.Now()
+
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+
+	var batch []rpcMessage
+	if json.Unmarshal(msg.Msg, &batch) == nil {
+		descs := make([]string, 0, len(batch))
+		var errs []string
+		for _, m := range batch {
+			desc, err := rpc.response(m, now)
+			if err != nil {
+				desc += ", error"
+				errs = append(errs, err.Error())
+			}
+			descs = append(descs, desc)
+		}
+		res := layerResult{Header: "[batch " + strings.Join(descs, "; ") + "] ", Body: msg.Msg}
+		if len(errs) > 0 {
+			res.Err = errors.New(strings.Join(errs, "; "))
+		}
+		return res
+	}
+
+	var m rpcMessage
+	if json.Unmarshal(msg.Msg, &m) != nil {
+		return layerResult{Body: msg.Msg}
+	}
+	if m.Method != "" {
+		return notification(m)
+	}
+	if m.ID == nil {
+		return layerResult{Body: msg.Msg}
+	}
+	desc, err := rpc.response(m, now)
+	if err != nil {
+		res := layerResult{Err: err}
+		if len(m.Error.Data) > 0 {
+			res.Header, res.Body = "["+desc+", error data] ", m.Error.Data
+		}
+		return res
+	}
+	return layerResult{Header: "[" + desc + "] ", Body: m.Result}
+}
+
+// notification shows a notification, or a call from the server. The
+// notifications of subscriptions, such as eth_subscription, show their
+// result.
+func notification(m rpcMessage) layerResult {
+	kind := "notification"
+	if m.ID != nil {
+		kind = "call #" + string(m.ID)
+	}
+	var sub struct {
+		Subscription json.RawMessage
+		Result       json.RawMessage
+	}
+	if json.Unmarshal(m.Params, &sub) == nil && sub.Subscription != nil && sub.Result != nil {
+		var id string
+		if json.Unmarshal(sub.Subscription, &id) != nil {
+			id = string(sub.Subscription)
+		}
+		return layerResult{Header: "[" + kind + " " + m.Method + " " + id + "] ", Body: sub.Result}
+	}
+	body := m.Params
+	if body == nil {
+		body = []byte{}
+	}
+	return layerResult{Header: "[" + kind + " " + m.Method + "] ", Body: body}
+}
+
+// Status shows the number of calls waiting for their response.
+func (rpc *jsonRPC) Status() string {
+	rpc.mu.Lock()
+	defer rpc.mu.Unlock()
+
+	if len(rpc.pending) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("JSON-RPC: %d pending call(s)", len(rpc.pending))
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseRPCParams(t *testing.T) {
+	tests := []struct {
+		s    string
+		want string
+	}{
+		{"", ""},
+		{"   ", ""},
+		{`{"a": 1}`, `{"a": 1}`},
+		{`1 "two" [3] {"four": 4}`, `[1,"two",[3],{"four":4}]`},
+		{`hello world`, `["hello","world"]`},
+		{`0x1f latest`, `["0x1f","latest"]`},
+		{`true false null`, `[true,false,null]`},
+		{`1.5e3`, `[1.5e3]`},
+		{`12abc`, `["12abc"]`},
+		{`"a b"c`, `["\"a","b\"c"]`},
+		{`{"a": 1`, `["{\"a\":",1]`},
+	}
+	for _, tt := range tests {
+		got, err := parseRPCParams(tt.s)
+		if err != nil {
+			t.Errorf("%q: %v", tt.s, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("%q: got %s, want %s", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestJSONRPCSend(t *testing.T) {
+	tests := []struct {
+		msg    string
+		frame  string
+		header string
+		// the start of the error, if any
+		err string
+	}{
+		{msg: "ping", frame: `{"jsonrpc":"2.0","id":1,"method":"ping"}`, header: "[#1] "},
+		{msg: "add 1 2", frame: `{"jsonrpc":"2.0","id":1,"method":"add","params":[1,2]}`, header: "[#1] "},
+		{msg: `greet {"name": "x"}`, frame: `{"jsonrpc":"2.0","id":1,"method":"greet","params":{"name":"x"}}`, header: "[#1] "},
+		{msg: "notify log hello", frame: `{"jsonrpc":"2.0","method":"log","params":["hello"]}`},
+		{msg: "a\n\nnotify b\nc 1", frame: `[{"jsonrpc":"2.0","id":1,"method":"a"},{"jsonrpc":"2.0","method":"b"},{"jsonrpc":"2.0","id":2,"method":"c","params":[1]}]`, header: "[batch #1, #2] "},
+		{msg: ` {"jsonrpc":"2.0","id":"x","method":"m"} `, frame: `{"jsonrpc":"2.0","id":"x","method":"m"}`},
+		{msg: "  \n ", err: "the method is missing"},
+		{msg: "notify", err: "usage: METHOD"},
+	}
+	for _, tt := range tests {
+		layer, err := newJSONRPC(SettingsBase{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames, header, err := layer.Send(tt.msg)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.msg, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.msg, err)
+			continue
+		}
+		if len(frames) != 1 || string(frames[0].Msg) != tt.frame || header != tt.header {
+			t.Errorf("%q: got %q and header %q, want %s and %q", tt.msg, frames, header, tt.frame, tt.header)
+		}
+	}
+}
+
+// latencyRe matches the latency of the responses, which is replaced in the
+// headers and errors compared.
+var latencyRe = regexp.MustCompile(`, [0-9.]+[µmn]?s\b`)
+
+func TestJSONRPCReceive(t *testing.T) {
+	tests := []struct {
+		// calls sent before receiving msg
+		sent   []string
+		msg    string
+		header string
+		body   string
+		err    string
+	}{
+		{sent: []string{"add 1 2"}, msg: `{"jsonrpc":"2.0","id":1,"result":3}`, header: "[#1 add, LATENCY] ", body: "3"},
+		{msg: `{"jsonrpc":"2.0","id":9,"result":"x"}`, header: "[#9] ", body: `"x"`},
+		{sent: []string{"f"}, msg: `{"jsonrpc":"2.0","id":1,"error":{"code":-32601,"message":"Method not found"}}`, err: "#1 f, LATENCY: error -32601: Method not found"},
+		{msg: `{"jsonrpc":"2.0","id":2,"error":{"code":1,"message":"m","data":{"x":1}}}`, header: "[#2, error data] ", body: `{"x":1}`, err: "#2: error 1: m"},
+		{sent: []string{"a\nb"}, msg: `[{"jsonrpc":"2.0","id":1,"result":1},{"jsonrpc":"2.0","id":2,"error":{"code":2,"message":"no"}}]`,
+			header: "[batch #1 a, LATENCY; #2 b, LATENCY, error] ", body: `[{"jsonrpc":"2.0","id":1,"result":1},{"jsonrpc":"2.0","id":2,"error":{"code":2,"message":"no"}}]`, err: "#2 b, LATENCY: error 2: no"},
+		{msg: `{"jsonrpc":"2.0","method":"update","params":[1]}`, header: "[notification update] ", body: "[1]"},
+		{msg: `{"jsonrpc":"2.0","method":"tick"}`, header: "[notification tick] ", body: ""},
+		{msg: `{"jsonrpc":"2.0","id":5,"method":"confirm","params":{}}`, header: "[call #5 confirm] ", body: "{}"},
+		{msg: `{"jsonrpc":"2.0","method":"eth_subscription","params":{"subscription":"0xab","result":{"n":1}}}`, header: "[notification eth_subscription 0xab] ", body: `{"n":1}`},
+		{msg: `not json`, body: "not json"},
+	}
+	for _, tt := range tests {
+		layer, err := newJSONRPC(SettingsBase{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rpc := layer.(*jsonRPC)
+		for _, msg := range tt.sent {
+			if _, _, err := rpc.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+		res := rpc.Receive(WsMsg{Type: websocket.TextMessage, Msg: []byte(tt.msg)})
+		var errText string
+		if res.Err != nil {
+			errText = latencyRe.ReplaceAllString(res.Err.Error(), ", LATENCY")
+		}
+		res.Header = latencyRe.ReplaceAllString(res.Header, ", LATENCY")
+		if res.Header != tt.header || string(res.Body) != tt.body || errText != tt.err {
+			t.Errorf("%s: got header %q, body %s and error %q", tt.msg, res.Header, res.Body, errText)
+		}
+		if status := rpc.Status(); status != "" {
+			t.Errorf("%s: got status %q after the response", tt.msg, status)
+		}
+	}
+}
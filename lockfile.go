@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// lockTimeout is how long lockFile waits for the lock to be released.
+	lockTimeout = 5 * time.Second
+	// lockStale is the age after which a lock whose process is no longer
+	// running is considered to have been left behind by a crash, and is
+	// removed.
+	lockStale = 30 * time.Second
+)
+
+// lockFile acquires an exclusive lock on file, shared between processes, by
+// creating file.lock. The returned function releases the lock.
+func lockFile(file string) (unlock func(), err error) {
+	lock := file + ".lock"
+	deadline := time.Now().Add(lockTimeout)
+
+	for {
+		f, err := os.OpenFile(lock, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintln(f, os.Getpid())
+			f.Close()
+			return func() { os.Remove(lock) }, nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if removeStaleLock(lock) {
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("timed out waiting for lock %s; remove it if no other claws is running", lock)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// removeStaleLock removes the lock if it was left behind by a crashed
+// process: it must be older than lockStale, and the process whose PID it
+// contains must not be running. It reports whether the lock was removed.
+//
+// Two processes may find the same stale lock at once: if one of them removes
+// it and creates a new lock before the other one removes it, the new lock is
+// removed too, and both processes hold it. As the lock must have been stale
+// for lockStale, this only happens after a crash, and in that case writes to
+// the configuration file are still atomic, though one of them may be lost.
+func removeStaleLock(lock string) bool {
+	fi, err := os.Stat(lock)
+	if err != nil || time.Since(fi.ModTime()) <= lockStale {
+		return false
+	}
+	data, err := os.ReadFile(lock)
+	if err != nil {
+		return false
+	}
+	// a lock without a PID was left by a crash right after creating it
+	if pid, err := strconv.Atoi(strings.TrimSpace(string(data))); err == nil && processRunning(pid) {
+		return false
+	}
+	if err := os.Remove(lock); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return false
+	}
+	return true
+}
+
+// processRunning reports whether the process with the given PID is running.
+func processRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		// on Windows, the process does not exist
+		return false
+	}
+	defer p.Release()
+	if runtime.GOOS == "windows" {
+		return true
+	}
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRemoveStaleLock(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		age     time.Duration
+		removed bool
+	}{
+		{"stale without a PID", "", 2 * lockStale, true},
+		{"stale with a running process", strconv.Itoa(os.Getpid()), 2 * lockStale, false},
+		{"recent without a PID", "", 0, false},
+		{"recent with a running process", strconv.Itoa(os.Getpid()), 0, false},
+	}
+	for _, tt := range tests {
+		lock := filepath.Join(t.TempDir(), "claws.json.lock")
+		if err := os.WriteFile(lock, []byte(tt.data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		mtime := time.Now().Add(-tt.age)
+		if err := os.Chtimes(lock, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		if got := removeStaleLock(lock); got != tt.removed {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.removed)
+		}
+		if _, err := os.Stat(lock); (err != nil) != tt.removed {
+			t.Errorf("%s: the lock exists: %v", tt.name, err == nil)
+		}
+	}
+}
@@ -21,21 +21,42 @@ func main() {
 		}
 	}()
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "config":
+			err = ConfigCommand(os.Args[2:])
+			return
+		case "bench":
+			err = BenchCommand(os.Args[2:])
+			return
+		case "test":
+			err = TestCommand(os.Args[2:])
+			return
+		}
+	}
+
 	oState := State{
 		ActionIndex: -1,
 		HideHelp:    len(os.Args) > 1,
 	}
 
+	// the configuration file and the profile are needed before the other
+	// flags can be parsed
+	configFile, profile := preParseFlags()
+
 	// load config from claws.json
-	if oState.Settings, err = LoadSettings(); err != nil {
+	if oState.Settings, err = LoadSettings(configFile); err != nil {
 		return
 	}
 
 	// cmdline configuration + help
 	// merge cmdline flags into settings
-	if err = oState.Settings.ParseFlags(); err != nil {
+	opts, err := oState.Settings.ParseFlags(profile)
+	if err != nil {
 		return
 	}
+	// the connection options of the profile are only used by this session
+	oState.setOptions(opts)
 
 	g, err := gocui.NewGui(gocui.OutputNormal)
 	if err != nil {
@@ -44,6 +65,7 @@ func main() {
 	defer g.Close()
 
 	oState.ExecuteFunc = g.Update
+	go oState.WatchSettings()
 
 	fnLayout := NewLayoutFunc(&oState)
 	g.SetManagerFunc(fnLayout)
@@ -13,6 +13,14 @@ const (
 	modeEscape
 	modeConnect
 	modeSetPing
+	modeSetDecoder
+	modeSetEncoder
+	modeSaveProfile
+	modeTemplate
+	modePrompt
+	modeSchedule
+	modeWatch
+	modeSetProtocol
 	modeMax
 )
 
@@ -23,9 +31,17 @@ type ModeStyle struct {
 }
 
 var modeChars = [modeMax]ModeStyle{
-	modeInsert:    ModeStyle{' ', gocui.ColorGreen, "INS"},
-	modeOverwrite: ModeStyle{'R', gocui.ColorGreen, "OVR"},
-	modeEscape:    ModeStyle{' ', gocui.ColorRed, "ESC"},
-	modeConnect:   ModeStyle{'c', gocui.ColorRed, "CON"},
-	modeSetPing:   ModeStyle{'p', gocui.ColorRed, "PNG"},
+	modeInsert:      ModeStyle{' ', gocui.ColorGreen, "INS"},
+	modeOverwrite:   ModeStyle{'R', gocui.ColorGreen, "OVR"},
+	modeEscape:      ModeStyle{' ', gocui.ColorRed, "ESC"},
+	modeConnect:     ModeStyle{'c', gocui.ColorRed, "CON"},
+	modeSetPing:     ModeStyle{'p', gocui.ColorRed, "PNG"},
+	modeSetDecoder:  ModeStyle{'b', gocui.ColorRed, "BIN"},
+	modeSetEncoder:  ModeStyle{'e', gocui.ColorRed, "ENC"},
+	modeSaveProfile: ModeStyle{'P', gocui.ColorRed, "PRF"},
+	modeTemplate:    ModeStyle{'T', gocui.ColorRed, "TPL"},
+	modePrompt:      ModeStyle{'?', gocui.ColorRed, "VAR"},
+	modeSchedule:    ModeStyle{'S', gocui.ColorRed, "SCH"},
+	modeWatch:       ModeStyle{'w', gocui.ColorRed, "WCH"},
+	modeSetProtocol: ModeStyle{'L', gocui.ColorRed, "LAY"},
 }
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// mqtt speaks MQTT 3.1.1 or 5 over binary WebSocket messages, which can
+// contain several packets, or parts of them. The client connects with
+// CONNECT, and sends PINGREQ packets to keep the connection alive; the user
+// types commands, which are translated into packets:
+//
+//	subscribe TOPIC [QOS]                      subscribe to a topic filter
+//	unsubscribe TOPIC                          remove a subscription
+//	publish [-qos N] [-retain] TOPIC [PAYLOAD] publish a message
+//	disconnect                                 disconnect gracefully
+//
+// The messages published with QoS 1 and 2 are acknowledged automatically.
+type mqtt struct {
+	mu sync.Mutex
+
+	v5                 bool
+	clientID           string
+	username, password string
+	keepAlive          time.Duration
+
+	// data received which doesn't contain a whole packet yet
+	buf    []byte
+	lastID uint16
+	// topics of the subscriptions, and of the SUBSCRIBE and UNSUBSCRIBE
+	// packets waiting for their acknowledgement, by packet ID
+	subs          map[string]byte
+	pendingSubs   map[uint16]mqttSubscription
+	pendingUnsubs map[uint16]string
+}
+
+type mqttSubscription struct {
+	Topic string
+	QoS   byte
+}
+
+// MQTT packet types.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+)
+
+// mqttDefaultKeepAlive is the keep alive interval used when it isn't set.
+const mqttDefaultKeepAlive = 60
+
+func newMQTT(oSet SettingsBase) (protocolLayer, error) {
+	o := oSet.MQTT
+	var v5 bool
+	switch o.Version {
+	case "", "3.1.1", "4":
+	case "5", "5.0":
+		v5 = true
+	default:
+		return nil, fmt.Errorf("unsupported MQTT version %q: use 3.1.1 or 5", o.Version)
+	}
+	keepAlive := o.KeepAlive
+	switch {
+	case keepAlive == 0:
+		keepAlive = mqttDefaultKeepAlive
+	case keepAlive < 0:
+		keepAlive = 0
+	case keepAlive > 0xffff:
+		return nil, fmt.Errorf("the MQTT keep alive must be at most %d seconds", 0xffff)
+	}
+	clientID := o.ClientID
+	if clientID == "" {
+		var b [6]byte
+		rand.Read(b[:])
+		clientID = "claws-" + hex.EncodeToString(b[:])
+	}
+	return &mqtt{
+		v5:            v5,
+		clientID:      clientID,
+		username:      o.Username,
+		password:      o.Password,
+		keepAlive:     time.Duration(keepAlive) * time.Second,
+		subs:          make(map[string]byte),
+		pendingSubs:   make(map[uint16]mqttSubscription),
+		pendingUnsubs: make(map[uint16]string),
+	}, nil
+}
+
+func (mq *mqtt) URL(u string) (string, error) {
+	return u, nil
+}
+
+// Subprotocols returns the subprotocol of MQTT.
+func (mq *mqtt) Subprotocols() []string {
+	return []string{"mqtt"}
+}
+
+// mqttPacket returns a packet, with the given type, flags and body.
+func mqttPacket(typ, flags byte, body []byte) WsMsg {
+	data := []byte{typ<<4 | flags}
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		data = append(data, b)
+		if n == 0 {
+			break
+		}
+	}
+	return WsMsg{Type: websocket.BinaryMessage, Msg: append(data, body...)}
+}
+
+// appendUint16 appends v to b, in big-endian order.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = appendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
+
+// appendProperties appends an empty list of properties, in MQTT 5.
+func (mq *mqtt) appendProperties(b []byte) []byte {
+	if mq.v5 {
+		return append(b, 0)
+	}
+	return b
+}
+
+// nextID returns a new packet ID.
+func (mq *mqtt) nextID() uint16 {
+	if mq.lastID++; mq.lastID == 0 {
+		mq.lastID = 1
+	}
+	return mq.lastID
+}
+
+func (mq *mqtt) Open() ([]WsMsg, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	var body []byte
+	body = appendMQTTString(body, "MQTT")
+	level, flags := byte(4), byte(0x02) // clean session
+	if mq.v5 {
+		level = 5
+	}
+	if mq.username != "" {
+		flags |= 0x80
+	}
+	if mq.password != "" {
+		flags |= 0x40
+	}
+	body = append(body, level, flags)
+	body = appendUint16(body, uint16(mq.keepAlive/time.Second))
+	body = mq.appendProperties(body)
+	body = appendMQTTString(body, mq.clientID)
+	if mq.username != "" {
+		body = appendMQTTString(body, mq.username)
+	}
+	if mq.password != "" {
+		body = appendMQTTString(body, mq.password)
+	}
+	return []WsMsg{mqttPacket(mqttConnect, 0, body)}, nil
+}
+
+// parseQoS parses a QoS level, 0, 1 or 2.
+func parseQoS(s string) (byte, error) {
+	switch s {
+	case "0", "1", "2":
+		return s[0] - '0', nil
+	}
+	return 0, fmt.Errorf("invalid QoS %q: use 0, 1 or 2", s)
+}
+
+func (mq *mqtt) Send(msg string) ([]WsMsg, string, error) {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	cmd, arg := parsePlaceholder(msg)
+	switch cmd {
+	case "subscribe":
+		topic, rest := parsePlaceholder(arg)
+		if topic == "" {
+			return nil, "", errors.New("usage: subscribe TOPIC [QOS]")
+		}
+		var qos byte
+		if rest != "" {
+			var err error
+			if qos, err = parseQoS(rest); err != nil {
+				return nil, "", err
+			}
+		}
+		id := mq.nextID()
+		body := appendUint16(nil, id)
+		body = mq.appendProperties(body)
+		body = appendMQTTString(body, topic)
+		body = append(body, qos)
+		mq.pendingSubs[id] = mqttSubscription{topic, qos}
+		return []WsMsg{mqttPacket(mqttSubscribe, 0x02, body)}, fmt.Sprintf("[#%d] ", id), nil
+	case "unsubscribe":
+		if arg == "" {
+			return nil, "", errors.New("usage: unsubscribe TOPIC")
+		}
+		id := mq.nextID()
+		body := appendUint16(nil, id)
+		body = mq.appendProperties(body)
+		body = appendMQTTString(body, arg)
+		mq.pendingUnsubs[id] = arg
+		return []WsMsg{mqttPacket(mqttUnsubscribe, 0x02, body)}, fmt.Sprintf("[#%d] ", id), nil
+	case "publish":
+		return mq.publish(arg)
+	case "disconnect":
+		var body []byte
+		if mq.v5 {
+			body = []byte{0, 0}
+		}
+		return []WsMsg{mqttPacket(mqttDisconnect, 0, body)}, "", nil
+	}
+	return nil, "", fmt.Errorf("unknown MQTT command %q; use subscribe, unsubscribe, publish or disconnect", cmd)
+}
+
+// publish returns the PUBLISH packet for the arguments of the publish
+// command.
+func (mq *mqtt) publish(arg string) ([]WsMsg, string, error) {
+	const usage = "usage: publish [-qos N] [-retain] TOPIC [PAYLOAD]"
+	var qos byte
+	var retain bool
+	for {
+		opt, rest := parsePlaceholder(arg)
+		switch opt {
+		case "-qos":
+			var err error
+			var level string
+			level, arg = parsePlaceholder(rest)
+			if qos, err = parseQoS(level); err != nil {
+				return nil, "", err
+			}
+			continue
+		case "-retain":
+			retain, arg = true, rest
+			continue
+		}
+		break
+	}
+	topic, payload := parsePlaceholder(arg)
+	if topic == "" {
+		return nil, "", errors.New(usage)
+	}
+
+	flags := qos << 1
+	if retain {
+		flags |= 0x01
+	}
+	body := appendMQTTString(nil, topic)
+	header := ""
+	if qos > 0 {
+		id := mq.nextID()
+		body = appendUint16(body, id)
+		header = fmt.Sprintf("[#%d] ", id)
+	}
+	body = mq.appendProperties(body)
+	body = append(body, payload...)
+	return []WsMsg{mqttPacket(mqttPublish, flags, body)}, header, nil
+}
+
+// mqttConnackErrors describe the return codes of CONNACK, in MQTT 3.1.1,
+// and the most common reason codes, in MQTT 5.
+var mqttConnackErrors = map[byte]string{
+	1:    "unacceptable protocol version",
+	2:    "client identifier rejected",
+	3:    "server unavailable",
+	4:    "bad user name or password",
+	5:    "not authorized",
+	0x80: "unspecified error",
+	0x84: "unsupported protocol version",
+	0x85: "client identifier not valid",
+	0x86: "bad user name or password",
+	0x87: "not authorized",
+	0x88: "server unavailable",
+	0x89: "server busy",
+	0x8a: "banned",
+}
+
+// splitMQTTPacket returns the first packet in data, and the rest of data.
+// If data doesn't contain a whole packet, the packet is nil.
+func splitMQTTPacket(data []byte) (first byte, body, rest []byte, err error) {
+	length, mult := 0, 1
+	for i := 1; ; i++ {
+		if i >= len(data) {
+			return 0, nil, data, nil
+		}
+		if i > 4 {
+			return 0, nil, nil, errors.New("invalid MQTT packet: malformed remaining length")
+		}
+		length += int(data[i]&0x7f) * mult
+		mult *= 128
+		if data[i]&0x80 == 0 {
+			if len(data) < i+1+length {
+				return 0, nil, data, nil
+			}
+			return data[0], data[i+1 : i+1+length], data[i+1+length:], nil
+		}
+	}
+}
+
+// skipProperties skips the properties at the start of b, in MQTT 5.
+func (mq *mqtt) skipProperties(b []byte) []byte {
+	if !mq.v5 {
+		return b
+	}
+	length, mult := 0, 1
+	for i := 0; i < len(b) && i < 4; i++ {
+		length += int(b[i]&0x7f) * mult
+		mult *= 128
+		if b[i]&0x80 == 0 {
+			if i+1+length > len(b) {
+				return nil
+			}
+			return b[i+1+length:]
+		}
+	}
+	return nil
+}
+
+func (mq *mqtt) Receive(msg WsMsg) layerResult {
+	if msg.Type != websocket.BinaryMessage {
+		return layerResult{Body: msg.Msg}
+	}
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.buf = append(mq.buf, msg.Msg...)
+	var results []layerResult
+	for len(mq.buf) > 0 {
+		first, body, rest, err := splitMQTTPacket(mq.buf)
+		if err != nil {
+			mq.buf = nil
+			results = append(results, layerResult{Err: err})
+			break
+		}
+		if body == nil && len(rest) == len(mq.buf) {
+			// wait for the rest of the packet
+			break
+		}
+		mq.buf = rest
+		if res := mq.receivePacket(first, body); res != nil {
+			results = append(results, *res)
+		}
+	}
+	if len(mq.buf) == 0 {
+		mq.buf = nil
+	}
+
+	if len(results) == 0 {
+		return layerResult{}
+	}
+	res := results[0]
+	res.Next = results[1:]
+	return res
+}
+
+// receivePacket handles a packet, whose first byte and body are given.
+func (mq *mqtt) receivePacket(first byte, body []byte) *layerResult {
+	typ, flags := first>>4, first&0x0f
+	var id uint16
+	if len(body) >= 2 {
+		id = binary.BigEndian.Uint16(body)
+	}
+	fnAck := func(typ, flags byte) WsMsg {
+		b := appendUint16(nil, id)
+		return mqttPacket(typ, flags, b)
+	}
+
+	switch typ {
+	case mqttConnack:
+		if len(body) < 2 {
+			return &layerResult{Err: errors.New("invalid MQTT CONNACK packet")}
+		}
+		if code := body[1]; code != 0 {
+			desc, ok := mqttConnackErrors[code]
+			if !ok {
+				desc = "code " + strconv.Itoa(int(code))
+			}
+			return &layerResult{Err: errors.New("MQTT connection refused: " + desc)}
+		}
+		info := "Connected to the MQTT broker as " + mq.clientID
+		if body[0]&0x01 != 0 {
+			info += " (session present)"
+		}
+		res := &layerResult{Info: info}
+		if mq.keepAlive > 0 {
+			res.Heartbeat, res.HeartbeatFrame = mq.keepAlive*3/4, mqttPacket(mqttPingreq, 0, nil)
+		}
+		return res
+	case mqttPublish:
+		return mq.receivePublish(flags, body)
+	case mqttPuback:
+		return &layerResult{Info: fmt.Sprintf("Message #%d acknowledged", id)}
+	case mqttPubrec:
+		return &layerResult{Replies: []WsMsg{fnAck(mqttPubrel, 0x02)}}
+	case mqttPubrel:
+		return &layerResult{Replies: []WsMsg{fnAck(mqttPubcomp, 0)}}
+	case mqttPubcomp:
+		return &layerResult{Info: fmt.Sprintf("Message #%d delivered", id)}
+	case mqttSuback:
+		if len(body) < 2 {
+			return &layerResult{Err: errors.New("invalid MQTT SUBACK packet")}
+		}
+		sub, ok := mq.pendingSubs[id]
+		delete(mq.pendingSubs, id)
+		codes := mq.skipProperties(body[2:])
+		if !ok || len(codes) == 0 {
+			return &layerResult{Info: fmt.Sprintf("Subscription #%d acknowledged", id)}
+		}
+		if codes[0] >= 0x80 {
+			return &layerResult{Err: fmt.Errorf("subscription #%d to %s refused (code %#x)", id, sub.Topic, codes[0])}
+		}
+		mq.subs[sub.Topic] = codes[0]
+		return &layerResult{Info: fmt.Sprintf("Subscribed to %s (QoS %d)", sub.Topic, codes[0])}
+	case mqttUnsuback:
+		topic, ok := mq.pendingUnsubs[id]
+		delete(mq.pendingUnsubs, id)
+		if !ok {
+			return &layerResult{Info: fmt.Sprintf("Unsubscription #%d acknowledged", id)}
+		}
+		delete(mq.subs, topic)
+		return &layerResult{Info: "Unsubscribed from " + topic}
+	case mqttPingresp:
+		return nil
+	case mqttDisconnect:
+		info := "Disconnected by the MQTT broker"
+		if len(body) > 0 && body[0] != 0 {
+			info += fmt.Sprintf(" (code %#x)", body[0])
+		}
+		return &layerResult{Info: info}
+	}
+	return &layerResult{Err: fmt.Errorf("unexpected MQTT packet of type %d", typ)}
+}
+
+// receivePublish shows a message published, acknowledging it.
+func (mq *mqtt) receivePublish(flags byte, body []byte) *layerResult {
+	if len(body) < 2 {
+		return &layerResult{Err: errors.New("invalid MQTT PUBLISH packet")}
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return &layerResult{Err: errors.New("invalid MQTT PUBLISH packet")}
+	}
+	topic, body := string(body[2:2+n]), body[2+n:]
+
+	qos := flags >> 1 & 0x03
+	res := &layerResult{}
+	header := "[" + topic
+	if qos > 0 {
+		if len(body) < 2 {
+			return &layerResult{Err: errors.New("invalid MQTT PUBLISH packet")}
+		}
+		id := body[:2]
+		body = body[2:]
+		ack := mqttPacket(mqttPuback, 0, id)
+		if qos == 2 {
+			ack = mqttPacket(mqttPubrec, 0, id)
+		}
+		res.Replies = []WsMsg{ack}
+		header += fmt.Sprintf(", QoS %d", qos)
+	}
+	if flags&0x01 != 0 {
+		header += ", retained"
+	}
+	res.Header = header + "] "
+
+	payload := mq.skipProperties(body)
+	if payload == nil {
+		payload = []byte{}
+	}
+	res.Body = payload
+	// text payloads are formatted like text messages, while the others can
+	// be decoded by the binary decoders
+	if utf8.Valid(payload) {
+		res.Type = websocket.TextMessage
+	}
+	return res
+}
+
+// Status lists the subscriptions.
+func (mq *mqtt) Status() string {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	if len(mq.subs) == 0 {
+		return "MQTT: no subscriptions"
+	}
+	topics := make([]string, 0, len(mq.subs))
+	for topic := range mq.subs {
+		topics = append(topics, topic)
+	}
+	sort.Strings(topics)
+	return fmt.Sprintf("MQTT: %d subscription(s): %s", len(topics), strings.Join(topics, ", "))
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestMQTTRemainingLength(t *testing.T) {
+	tests := []struct {
+		length int
+		// bytes of the remaining length
+		size int
+	}{
+		{0, 1},
+		{1, 1},
+		{127, 1},
+		{128, 2},
+		{16383, 2},
+		{16384, 3},
+		{2097151, 3},
+		{2097152, 4},
+	}
+	for _, tt := range tests {
+		body := bytes.Repeat([]byte{'x'}, tt.length)
+		pkt := mqttPacket(mqttPublish, 0, body).Msg
+		if got := len(pkt) - 1 - tt.length; got != tt.size {
+			t.Errorf("length %d: encoded in %d bytes, want %d", tt.length, got, tt.size)
+		}
+		first, gotBody, rest, err := splitMQTTPacket(pkt)
+		if err != nil {
+			t.Errorf("length %d: %v", tt.length, err)
+			continue
+		}
+		if first != mqttPublish<<4 || len(gotBody) != tt.length || len(rest) != 0 {
+			t.Errorf("length %d: got first byte %#x, body of %d bytes and %d bytes left", tt.length, first, len(gotBody), len(rest))
+		}
+	}
+}
+
+func TestSplitMQTTPacket(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		body    []byte
+		rest    []byte
+		wantErr bool
+	}{
+		{"empty body", []byte{0xd0, 0x00}, []byte{}, []byte{}, false},
+		{"followed by another packet", []byte{0x40, 0x02, 0x00, 0x01, 0xd0}, []byte{0x00, 0x01}, []byte{0xd0}, false},
+		{"length missing", []byte{0x30}, nil, []byte{0x30}, false},
+		{"length incomplete", []byte{0x30, 0x80}, nil, []byte{0x30, 0x80}, false},
+		{"body incomplete", []byte{0x30, 0x03, 0x00}, nil, []byte{0x30, 0x03, 0x00}, false},
+		{"length too long", []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x01}, nil, nil, true},
+	}
+	for _, tt := range tests {
+		_, body, rest, err := splitMQTTPacket(tt.data)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(body, tt.body) || (body == nil) != (tt.body == nil) || !bytes.Equal(rest, tt.rest) {
+			t.Errorf("%s: got body %x and rest %x, want %x and %x", tt.name, body, rest, tt.body, tt.rest)
+		}
+	}
+}
+
+// mqttPublishPacket returns a PUBLISH packet with QoS 0.
+func mqttPublishPacket(topic, payload string, v5 bool) []byte {
+	body := appendMQTTString(nil, topic)
+	if v5 {
+		// a content type property
+		body = append(body, 6, 0x03, 0x00, 0x03, 'a', '/', 'b')
+	}
+	return mqttPacket(mqttPublish, 0, append(body, payload...)).Msg
+}
+
+func TestMQTTReceive(t *testing.T) {
+	pkt := mqttPublishPacket("a/b", "hello", false)
+	two := append(mqttPublishPacket("x", "1", false), mqttPublishPacket("y", "2", false)...)
+	tests := []struct {
+		name   string
+		v5     bool
+		frames [][]byte
+		want   []string
+	}{
+		{"whole packet", false, [][]byte{pkt}, []string{"[a/b] hello"}},
+		{"split after the first byte", false, [][]byte{pkt[:1], pkt[1:]}, []string{"[a/b] hello"}},
+		{"split in the body", false, [][]byte{pkt[:5], pkt[5:9], pkt[9:]}, []string{"[a/b] hello"}},
+		{"byte by byte", false, splitBytes(pkt), []string{"[a/b] hello"}},
+		{"two packets", false, [][]byte{two}, []string{"[x] 1", "[y] 2"}},
+		{"two packets, split", false, [][]byte{two[:6], two[6:]}, []string{"[x] 1", "[y] 2"}},
+		{"properties", true, [][]byte{mqttPublishPacket("a/b", "hello", true)}, []string{"[a/b] hello"}},
+	}
+	for _, tt := range tests {
+		oSet := SettingsBase{}
+		if tt.v5 {
+			oSet.MQTT.Version = "5"
+		}
+		layer, err := newMQTT(oSet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, f := range tt.frames {
+			res := layer.Receive(WsMsg{Type: websocket.BinaryMessage, Msg: f})
+			for _, r := range append([]layerResult{res}, res.Next...) {
+				if r.Err != nil {
+					t.Errorf("%s: %v", tt.name, r.Err)
+				}
+				if r.Header != "" || r.Body != nil {
+					got = append(got, r.Header+string(r.Body))
+				}
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func splitBytes(b []byte) [][]byte {
+	res := make([][]byte, len(b))
+	for i := range b {
+		res[i] = b[i : i+1]
+	}
+	return res
+}
+
+func TestMQTTReceiveInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"topic too long", []byte{0x30, 0x03, 0x00, 0x05, 'a'}},
+		{"packet ID missing", []byte{0x32, 0x03, 0x00, 0x01, 'a'}},
+		{"CONNACK too short", []byte{0x20, 0x01, 0x00}},
+		{"SUBACK too short", []byte{0x90, 0x01, 0x00}},
+	}
+	for _, tt := range tests {
+		layer, err := newMQTT(SettingsBase{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res := layer.Receive(WsMsg{Type: websocket.BinaryMessage, Msg: tt.data}); res.Err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
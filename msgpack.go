@@ -0,0 +1,311 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// decodeMsgpack decodes a MessagePack payload.
+func decodeMsgpack(msg []byte, oSet SettingsBase) (string, error) {
+	r := &binReader{b: msg}
+	v, err := readMsgpack(r)
+	if err != nil {
+		return "", err
+	}
+	if err := r.end(); err != nil {
+		return "", err
+	}
+	return formatTree(v), nil
+}
+
+func readMsgpack(r *binReader) (interface{}, error) {
+	if err := r.enter(); err != nil {
+		return nil, err
+	}
+	defer r.leave()
+
+	c, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return readMsgpackMap(r, uint64(c&0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return readMsgpackArray(r, uint64(c&0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := r.bytes(uint64(c & 0x1f))
+		return string(b), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+
+	// bin 8/16/32, str 8/16/32
+	case 0xc4, 0xc5, 0xc6, 0xd9, 0xda, 0xdb:
+		var n uint64
+		switch c {
+		case 0xc4, 0xd9:
+			n, err = r.uint(1)
+		case 0xc5, 0xda:
+			n, err = r.uint(2)
+		default:
+			n, err = r.uint(4)
+		}
+		if err != nil {
+			return nil, err
+		}
+		b, err := r.bytes(n)
+		if err != nil {
+			return nil, err
+		}
+		if c >= 0xd9 {
+			return string(b), nil
+		}
+		return b, nil
+
+	// ext 8/16/32
+	case 0xc7, 0xc8, 0xc9:
+		n, err := r.uint(1 << (c - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackExt(r, n)
+	// fixext 1/2/4/8/16
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return readMsgpackExt(r, 1<<(c-0xd4))
+
+	case 0xca:
+		n, err := r.uint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := r.uint(8)
+		return math.Float64frombits(n), err
+
+	// uint 8/16/32/64
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return r.uint(1 << (c - 0xcc))
+	// int 8/16/32/64
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		n, err := r.uint(size)
+		// sign extension
+		shift := 64 - 8*size
+		return int64(n<<shift) >> shift, err
+
+	// array 16/32
+	case 0xdc, 0xdd:
+		n, err := r.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackArray(r, n)
+	// map 16/32
+	case 0xde, 0xdf:
+		n, err := r.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return readMsgpackMap(r, n)
+	}
+
+	return nil, fmt.Errorf("invalid MessagePack type byte 0x%02x", c)
+}
+
+func readMsgpackArray(r *binReader, n uint64) (interface{}, error) {
+	if err := r.checkLength(n); err != nil {
+		return nil, err
+	}
+	res := make([]interface{}, n)
+	for i := range res {
+		var err error
+		if res[i], err = readMsgpack(r); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func readMsgpackMap(r *binReader, n uint64) (interface{}, error) {
+	if err := r.checkLength(n); err != nil {
+		return nil, err
+	}
+	res := make([]mapEntry, n)
+	for i := range res {
+		var err error
+		if res[i].Key, err = readMsgpack(r); err != nil {
+			return nil, err
+		}
+		if res[i].Value, err = readMsgpack(r); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// msgpackTimestamp is the extension type of MessagePack timestamps.
+const msgpackTimestamp = -1
+
+func readMsgpackExt(r *binReader, n uint64) (interface{}, error) {
+	typ, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := r.bytes(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(typ) == msgpackTimestamp {
+		dr := &binReader{b: data}
+		switch n {
+		case 4:
+			sec, _ := dr.uint(4)
+			return time.Unix(int64(sec), 0), nil
+		case 8:
+			v, _ := dr.uint(8)
+			return time.Unix(int64(v&(1<<34-1)), int64(v>>34)), nil
+		case 12:
+			nsec, _ := dr.uint(4)
+			sec, _ := dr.uint(8)
+			return time.Unix(int64(sec), int64(nsec)), nil
+		}
+	}
+
+	return extValue{Type: int8(typ), Data: data}, nil
+}
+
+// encodeMsgpack encodes a JSON message as MessagePack.
+func encodeMsgpack(msg []byte, oSet SettingsBase) ([]byte, error) {
+	v, err := parseJSONTree(msg)
+	if err != nil {
+		return nil, err
+	}
+	w := new(binWriter)
+	if err := writeMsgpack(w, v); err != nil {
+		return nil, err
+	}
+	return w.Bytes(), nil
+}
+
+func writeMsgpack(w *binWriter, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(0xc0)
+	case bool:
+		if v {
+			w.WriteByte(0xc3)
+		} else {
+			w.WriteByte(0xc2)
+		}
+	case int64:
+		switch {
+		case v >= 0:
+			writeMsgpackUint(w, uint64(v))
+		case v >= -32:
+			w.WriteByte(byte(v))
+		case v >= math.MinInt8:
+			w.WriteByte(0xd0)
+			w.writeUint(1, uint64(v))
+		case v >= math.MinInt16:
+			w.WriteByte(0xd1)
+			w.writeUint(2, uint64(v))
+		case v >= math.MinInt32:
+			w.WriteByte(0xd2)
+			w.writeUint(4, uint64(v))
+		default:
+			w.WriteByte(0xd3)
+			w.writeUint(8, uint64(v))
+		}
+	case uint64:
+		writeMsgpackUint(w, v)
+	case float64:
+		w.WriteByte(0xcb)
+		w.writeUint(8, math.Float64bits(v))
+	case string:
+		writeMsgpackHead(w, len(v), 32, msgpackStrTypes)
+		w.WriteString(v)
+	case []byte:
+		writeMsgpackHead(w, len(v), 0, msgpackBinTypes)
+		w.Write(v)
+	case []interface{}:
+		writeMsgpackHead(w, len(v), 16, msgpackArrayTypes)
+		for _, el := range v {
+			if err := writeMsgpack(w, el); err != nil {
+				return err
+			}
+		}
+	case []mapEntry:
+		writeMsgpackHead(w, len(v), 16, msgpackMapTypes)
+		for _, e := range v {
+			if err := writeMsgpack(w, e.Key); err != nil {
+				return err
+			}
+			if err := writeMsgpack(w, e.Value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: cannot encode value of type %T", v)
+	}
+	return nil
+}
+
+func writeMsgpackUint(w *binWriter, v uint64) {
+	switch {
+	case v <= 0x7f:
+		w.WriteByte(byte(v))
+	case v <= math.MaxUint8:
+		w.WriteByte(0xcc)
+		w.writeUint(1, v)
+	case v <= math.MaxUint16:
+		w.WriteByte(0xcd)
+		w.writeUint(2, v)
+	case v <= math.MaxUint32:
+		w.WriteByte(0xce)
+		w.writeUint(4, v)
+	default:
+		w.WriteByte(0xcf)
+		w.writeUint(8, v)
+	}
+}
+
+// Type bytes of the variants of strings, binaries, arrays and maps, used by
+// writeMsgpackHead: fixed length, 8-bit, 16-bit and 32-bit length.
+// Variants which do not exist are 0.
+var (
+	msgpackStrTypes   = [4]byte{0xa0, 0xd9, 0xda, 0xdb}
+	msgpackBinTypes   = [4]byte{0, 0xc4, 0xc5, 0xc6}
+	msgpackArrayTypes = [4]byte{0x90, 0, 0xdc, 0xdd}
+	msgpackMapTypes   = [4]byte{0x80, 0, 0xde, 0xdf}
+)
+
+// writeMsgpackHead writes the type byte and the length n of a string, binary,
+// array or map, using the smallest variant in types. fixMax is the number of
+// lengths which can be represented by the fixed length variant.
+func writeMsgpackHead(w *binWriter, n int, fixMax int, types [4]byte) {
+	switch {
+	case types[0] != 0 && n < fixMax:
+		w.WriteByte(types[0] | byte(n))
+	case types[1] != 0 && n <= math.MaxUint8:
+		w.WriteByte(types[1])
+		w.writeUint(1, uint64(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(types[2])
+		w.writeUint(2, uint64(n))
+	default:
+		w.WriteByte(types[3])
+		w.writeUint(4, uint64(n))
+	}
+}
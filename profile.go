@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+)
+
+// ConnectionOptions are the settings of a connection to a WebSocket, which
+// can be saved, together with the URL, as a Profile.
+type ConnectionOptions struct {
+	PingSeconds int
+	Pipe        struct {
+		In  []string
+		Out []string
+	}
+	Headers          []string
+	Subprotocols     []string
+	TLS              TLSOptions
+	OnConnect        []string
+	Proxy            string
+	UnixSocket       string
+	Compression      bool
+	CompressionLevel int
+	Decompression    string
+	BinaryDecoder    string
+	BinaryEncoder    string
+	Protobuf         struct {
+		DescriptorSet string
+		Message       string
+		SendMessage   string
+	}
+	// Protocol is the application protocol spoken over the connection (see
+	// protocolLayers), if any.
+	Protocol string
+	SocketIO struct {
+		Namespace string
+		// JSON object sent when connecting to a namespace
+		Auth string
+	}
+	STOMP struct {
+		Login    string
+		Passcode string
+		// virtual host, the host of the URL if empty
+		Host string
+		// heart-beats offered to the server, "SEND_MS,RECEIVE_MS"
+		HeartBeat string
+	}
+	GraphQL struct {
+		// JSON object sent with connection_init
+		InitPayload string
+	}
+	MQTT struct {
+		// "3.1.1" (the default) or "5"
+		Version  string
+		ClientID string
+		Username string
+		Password string
+		// keep alive interval, in seconds: 60 when 0, disabled when negative
+		KeepAlive int
+	}
+}
+
+func (o *ConnectionOptions) Clone() ConnectionOptions {
+	ret := *o
+	ret.Pipe.In = cloneStrings(o.Pipe.In)
+	ret.Pipe.Out = cloneStrings(o.Pipe.Out)
+	ret.Headers = cloneStrings(o.Headers)
+	ret.Subprotocols = cloneStrings(o.Subprotocols)
+	ret.OnConnect = cloneStrings(o.OnConnect)
+	return ret
+}
+
+func cloneStrings(src []string) []string {
+	if src == nil {
+		return nil
+	}
+	dst := make([]string, len(src))
+	copy(dst, src)
+	return dst
+}
+
+// Profile is a named set of settings for connecting to a WebSocket.
+type Profile struct {
+	URL string
+	ConnectionOptions
+}
+
+// TLSOptions contains the TLS settings of a connection.
+type TLSOptions struct {
+	// Insecure disables the verification of the server's certificate.
+	Insecure bool
+	// CAFile is a PEM file with the certificates of the CAs used to verify
+	// the server's certificate, instead of the system ones.
+	CAFile string
+	// CertFile and KeyFile are the PEM files of the client certificate.
+	CertFile string
+	KeyFile  string
+	// ServerName is the server name used for verifying the certificate and
+	// for SNI, instead of the host in the URL.
+	ServerName string
+}
+
+// Config returns the tls.Config for the options, or nil if the defaults
+// should be used.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if o == (TLSOptions{}) {
+		return nil, nil
+	}
+
+	cfg := &tls.Config{
+		InsecureSkipVerify: o.Insecure,
+		ServerName:         o.ServerName,
+	}
+	if o.CAFile != "" {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// WsOptions returns the options used to open a connection.
+func (o *ConnectionOptions) WsOptions() (WsOptions, error) {
+	header, err := parseHeaders(o.Headers)
+	if err != nil {
+		return WsOptions{}, err
+	}
+	tlsConfig, err := o.TLS.Config()
+	if err != nil {
+		return WsOptions{}, err
+	}
+	return WsOptions{
+		PingSeconds:      o.PingSeconds,
+		Header:           header,
+		Subprotocols:     o.Subprotocols,
+		TLSConfig:        tlsConfig,
+		Compression:      o.Compression,
+		CompressionLevel: o.CompressionLevel,
+		Proxy:            o.Proxy,
+		UnixSocket:       o.UnixSocket,
+	}, nil
+}
+
+// parseHeaders parses headers in the form "Name: value".
+func parseHeaders(headers []string) (http.Header, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+	h := make(http.Header, len(headers))
+	for _, line := range headers {
+		name, value, ok := strings.Cut(line, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid header %q: must be in the form \"Name: value\"", line)
+		}
+		h.Add(name, strings.TrimSpace(value))
+	}
+	return h, nil
+}
+
+// ProfileNames returns the sorted names of the saved profiles.
+func (s *SettingsBase) ProfileNames() []string {
+	names := make([]string, 0, len(s.Profiles))
+	for name := range s.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyProfile replaces the URL and the connection options with those of the
+// profile with the given name.
+func (s *SettingsBase) ApplyProfile(name string) error {
+	p, ok := s.Profiles[name]
+	if !ok {
+		if len(s.Profiles) == 0 {
+			return fmt.Errorf("profile %q does not exist; no profiles have been saved", name)
+		}
+		return fmt.Errorf("profile %q does not exist; available profiles: %s", name, strings.Join(s.ProfileNames(), ", "))
+	}
+	s.LastWebsocketURL = p.URL
+	s.ConnectionOptions = p.ConnectionOptions.Clone()
+	return nil
+}
+
+// SaveProfile saves the current URL and connection options as the profile
+// with the given name, replacing it if it already exists.
+func (s *SettingsBase) SaveProfile(name string) error {
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return errors.New("profile names must not be empty or contain spaces")
+	}
+	if s.Profiles == nil {
+		s.Profiles = make(map[string]Profile)
+	}
+	s.Profiles[name] = Profile{
+		URL:               s.LastWebsocketURL,
+		ConnectionOptions: s.ConnectionOptions.Clone(),
+	}
+	return nil
+}
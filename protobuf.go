@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// decodeProtobuf decodes a Protobuf payload. If a descriptor set and a message
+// name are specified in the settings, the message is decoded using its schema
+// and shown as JSON; otherwise, it is decoded without a schema, showing the
+// field numbers and wire types.
+func decodeProtobuf(msg []byte, oSet SettingsBase) (string, error) {
+	if oSet.Protobuf.Message == "" {
+		v, err := readProtoFields(msg, 0)
+		if err != nil {
+			return "", err
+		}
+		return formatTree(v), nil
+	}
+
+	md, err := findProtoMessage(oSet.Protobuf.DescriptorSet, oSet.Protobuf.Message)
+	if err != nil {
+		return "", err
+	}
+	m := dynamicpb.NewMessage(md)
+	if err := proto.Unmarshal(msg, m); err != nil {
+		return "", err
+	}
+	res, err := protojson.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(attemptJSONFormatting(res)), nil
+}
+
+// encodeProtobuf encodes a JSON message as the Protobuf message specified in
+// the settings, using the Protobuf JSON mapping.
+func encodeProtobuf(msg []byte, oSet SettingsBase) ([]byte, error) {
+	if oSet.Protobuf.SendMessage == "" {
+		return nil, errors.New("protobuf: no message type specified for sent messages")
+	}
+	md, err := findProtoMessage(oSet.Protobuf.DescriptorSet, oSet.Protobuf.SendMessage)
+	if err != nil {
+		return nil, err
+	}
+	m := dynamicpb.NewMessage(md)
+	if err := protojson.Unmarshal(msg, m); err != nil {
+		return nil, err
+	}
+	return proto.Marshal(m)
+}
+
+// readProtoFields decodes a Protobuf message without knowing its schema.
+// Length-delimited fields are shown as nested messages if they can be parsed
+// as such, as strings if they are text, and as bytes otherwise. depth is the
+// nesting of the message: deeper than maxBinaryDepth, fields are no longer
+// parsed as messages.
+func readProtoFields(b []byte, depth int) ([]mapEntry, error) {
+	res := []mapEntry{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		var v interface{}
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, n = protowire.ConsumeFixed32(b)
+			v = uint64(x)
+		case protowire.Fixed64Type:
+			v, n = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			var x []byte
+			x, n = protowire.ConsumeBytes(b)
+			v = protoBytesValue(x, depth+1)
+		case protowire.StartGroupType:
+			var x []byte
+			x, n = protowire.ConsumeGroup(num, b)
+			if n >= 0 {
+				v = protoBytesValue(x, depth+1)
+			}
+		default:
+			return nil, fmt.Errorf("invalid wire type %d for field %d", typ, num)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		res = append(res, mapEntry{
+			Key:   strconv.Itoa(int(num)) + ":" + protoWireTypeNames[typ],
+			Value: v,
+		})
+	}
+	return res, nil
+}
+
+func protoBytesValue(b []byte, depth int) interface{} {
+	if len(b) > 0 && depth < maxBinaryDepth {
+		if fields, err := readProtoFields(b, depth); err == nil {
+			return fields
+		}
+	}
+	if isText(b) {
+		return string(b)
+	}
+	return b
+}
+
+var protoWireTypeNames = map[protowire.Type]string{
+	protowire.VarintType:     "varint",
+	protowire.Fixed32Type:    "fixed32",
+	protowire.Fixed64Type:    "fixed64",
+	protowire.BytesType:      "bytes",
+	protowire.StartGroupType: "group",
+}
+
+// protoFiles caches the last descriptor set which was loaded.
+var protoFiles struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	files   *protoregistry.Files
+}
+
+// findProtoMessage finds the descriptor of the message with the given full
+// name in the descriptor set at path (as generated by
+// `protoc --include_imports --descriptor_set_out`).
+func findProtoMessage(path, name string) (protoreflect.MessageDescriptor, error) {
+	if path == "" {
+		return nil, errors.New("protobuf: no descriptor set specified")
+	}
+
+	protoFiles.Lock()
+	defer protoFiles.Unlock()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if protoFiles.path != path || !protoFiles.modTime.Equal(fi.ModTime()) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var set descriptorpb.FileDescriptorSet
+		if err := proto.Unmarshal(data, &set); err != nil {
+			return nil, fmt.Errorf("protobuf: reading %s: %w", path, err)
+		}
+		files, err := protodesc.NewFiles(&set)
+		if err != nil {
+			return nil, fmt.Errorf("protobuf: reading %s: %w", path, err)
+		}
+		protoFiles.path, protoFiles.modTime, protoFiles.files = path, fi.ModTime(), files
+	}
+
+	d, err := protoFiles.files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, fmt.Errorf("protobuf: message %s: %w", name, err)
+	}
+	md, ok := d.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("protobuf: %s is not a message", name)
+	}
+	return md, nil
+}
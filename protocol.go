@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// A protocolLayer speaks an application protocol, such as Socket.IO, over
+// the WebSocket connection: it translates the messages typed by the user
+// into frames, and decodes the frames received, answering those which are
+// part of the protocol, such as heartbeats. A new layer is created for each
+// connection, and its methods can be called concurrently.
+type protocolLayer interface {
+	// URL returns the URL to connect to, adding what the protocol needs.
+	URL(url string) (string, error)
+	// Open returns the frames to send after connecting.
+	Open() ([]WsMsg, error)
+	// Send translates a message typed by the user into the frames to send,
+	// returning a header describing them, which is shown before the message.
+	Send(msg string) (frames []WsMsg, header string, err error)
+	// Receive decodes a frame received.
+	Receive(msg WsMsg) layerResult
+}
+
+// layerResult is a frame received, as decoded by a protocolLayer.
+type layerResult struct {
+	// Header and Body are shown as a message received, unless Body is nil.
+	// Type, if not zero, is the type of the message shown, instead of the
+	// type of the frame.
+	Header string
+	Body   []byte
+	Type   int
+	// Info is shown as debug information, and Err as an error.
+	Info string
+	Err  error
+	// Replies are sent to the server.
+	Replies []WsMsg
+	// Heartbeat, if not zero, is the interval at which HeartbeatFrame is
+	// sent to the server from now on, for as long as the connection is open.
+	Heartbeat      time.Duration
+	HeartbeatFrame WsMsg
+	// Next are the results of the other packets in the frame, for the
+	// protocols which can send several packets in a frame.
+	Next []layerResult
+}
+
+// layerSubprotocols is implemented by the protocol layers which request
+// WebSocket subprotocols, when none are set.
+type layerSubprotocols interface {
+	Subprotocols() []string
+}
+
+// layerStatus is implemented by the protocol layers which show their state
+// in the status line.
+type layerStatus interface {
+	Status() string
+}
+
+// protocolLayers contains the protocol layers which can be chosen using the
+// Protocol setting.
+var protocolLayers = map[string]func(oSet SettingsBase) (protocolLayer, error){
+	"graphql":        newGraphQL,
+	"graphql-legacy": newGraphQLLegacy,
+	"jsonrpc":        newJSONRPC,
+	"mqtt":           newMQTT,
+	"socketio":       newSocketIO,
+	"stomp":          newSTOMP,
+}
+
+// protocolLayerNames returns the sorted names of the available protocol
+// layers.
+func protocolLayerNames() []string {
+	names := make([]string, 0, len(protocolLayers))
+	for name := range protocolLayers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newProtocolLayer returns the protocol layer set in the settings, or nil if
+// messages are sent as they are typed.
+func newProtocolLayer(oSet SettingsBase) (protocolLayer, error) {
+	if oSet.Protocol == "" {
+		return nil, nil
+	}
+	fnNew, ok := protocolLayers[oSet.Protocol]
+	if !ok {
+		return nil, fmt.Errorf("unknown protocol %q; available protocols: %s", oSet.Protocol, strings.Join(protocolLayerNames(), ", "))
+	}
+	return fnNew(oSet)
+}
+
+func textFrame(s string) WsMsg {
+	return WsMsg{Type: websocket.TextMessage, Msg: []byte(s)}
+}
+
+// currentLayer returns the protocol layer of the current connection.
+func (s *State) currentLayer() protocolLayer {
+	s.layerLock.Lock()
+	defer s.layerLock.Unlock()
+	return s.layer
+}
+
+func (s *State) setLayer(layer protocolLayer) {
+	s.layerLock.Lock()
+	defer s.layerLock.Unlock()
+	s.layer = layer
+}
+
+// SetProtocol sets the protocol spoken over the next connections.
+func (s *State) SetProtocol(name string) error {
+	if name != "" {
+		if _, ok := protocolLayers[name]; !ok {
+			return fmt.Errorf("unknown protocol %q; available protocols: %s", name, strings.Join(protocolLayerNames(), ", "))
+		}
+	}
+	return s.setOption(func(o *ConnectionOptions) {
+		o.Protocol = name
+	}, "Protocol")
+}
+
+// writeFrames sends frames, generated by a protocol layer.
+func (s *State) writeFrames(frames []WsMsg) {
+	for _, f := range frames {
+		s.wsConn.Write(f)
+	}
+}
+
+// startHeartbeat sends frame every d, until the connection is closed or the
+// protocol layer changes.
+func (s *State) startHeartbeat(layer protocolLayer, d time.Duration, frame WsMsg) {
+	go func() {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for range ticker.C {
+			if s.currentLayer() != layer || !s.wsConn.Write(frame) {
+				return
+			}
+		}
+	}()
+}
+
+// layerStatus returns the status of the protocol layer, if it has one.
+func (s *State) layerStatus() string {
+	if ls, ok := s.currentLayer().(layerStatus); ok {
+		return ls.Status()
+	}
+	return ""
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// proxyFunc returns the function used to choose the proxy for the connection
+// to a WebSocket. If proxy is empty, the proxy is taken from the environment
+// variables (HTTP_PROXY, HTTPS_PROXY and NO_PROXY); if it is "none", no proxy
+// is used. Otherwise, proxy is the URL of an http, https or socks5 proxy, which
+// is used for all hosts except those in NO_PROXY.
+func proxyFunc(proxy string) (func(*http.Request) (*url.URL, error), error) {
+	switch proxy {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case "none":
+		return nil, nil
+	}
+
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Scheme == "socks5h" {
+		// the socks5 dialer always lets the proxy resolve host names
+		u.Scheme = "socks5"
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("invalid proxy URL %q: scheme must be http, https or socks5", proxy)
+	}
+
+	noProxy := getEnvAny("NO_PROXY", "no_proxy")
+	return func(req *http.Request) (*url.URL, error) {
+		if matchNoProxy(noProxy, req.URL.Hostname()) {
+			return nil, nil
+		}
+		return u, nil
+	}, nil
+}
+
+func getEnvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// matchNoProxy reports whether host matches one of the comma-separated
+// entries of noProxy, which can be "*", IP addresses, CIDR ranges or domain
+// names, which also match their subdomains.
+func matchNoProxy(noProxy, host string) bool {
+	ip := net.ParseIP(host)
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if h, _, err := net.SplitHostPort(entry); err == nil {
+			entry = h
+		}
+		switch {
+		case entry == "":
+		case entry == "*":
+			return true
+		case ip != nil:
+			if _, ipNet, err := net.ParseCIDR(entry); err == nil && ipNet.Contains(ip) {
+				return true
+			}
+			if ip.Equal(net.ParseIP(entry)) {
+				return true
+			}
+		default:
+			entry = strings.TrimPrefix(entry, ".")
+			host := strings.ToLower(host)
+			if host == entry || strings.HasSuffix(host, "."+entry) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// dialerProxy wraps fnProxy to report the proxy in use using fnDebug, and to
+// handle https proxies, whose address is stored in httpsProxyAddr.
+func dialerProxy(
+	fnProxy func(*http.Request) (*url.URL, error),
+	fnDebug func(string),
+	httpsProxyAddr *string,
+) func(*http.Request) (*url.URL, error) {
+	return func(req *http.Request) (*url.URL, error) {
+		u, err := fnProxy(req)
+		if err != nil || u == nil {
+			return u, err
+		}
+		fnDebug("Using proxy " + u.Redacted())
+		if u.Scheme == "https" {
+			u, *httpsProxyAddr = httpsProxy(u)
+		}
+		return u, nil
+	}
+}
+
+// httpsProxy returns the URL to be used by the dialer for an https proxy,
+// which is handled as an http proxy to which the connection is made over TLS
+// (see dialHTTPSProxy), together with the address of the proxy.
+func httpsProxy(u *url.URL) (*url.URL, string) {
+	u2 := *u
+	u2.Scheme = "http"
+	if u2.Port() == "" {
+		u2.Host = net.JoinHostPort(u2.Hostname(), "443")
+	}
+	return &u2, u2.Host
+}
+
+// dialHTTPSProxy starts a TLS session with the https proxy on conn.
+func dialHTTPSProxy(conn net.Conn, addr string) (net.Conn, error) {
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy: %w", err)
+	}
+	return tlsConn, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reloadInterval is how often the configuration files are checked for
+// changes.
+const reloadInterval = time.Second
+
+// reloadQuietFields are the settings which are reloaded without reporting
+// them, because they are changed by claws itself (also by other instances)
+// rather than by the user.
+var reloadQuietFields = map[string]bool{
+	"Info":             true,
+	"Version":          true,
+	"LastWebsocketURL": true,
+	"History":          true,
+}
+
+// Reload reads the configuration files again, and applies the settings which
+// changed in them since they were last loaded. The settings which were
+// changed in the meantime by other means, such as flags, are kept if they
+// did not change in the files. It returns a description of the changes.
+func (s *Settings) Reload() (changes []string, err error) {
+	oSet, local, _, err := readConfigFiles(s.file, s.localFile)
+	if err != nil {
+		return nil, err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	cur := reflect.ValueOf(&s.SettingsBase).Elem()
+	prev := reflect.ValueOf(&s.loaded).Elem()
+	next := reflect.ValueOf(&oSet).Elem()
+	for _, field := range reloadFields() {
+		n := next.FieldByName(field)
+		if reflect.DeepEqual(prev.FieldByName(field).Interface(), n.Interface()) {
+			continue
+		}
+		c := cur.FieldByName(field)
+		if !reloadQuietFields[field] {
+			describeChange(field, c.Interface(), n.Interface(), &changes)
+		}
+		c.Set(n)
+	}
+
+	// the values which were set are shared with oSet
+	s.SettingsBase = s.SettingsBase.Clone()
+	s.loaded = oSet
+	if !reflect.DeepEqual(s.local.profiles, local.profiles) {
+		describeChange("Profiles ("+localConfigName+")", s.local.profiles, local.profiles, &changes)
+	}
+	if !reflect.DeepEqual(s.local.templates, local.templates) {
+		describeChange("Templates ("+localConfigName+")", s.local.templates, local.templates, &changes)
+	}
+	s.local = local
+	return changes, nil
+}
+
+// reloadFields returns the names of the settings, sorted.
+func reloadFields() []string {
+	fields := configFields(reflect.TypeOf(SettingsBase{}))
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describeChange adds to changes descriptions of the differences between old
+// and new, such as `PingSeconds: 5 -> 10`. Structs and maps are compared
+// key by key.
+func describeChange(path string, old, new interface{}, changes *[]string) {
+	var oldV, newV interface{}
+	fnDecode := func(v interface{}, dst *interface{}) {
+		data, _ := json.Marshal(v)
+		json.Unmarshal(data, dst)
+	}
+	fnDecode(old, &oldV)
+	fnDecode(new, &newV)
+	diffJSON(path, oldV, newV, changes)
+}
+
+func diffJSON(path string, old, new interface{}, changes *[]string) {
+	if reflect.DeepEqual(old, new) {
+		return
+	}
+
+	oldM, okOld := old.(map[string]interface{})
+	newM, okNew := new.(map[string]interface{})
+	if !okOld || !okNew {
+		*changes = append(*changes, fmt.Sprintf("%s: %s -> %s", path, compactJSON(old), compactJSON(new)))
+		return
+	}
+
+	keys := make([]string, 0, len(oldM)+len(newM))
+	for k := range oldM {
+		keys = append(keys, k)
+	}
+	for k := range newM {
+		if _, ok := oldM[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		o, okO := oldM[k]
+		n, okN := newM[k]
+		switch {
+		case !okO:
+			*changes = append(*changes, path+"."+k+" added")
+		case !okN:
+			*changes = append(*changes, path+"."+k+" removed")
+		default:
+			diffJSON(path+"."+k, o, n, changes)
+		}
+	}
+}
+
+func compactJSON(v interface{}) string {
+	buf := new(bytes.Buffer)
+	e := json.NewEncoder(buf)
+	e.SetEscapeHTML(false)
+	e.Encode(v)
+	s := strings.TrimSuffix(buf.String(), "\n")
+	if len(s) > 60 {
+		s = s[:57] + "..."
+	}
+	return s
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime int64
+	size    int64
+}
+
+func statFile(file string) fileStamp {
+	if file == "" {
+		return fileStamp{}
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{fi.ModTime().UnixNano(), fi.Size()}
+}
+
+// WatchSettings reloads the settings whenever the configuration files change,
+// applying the new ping interval to the connection and printing what
+// changed. It never returns.
+func (s *State) WatchSettings() {
+	file, local := s.Settings.ConfigFiles()
+	fnStat := func() [2]fileStamp {
+		return [2]fileStamp{statFile(file), statFile(local)}
+	}
+
+	last := fnStat()
+	for range time.Tick(reloadInterval) {
+		cur := fnStat()
+		if cur == last {
+			continue
+		}
+		last = cur
+
+		ping := s.connSettings().PingSeconds
+		changes, err := s.Settings.Reload()
+		if err != nil {
+			s.PrintError(fmt.Errorf("reloading settings: %w", err))
+			continue
+		}
+		if len(changes) == 0 {
+			continue
+		}
+		s.PrintDebug("Settings reloaded: " + strings.Join(changes, ", "))
+		if newPing := s.connSettings().PingSeconds; newPing != ping {
+			s.wsConn.SetPingInterval(newPing)
+		}
+	}
+}
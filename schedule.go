@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Schedule is a message which is sent repeatedly over a connection.
+type Schedule struct {
+	ID      int
+	Message string
+	// time between two messages, and maximum random variation of each
+	// interval
+	Interval time.Duration
+	Jitter   time.Duration
+	// number of messages to send, 0 if unlimited, and number of messages sent
+	Count int
+	Sent  int
+
+	// sends the message; if it returns an error, the schedule is cancelled
+	send func(Schedule) error
+	// time the next message is due, without and with the jitter
+	nominal time.Time
+	next    time.Time
+}
+
+func (s Schedule) String() string {
+	str := fmt.Sprintf("#%d every %v", s.ID, s.Interval)
+	if s.Jitter > 0 {
+		str += fmt.Sprintf(" (±%v)", s.Jitter)
+	}
+	if s.Count > 0 {
+		str += fmt.Sprintf(", %d/%d sent", s.Sent, s.Count)
+	} else {
+		str += fmt.Sprintf(", %d sent", s.Sent)
+	}
+	return str + ": " + s.Message
+}
+
+// scheduler keeps the schedules of a connection. The write pump waits for
+// them to be due, alongside the ping ticker, and passes them to a worker
+// goroutine which sends the messages, so that preparing them (which may
+// involve pipes and encoders) doesn't block the connection.
+type scheduler struct {
+	mu        sync.Mutex
+	schedules []*Schedule
+	lastID    int
+	rnd       *rand.Rand
+
+	// notifies the write pump that the schedules changed
+	chChanged chan struct{}
+	chDue     chan Schedule
+}
+
+func newScheduler() *scheduler {
+	sc := &scheduler{
+		rnd:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		chChanged: make(chan struct{}, 1),
+		chDue:     make(chan Schedule, 16),
+	}
+	go sc.work()
+	return sc
+}
+
+// work sends the messages which are due, until stop is called.
+func (sc *scheduler) work() {
+	for s := range sc.chDue {
+		if err := s.send(s); err != nil {
+			sc.cancel(s.ID)
+		}
+	}
+}
+
+// stop stops the worker. It must be called by the write pump, when exiting.
+func (sc *scheduler) stop() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.schedules = nil
+	close(sc.chDue)
+}
+
+func (sc *scheduler) notify() {
+	select {
+	case sc.chChanged <- struct{}{}:
+	default:
+	}
+}
+
+// add adds a schedule, whose first message is sent after one interval, and
+// returns its ID.
+func (sc *scheduler) add(s Schedule) int {
+	sc.mu.Lock()
+	sc.lastID++
+	s.ID = sc.lastID
+	s.Sent = 0
+	s.nominal = time.Now().Add(s.Interval)
+	s.next = s.nominal.Add(sc.jitter(s.Jitter))
+	sc.schedules = append(sc.schedules, &s)
+	sc.mu.Unlock()
+
+	sc.notify()
+	return s.ID
+}
+
+// cancel removes the schedule with the given ID, reporting whether it existed.
+func (sc *scheduler) cancel(id int) bool {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for i, s := range sc.schedules {
+		if s.ID == id {
+			sc.schedules = append(sc.schedules[:i], sc.schedules[i+1:]...)
+			sc.notify()
+			return true
+		}
+	}
+	return false
+}
+
+// cancelAll removes all the schedules, returning how many there were.
+func (sc *scheduler) cancelAll() int {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	n := len(sc.schedules)
+	sc.schedules = nil
+	sc.notify()
+	return n
+}
+
+func (sc *scheduler) list() []Schedule {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	res := make([]Schedule, len(sc.schedules))
+	for i, s := range sc.schedules {
+		res[i] = *s
+	}
+	return res
+}
+
+// nextDue returns when the next message is due.
+func (sc *scheduler) nextDue() (next time.Time, ok bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	for _, s := range sc.schedules {
+		if !ok || s.next.Before(next) {
+			next, ok = s.next, true
+		}
+	}
+	return
+}
+
+// fire passes the schedules which are due to the worker, and removes those
+// which are complete. If the worker is busy, the message is skipped.
+func (sc *scheduler) fire(now time.Time) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	keep := sc.schedules[:0]
+	for _, s := range sc.schedules {
+		if now.Before(s.next) {
+			keep = append(keep, s)
+			continue
+		}
+
+		s.Sent++
+		select {
+		case sc.chDue <- *s:
+		default:
+			// the worker is busy
+			s.Sent--
+		}
+		if s.Count > 0 && s.Sent >= s.Count {
+			continue
+		}
+
+		// the interval is kept constant, unless the messages are late by
+		// more than an interval, so that they are not sent in bursts.
+		s.nominal = s.nominal.Add(s.Interval)
+		if s.nominal.Before(now) {
+			s.nominal = now
+		}
+		s.next = s.nominal.Add(sc.jitter(s.Jitter))
+		keep = append(keep, s)
+	}
+	sc.schedules = keep
+}
+
+// jitter returns a random duration between -max and max.
+func (sc *scheduler) jitter(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(sc.rnd.Int63n(int64(2*max)+1)) - max
+}
+
+// parseSchedule parses a schedule in the form
+//
+//	INTERVAL [xCOUNT] [~JITTER] MESSAGE
+//
+// INTERVAL is a duration (5s, 250ms), a number of seconds, or a rate (10/s,
+// 100/m). COUNT is the number of messages to send, and JITTER is the maximum
+// random variation of each interval.
+func parseSchedule(spec string) (Schedule, error) {
+	var s Schedule
+	next := func() string {
+		spec = strings.TrimLeft(spec, " \t")
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			i = len(spec)
+		}
+		tok := spec[:i]
+		spec = spec[i:]
+		return tok
+	}
+
+	tok := next()
+	if tok == "" {
+		return s, errors.New("the interval is missing")
+	}
+	var err error
+	if s.Interval, err = parseInterval(tok); err != nil {
+		return s, err
+	}
+
+	for {
+		rest := spec
+		tok := next()
+		switch {
+		case len(tok) > 1 && tok[0] == 'x':
+			if s.Count, err = strconv.Atoi(tok[1:]); err != nil || s.Count <= 0 {
+				return s, fmt.Errorf("invalid count %q", tok)
+			}
+			continue
+		case len(tok) > 1 && tok[0] == '~':
+			if s.Jitter, err = time.ParseDuration(tok[1:]); err != nil || s.Jitter < 0 {
+				return s, fmt.Errorf("invalid jitter %q", tok)
+			}
+			if s.Jitter > s.Interval {
+				return s, errors.New("the jitter must not be greater than the interval")
+			}
+			continue
+		}
+		s.Message = strings.TrimLeft(rest, " \t")
+		break
+	}
+	if strings.TrimSpace(s.Message) == "" {
+		return s, errors.New("the message is missing")
+	}
+	return s, nil
+}
+
+func parseInterval(tok string) (time.Duration, error) {
+	var d time.Duration
+	if n, unit, ok := strings.Cut(tok, "/"); ok {
+		units := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour}
+		rate, err := strconv.ParseFloat(n, 64)
+		if err != nil || rate <= 0 || units[unit] == 0 {
+			return 0, fmt.Errorf("invalid rate %q", tok)
+		}
+		d = time.Duration(float64(units[unit]) / rate)
+	} else if secs, err := strconv.ParseFloat(tok, 64); err == nil {
+		d = time.Duration(secs * float64(time.Second))
+	} else if d, err = time.ParseDuration(tok); err != nil {
+		return 0, fmt.Errorf("invalid interval %q", tok)
+	}
+
+	if d < time.Millisecond {
+		return 0, fmt.Errorf("the interval %v is too short", d)
+	}
+	return d, nil
+}
+
+// AddSchedule registers a message to be sent repeatedly over the current
+// connection, as described by spec (see parseSchedule). The message can
+// contain placeholders, which are replaced each time it is sent, or be a
+// template in the form @NAME; prompts are not allowed.
+func (s *State) AddSchedule(spec string) (Schedule, error) {
+	sched, err := parseSchedule(spec)
+	if err != nil {
+		return sched, err
+	}
+	if len(templatePrompts(s.resolveTemplate(sched.Message))) > 0 {
+		return sched, errors.New("scheduled messages can't contain prompts")
+	}
+
+	msg := sched.Message
+	sched.send = func(sc Schedule) error {
+		text, err := s.expandMessage(s.resolveTemplate(msg), nil)
+		if err != nil {
+			s.PrintError(fmt.Errorf("schedule #%d cancelled: %w", sc.ID, err))
+			return err
+		}
+		s.SendMessage(text)
+		if sc.Count > 0 && sc.Sent == sc.Count {
+			s.PrintDebug(fmt.Sprintf("Schedule #%d completed.", sc.ID))
+		}
+		return nil
+	}
+
+	sched.ID, err = s.wsConn.AddSchedule(sched)
+	return sched, err
+}
+
+// PrintSchedules prints the active schedules of the current connection.
+func (s *State) PrintSchedules() {
+	schedules := s.wsConn.Schedules()
+	if len(schedules) == 0 {
+		s.PrintDebug("No active schedules.")
+		return
+	}
+	for _, sc := range schedules {
+		s.PrintDebug(sc.String())
+	}
+}
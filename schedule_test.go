@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		spec     string
+		interval time.Duration
+		count    int
+		jitter   time.Duration
+		message  string
+		// the start of the error, if any
+		err string
+	}{
+		{spec: "5s ping", interval: 5 * time.Second, message: "ping"},
+		{spec: "250ms {\"op\": \"ping\"}", interval: 250 * time.Millisecond, message: `{"op": "ping"}`},
+		{spec: "1.5 hello  world", interval: 1500 * time.Millisecond, message: "hello  world"},
+		{spec: "10/s tick", interval: 100 * time.Millisecond, message: "tick"},
+		{spec: "2/m tick", interval: 30 * time.Second, message: "tick"},
+		{spec: "1s x3 ~200ms msg", interval: time.Second, count: 3, jitter: 200 * time.Millisecond, message: "msg"},
+		{spec: "  1s\t~1s x10 @ping", interval: time.Second, count: 10, jitter: time.Second, message: "@ping"},
+		{spec: "1s x msg", interval: time.Second, message: "x msg"},
+		{spec: "1s ~ msg", interval: time.Second, message: "~ msg"},
+		{spec: "", err: "the interval is missing"},
+		{spec: "soon ping", err: `invalid interval "soon"`},
+		{spec: "0/s ping", err: `invalid rate "0/s"`},
+		{spec: "10/d ping", err: `invalid rate "10/d"`},
+		{spec: "1us ping", err: "the interval 1µs is too short"},
+		{spec: "1s x0 ping", err: `invalid count "x0"`},
+		{spec: "1s xy ping", err: `invalid count "xy"`},
+		{spec: "1s ~-1s ping", err: `invalid jitter "~-1s"`},
+		{spec: "1s ~2s ping", err: "the jitter must not be greater than the interval"},
+		{spec: "1s", err: "the message is missing"},
+		{spec: "1s x2 ~1ms  ", err: "the message is missing"},
+	}
+	for _, tt := range tests {
+		s, err := parseSchedule(tt.spec)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		if s.Interval != tt.interval || s.Count != tt.count || s.Jitter != tt.jitter || s.Message != tt.message {
+			t.Errorf("%q: got every %v x%d ~%v %q, want every %v x%d ~%v %q", tt.spec,
+				s.Interval, s.Count, s.Jitter, s.Message, tt.interval, tt.count, tt.jitter, tt.message)
+		}
+	}
+}
+
+func TestScheduleString(t *testing.T) {
+	tests := []struct {
+		s    Schedule
+		want string
+	}{
+		{Schedule{ID: 1, Message: "ping", Interval: time.Second, Sent: 4}, "#1 every 1s, 4 sent: ping"},
+		{Schedule{ID: 2, Message: "x", Interval: time.Minute, Jitter: time.Second, Count: 3, Sent: 1}, "#2 every 1m0s (±1s), 1/3 sent: x"},
+	}
+	for _, tt := range tests {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("got %q, want %q", got, tt.want)
+		}
+	}
+}
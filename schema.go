@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Matching of the JSON messages received by claws test. The values are
+// decoded by encoding/json into interface{}, so numbers are float64.
+
+// describePath describes the position of a value in a message, for errors.
+func describePath(path []interface{}) string {
+	if len(path) == 0 {
+		return "the message"
+	}
+	return formatConfigPath(path)
+}
+
+// jsonSubset checks that actual contains expected: objects must contain the
+// keys of the expected objects, with matching values, while arrays must have
+// the same length and matching elements.
+func jsonSubset(path []interface{}, expected, actual interface{}) error {
+	switch exp := expected.(type) {
+	case map[string]interface{}:
+		act, ok := actual.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object, got %s", describePath(path), describeValue(actual))
+		}
+		for _, key := range sortedValueKeys(exp) {
+			val, ok := act[key]
+			if !ok {
+				return fmt.Errorf("%s: missing", describePath(appendPath(path, key)))
+			}
+			if err := jsonSubset(appendPath(path, key), exp[key], val); err != nil {
+				return err
+			}
+		}
+		return nil
+	case []interface{}:
+		act, ok := actual.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array, got %s", describePath(path), describeValue(actual))
+		}
+		if len(act) != len(exp) {
+			return fmt.Errorf("%s: expected %d elements, got %d", describePath(path), len(exp), len(act))
+		}
+		for i := range exp {
+			if err := jsonSubset(appendPath(path, i), exp[i], act[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if !reflect.DeepEqual(expected, actual) {
+		return fmt.Errorf("%s: expected %s, got %s", describePath(path), describeValue(expected), describeValue(actual))
+	}
+	return nil
+}
+
+// validateSchema validates v against a JSON Schema. Only the most common
+// keywords are supported: type, enum, const, properties, required,
+// additionalProperties, items, minItems, maxItems, minimum, maximum,
+// exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern, allOf,
+// anyOf, oneOf and not.
+func validateSchema(path []interface{}, schema, v interface{}) error {
+	s, ok := schema.(map[string]interface{})
+	if !ok {
+		// true and false accept and reject all values
+		if b, ok := schema.(bool); ok && !b {
+			return fmt.Errorf("%s: not allowed", describePath(path))
+		}
+		return nil
+	}
+	fnErr := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%s: %s", describePath(path), fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := s["type"]; ok {
+		var types []string
+		switch t := t.(type) {
+		case string:
+			types = []string{t}
+		case []interface{}:
+			for _, el := range t {
+				if name, ok := el.(string); ok {
+					types = append(types, name)
+				}
+			}
+		}
+		match := false
+		for _, name := range types {
+			if schemaType(v, name) {
+				match = true
+			}
+		}
+		if !match {
+			return fnErr("expected %s, got %s", strings.Join(types, " or "), describeValue(v))
+		}
+	}
+	if enum, ok := s["enum"].([]interface{}); ok {
+		match := false
+		for _, el := range enum {
+			if reflect.DeepEqual(el, v) {
+				match = true
+			}
+		}
+		if !match {
+			return fnErr("%s is not one of the allowed values", describeValue(v))
+		}
+	}
+	if c, ok := s["const"]; ok && !reflect.DeepEqual(c, v) {
+		return fnErr("expected %s, got %s", describeValue(c), describeValue(v))
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if err := validateObject(path, s, v); err != nil {
+			return err
+		}
+	case []interface{}:
+		if n, ok := s["minItems"].(float64); ok && float64(len(v)) < n {
+			return fnErr("expected at least %v elements, got %d", n, len(v))
+		}
+		if n, ok := s["maxItems"].(float64); ok && float64(len(v)) > n {
+			return fnErr("expected at most %v elements, got %d", n, len(v))
+		}
+		if items, ok := s["items"]; ok {
+			for i, el := range v {
+				if err := validateSchema(appendPath(path, i), items, el); err != nil {
+					return err
+				}
+			}
+		}
+	case float64:
+		if n, ok := s["minimum"].(float64); ok && v < n {
+			return fnErr("%v is lower than %v", v, n)
+		}
+		if n, ok := s["maximum"].(float64); ok && v > n {
+			return fnErr("%v is greater than %v", v, n)
+		}
+		if n, ok := s["exclusiveMinimum"].(float64); ok && v <= n {
+			return fnErr("%v is not greater than %v", v, n)
+		}
+		if n, ok := s["exclusiveMaximum"].(float64); ok && v >= n {
+			return fnErr("%v is not lower than %v", v, n)
+		}
+	case string:
+		length := float64(utf8.RuneCountInString(v))
+		if n, ok := s["minLength"].(float64); ok && length < n {
+			return fnErr("expected at least %v characters, got %v", n, length)
+		}
+		if n, ok := s["maxLength"].(float64); ok && length > n {
+			return fnErr("expected at most %v characters, got %v", n, length)
+		}
+		if p, ok := s["pattern"].(string); ok {
+			re, err := regexp.Compile(p)
+			if err != nil {
+				return fnErr("invalid pattern: %v", err)
+			}
+			if !re.MatchString(v) {
+				return fnErr("%q does not match %q", v, p)
+			}
+		}
+	}
+
+	if all, ok := s["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			if err := validateSchema(path, sub, v); err != nil {
+				return err
+			}
+		}
+	}
+	if anyOf, ok := s["anyOf"].([]interface{}); ok {
+		var firstErr error
+		for _, sub := range anyOf {
+			if firstErr = validateSchema(path, sub, v); firstErr == nil {
+				break
+			}
+		}
+		if firstErr != nil {
+			return fnErr("does not match any of the schemas of anyOf")
+		}
+	}
+	if oneOf, ok := s["oneOf"].([]interface{}); ok {
+		n := 0
+		for _, sub := range oneOf {
+			if validateSchema(path, sub, v) == nil {
+				n++
+			}
+		}
+		if n != 1 {
+			return fnErr("matches %d of the schemas of oneOf, instead of one", n)
+		}
+	}
+	if not, ok := s["not"]; ok && validateSchema(path, not, v) == nil {
+		return fnErr("matches the schema of not")
+	}
+	return nil
+}
+
+func validateObject(path []interface{}, s map[string]interface{}, v map[string]interface{}) error {
+	if required, ok := s["required"].([]interface{}); ok {
+		for _, key := range required {
+			if key, ok := key.(string); ok {
+				if _, ok := v[key]; !ok {
+					return fmt.Errorf("%s: missing", describePath(appendPath(path, key)))
+				}
+			}
+		}
+	}
+
+	props, _ := s["properties"].(map[string]interface{})
+	for _, key := range sortedValueKeys(v) {
+		sub, ok := props[key]
+		if !ok {
+			additional, ok := s["additionalProperties"]
+			if !ok {
+				continue
+			}
+			sub = additional
+		}
+		if err := validateSchema(appendPath(path, key), sub, v[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// schemaType reports whether v has the JSON Schema type name.
+func schemaType(v interface{}, name string) bool {
+	switch v := v.(type) {
+	case nil:
+		return name == "null"
+	case bool:
+		return name == "boolean"
+	case float64:
+		return name == "number" || name == "integer" && v == math.Trunc(v)
+	case string:
+		return name == "string"
+	case []interface{}:
+		return name == "array"
+	case map[string]interface{}:
+		return name == "object"
+	}
+	return false
+}
+
+// describeValue describes the type and value of a decoded JSON value, for
+// errors.
+func describeValue(v interface{}) string {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return describeJSON(raw)
+}
+
+func sortedValueKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
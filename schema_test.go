@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeTestJSON(t *testing.T, s string) interface{} {
+	t.Helper()
+	var v interface{}
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	return v
+}
+
+func TestJSONSubset(t *testing.T) {
+	tests := []struct {
+		expected, actual string
+		// the error, empty if actual matches
+		err string
+	}{
+		{`{}`, `{"a": 1}`, ""},
+		{`{"a": 1}`, `{"a": 1, "b": 2}`, ""},
+		{`{"a": {"b": "x"}}`, `{"a": {"b": "x", "c": null}}`, ""},
+		{`[1, {"a": true}]`, `[1, {"a": true, "b": false}]`, ""},
+		{`"x"`, `"x"`, ""},
+		{`null`, `null`, ""},
+		{`1`, `1.0`, ""},
+		{`{"a": 1}`, `{"b": 1}`, "a: missing"},
+		{`{"a": 1}`, `{"a": "1"}`, `a: expected number 1, got string "1"`},
+		{`{"a": {"b": 1}}`, `{"a": []}`, "a: expected an object, got array"},
+		{`{"a": [1]}`, `{"a": [1, 2]}`, "a: expected 1 elements, got 2"},
+		{`[{"a": 1}]`, `[{"a": 2}]`, "[0].a: expected number 1, got number 2"},
+		{`[]`, `{}`, "the message: expected an array, got object"},
+		{`null`, `false`, "the message: expected null, got boolean false"},
+	}
+	for _, tt := range tests {
+		err := jsonSubset(nil, decodeTestJSON(t, tt.expected), decodeTestJSON(t, tt.actual))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("%s in %s: got error %v, want %q", tt.expected, tt.actual, err, tt.err)
+		}
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+	const object = `{
+		"type": "object",
+		"required": ["id", "tags"],
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"name": {"type": "string", "minLength": 2, "maxLength": 4, "pattern": "^[a-z]+$"},
+			"tags": {"type": "array", "items": {"enum": ["a", "b"]}, "minItems": 1, "maxItems": 2},
+			"kind": {"const": "user"}
+		},
+		"additionalProperties": false
+	}`
+	tests := []struct {
+		schema, v string
+		// the start of the error, empty if v is valid
+		err string
+	}{
+		{`true`, `1`, ""},
+		{`{}`, `{"a": 1}`, ""},
+		{`false`, `1`, "the message: not allowed"},
+		{`{"type": ["string", "null"]}`, `null`, ""},
+		{`{"type": "integer"}`, `1.5`, "the message: expected integer, got number 1.5"},
+		{`{"type": "number", "exclusiveMinimum": 0, "exclusiveMaximum": 1}`, `0.5`, ""},
+		{`{"type": "number", "exclusiveMaximum": 1}`, `1`, "the message: 1 is not lower than 1"},
+		{object, `{"id": 1, "tags": ["a"]}`, ""},
+		{object, `{"id": 2, "name": "abc", "tags": ["a", "b"], "kind": "user"}`, ""},
+		{object, `{"tags": ["a"]}`, "id: missing"},
+		{object, `{"id": 0, "tags": ["a"]}`, "id: 0 is lower than 1"},
+		{object, `{"id": 1.5, "tags": ["a"]}`, "id: expected integer"},
+		{object, `{"id": 1, "tags": []}`, "tags: expected at least 1 elements"},
+		{object, `{"id": 1, "tags": ["a", "b", "a"]}`, "tags: expected at most 2 elements"},
+		{object, `{"id": 1, "tags": ["c"]}`, `tags[0]: string "c" is not one of the allowed values`},
+		{object, `{"id": 1, "tags": ["a"], "name": "x"}`, "name: expected at least 2 characters"},
+		{object, `{"id": 1, "tags": ["a"], "name": "abcde"}`, "name: expected at most 4 characters"},
+		{object, `{"id": 1, "tags": ["a"], "name": "AB"}`, `name: "AB" does not match`},
+		{object, `{"id": 1, "tags": ["a"], "kind": "admin"}`, `kind: expected string "user"`},
+		{object, `{"id": 1, "tags": ["a"], "extra": 1}`, "extra: not allowed"},
+		{object, `[]`, "the message: expected object, got array"},
+		{`{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `3`, ""},
+		{`{"anyOf": [{"type": "string"}, {"type": "integer"}]}`, `true`, "the message: does not match any of the schemas of anyOf"},
+		{`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `1.5`, ""},
+		{`{"oneOf": [{"type": "number"}, {"type": "integer"}]}`, `1`, "the message: matches 2 of the schemas of oneOf"},
+		{`{"allOf": [{"minimum": 1}, {"maximum": 2}]}`, `3`, "the message: 3 is greater than 2"},
+		{`{"not": {"type": "null"}}`, `null`, "the message: matches the schema of not"},
+		{`{"pattern": "("}`, `"x"`, "the message: invalid pattern"},
+	}
+	for _, tt := range tests {
+		err := validateSchema(nil, decodeTestJSON(t, tt.schema), decodeTestJSON(t, tt.v))
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.HasPrefix(err.Error(), tt.err)) {
+			t.Errorf("%s against %s: got error %v, want %q", tt.v, compactSpace(tt.schema), err, tt.err)
+		}
+	}
+}
+
+func TestParseValuePath(t *testing.T) {
+	tests := []struct {
+		s       string
+		path    []interface{}
+		wantErr bool
+	}{
+		{".", nil, false},
+		{".a", []interface{}{"a"}, false},
+		{".a.b", []interface{}{"a", "b"}, false},
+		{".data.items[0].id", []interface{}{"data", "items", 0, "id"}, false},
+		{"[2][10]", []interface{}{2, 10}, false},
+		{"a", nil, true},
+		{".a..b", nil, true},
+		{".a[", nil, true},
+		{".a[x]", nil, true},
+		{".a[-1]", nil, true},
+	}
+	for _, tt := range tests {
+		path, err := parseValuePath(tt.s)
+		if (err != nil) != tt.wantErr || !reflect.DeepEqual(path, tt.path) {
+			t.Errorf("%q: got %v and error %v", tt.s, path, err)
+		}
+	}
+}
+
+func TestLookupValue(t *testing.T) {
+	v := decodeTestJSON(t, `{"data": {"items": [{"id": 7}]}}`)
+	tests := []struct {
+		path string
+		want string
+		err  string
+	}{
+		{".", `{"data":{"items":[{"id":7}]}}`, ""},
+		{".data.items[0].id", `7`, ""},
+		{".data.items[1]", "", "data.items[1] does not exist"},
+		{".data.missing", "", "data.missing does not exist"},
+		{".data.items.id", "", "data.items is not an object"},
+		{".data[0]", "", "data is not an array"},
+	}
+	for _, tt := range tests {
+		path, err := parseValuePath(tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := lookupValue(v, path)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%s: got error %v, want %q", tt.path, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.path, err)
+			continue
+		}
+		if b, _ := json.Marshal(got); string(b) != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.path, b, tt.want)
+		}
+	}
+}
@@ -4,50 +4,66 @@ import (
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"os/user"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"sync"
 )
 
+// getConfigFolder returns $XDG_CONFIG_HOME, or ~/.config/ if it is not set
+// (also on Windows).
 func getConfigFolder() (string, error) {
-	u, err := user.Current()
+	if folder := os.Getenv("XDG_CONFIG_HOME"); filepath.IsAbs(folder) {
+		return folder, nil
+	}
+
+	home, err := os.UserHomeDir()
 	if err != nil {
 		return "", err
 	}
-	folder := u.HomeDir + "/.config/"
-
-	err = os.MkdirAll(folder, 0755)
-
-	return folder, err
+	return filepath.Join(home, ".config"), nil
 }
 
 type SettingsBase struct {
 	Info             string
+	Version          int
 	JSONFormatting   bool
 	Timestamp        string
 	LastWebsocketURL string
-	LastActions      []string
-	PingSeconds      int
-	Pipe             struct {
-		In  []string
-		Out []string
-	}
+	// sent messages and commands, by URL (see State.historyKey)
+	History               map[string][]string
+	HistorySize           int
+	HistoryKeepDuplicates bool
+	ConnectionOptions
+	Profiles  map[string]Profile
+	Templates map[string]string
 }
 
 func (s *SettingsBase) Clone() SettingsBase {
 	ret := *s
 
-	fnCopy := func(dst *[]string, src []string) {
-		if src == nil {
-			return
+	if s.History != nil {
+		ret.History = make(map[string][]string, len(s.History))
+		for key, actions := range s.History {
+			ret.History[key] = cloneStrings(actions)
+		}
+	}
+	ret.ConnectionOptions = s.ConnectionOptions.Clone()
+	if s.Profiles != nil {
+		ret.Profiles = make(map[string]Profile, len(s.Profiles))
+		for name, p := range s.Profiles {
+			p.ConnectionOptions = p.ConnectionOptions.Clone()
+			ret.Profiles[name] = p
+		}
+	}
+	if s.Templates != nil {
+		ret.Templates = make(map[string]string, len(s.Templates))
+		for name, text := range s.Templates {
+			ret.Templates[name] = text
 		}
-		*dst = make([]string, len(src))
-		copy(*dst, src)
 	}
-	fnCopy(&ret.LastActions, s.LastActions)
-	fnCopy(&ret.Pipe.In, s.Pipe.In)
-	fnCopy(&ret.Pipe.Out, s.Pipe.Out)
 
 	return ret
 }
@@ -56,83 +72,572 @@ func (s *SettingsBase) Clone() SettingsBase {
 type Settings struct {
 	SettingsBase
 	sync.RWMutex `json:"-"`
+
+	// path of claws.json
+	file string
+	// path of the project-local configuration file, if any, and what was
+	// read from it
+	localFile string
+	local     localConfig
+	// settings read from the files when they were last loaded, used to find
+	// the changed settings when reloading them
+	loaded SettingsBase
+	// problems found in the configuration files which don't prevent them
+	// from being used
+	warnings []string
 }
 
-// for goroutine-safe read access to settings
+// for goroutine-safe read access to settings. The profiles and templates of
+// the project-local configuration file are added to those of claws.json,
+// which take precedence.
 func (s *Settings) Clone() SettingsBase {
 	s.RLock()
 	defer s.RUnlock()
-	return s.SettingsBase.Clone()
+	ret := s.SettingsBase.Clone()
+	for name, p := range s.local.profiles {
+		if _, ok := ret.Profiles[name]; ok {
+			continue
+		}
+		if ret.Profiles == nil {
+			ret.Profiles = make(map[string]Profile)
+		}
+		p.ConnectionOptions = p.ConnectionOptions.Clone()
+		ret.Profiles[name] = p
+	}
+	for name, text := range s.local.templates {
+		if _, ok := ret.Templates[name]; ok {
+			continue
+		}
+		if ret.Templates == nil {
+			ret.Templates = make(map[string]string)
+		}
+		ret.Templates[name] = text
+	}
+	return ret
 }
 
-// loads settings from ~/.config/claws.json
-func LoadSettings() (oSet Settings, err error) {
+// cloneOwn returns a copy of the settings to be written to claws.json: the
+// values of the project-local configuration file which weren't changed since
+// they were loaded are replaced by those of claws.json, and its profiles and
+// templates are left out.
+func (s *Settings) cloneOwn() SettingsBase {
+	s.RLock()
+	defer s.RUnlock()
+	ret := s.SettingsBase.Clone()
+	cur := reflect.ValueOf(&ret).Elem()
+	loaded := reflect.ValueOf(&s.loaded).Elem()
+	own := reflect.ValueOf(&s.local.own).Elem()
+	for field := range s.local.values {
+		if f := cur.FieldByName(field); reflect.DeepEqual(f.Interface(), loaded.FieldByName(field).Interface()) {
+			f.Set(own.FieldByName(field))
+		}
+	}
+	return ret
+}
+
+// getConfigFile returns the path of claws.json: $CLAWS_CONFIG if set,
+// otherwise claws.json in the config folder.
+func getConfigFile() (string, error) {
+	if file := os.Getenv("CLAWS_CONFIG"); file != "" {
+		return file, nil
+	}
 	folder, err := getConfigFolder()
 	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, "claws.json"), nil
+}
+
+// localConfigName is the name of the project-local configuration file.
+const localConfigName = ".claws.json"
+
+// findLocalConfig looks for the project-local configuration file in the
+// current directory and its parents, returning an empty string if there is
+// none.
+func findLocalConfig() string {
+	dir, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	for {
+		file := filepath.Join(dir, localConfigName)
+		if fi, err := os.Stat(file); err == nil && !fi.IsDir() {
+			return file
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+const settingsInfo = "Claws configuration file; more information can be found at https://howl.moe/claws"
+
+// loads settings from file, or from the default location (see getConfigFile)
+// if it is empty. The values in the project-local configuration file, if
+// found, overlay those in file (see readLocalConfig).
+func LoadSettings(file string) (oSet Settings, err error) {
+	if file == "" {
+		if file, err = getConfigFile(); err != nil {
+			return
+		}
+	}
+	oSet.file = file
+
+	local := findLocalConfig()
+	if local != "" && !sameFile(local, file) {
+		oSet.localFile = local
+	}
+
+	oSet.SettingsBase, oSet.local, oSet.warnings, err = readConfigFiles(file, oSet.localFile)
+	oSet.loaded = oSet.SettingsBase.Clone()
+	return
+}
+
+// readConfigFiles reads the settings in file and, if local is not empty, in
+// the project-local configuration file, whose values overlay them. What was
+// read from the local file is returned, together with the warnings found in
+// both files.
+func readConfigFiles(file, local string) (oSet SettingsBase, lc localConfig, warnings []string, err error) {
+	fnWarn := func(file string, sf settingsFile) {
+		for _, w := range sf.warnings {
+			warnings = append(warnings, file+": "+w)
+		}
+	}
+
+	oSet, sf, err := readSettingsFile(file)
+	if err != nil {
+		err = fmt.Errorf("reading %s: %w", file, err)
 		return
 	}
+	fnWarn(file, sf)
 
-	f, err := os.Open(folder + "claws.json")
+	if local == "" {
+		return
+	}
+	var localSet SettingsBase
+	data, err := os.ReadFile(local)
+	if err == nil {
+		sf, err = parseSettings(data, &localSet)
+	}
+	if err == nil && len(sf.values) > 0 {
+		var localWarnings []string
+		lc, localWarnings = readLocalConfig(sf.values, localSet)
+		sf.warnings = append(sf.warnings, localWarnings...)
+		lc.own = oSet.Clone()
+		// decoding into the settings which have already been read only
+		// replaces the values which are in the local file
+		if data, err = json.Marshal(lc.values); err == nil {
+			err = json.Unmarshal(data, &oSet)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("reading %s: %w", local, err)
+		return
+	}
+	fnWarn(local, sf)
+	return
+}
+
+// localConfig is what is read from a project-local configuration file.
+type localConfig struct {
+	// top-level values, which overlay those of claws.json, and the values
+	// of claws.json they replace
+	values map[string]json.RawMessage
+	own    SettingsBase
+	// added to those of claws.json
+	profiles  map[string]Profile
+	templates map[string]string
+}
+
+// localIgnoredFields are the settings which are ignored in project-local
+// configuration files, with the reason. As the files come with projects,
+// which may not be trusted, they can't run commands or read files.
+var localIgnoredFields = map[string]string{
+	"LastWebsocketURL": "it is written by claws",
+	"History":          "it is written by claws",
+	"Pipe":             "project-local configuration files can't run commands",
+	"CAFile":           "project-local configuration files can't read files",
+	"CertFile":         "project-local configuration files can't read files",
+	"KeyFile":          "project-local configuration files can't read files",
+	"DescriptorSet":    "project-local configuration files can't read files",
+}
+
+// readLocalConfig returns what is used of a project-local configuration file,
+// whose settings and top-level values are given: the values, except those in
+// localIgnoredFields and those with ${file:...} or ${cmd:...} references,
+// and the profiles and templates. A profile with such references is ignored.
+// The values ignored are reported as warnings.
+func readLocalConfig(values map[string]json.RawMessage, oSet SettingsBase) (lc localConfig, warnings []string) {
+	safe := safeLocalValues("", values, reflect.TypeOf(oSet), &warnings)
+	for _, key := range sortedKeys(safe) {
+		switch key {
+		case "Info", "Version":
+		case "Profiles":
+			lc.profiles = readLocalProfiles(safe[key], &warnings)
+		case "Templates":
+			lc.templates = oSet.Templates
+		default:
+			if ref := unsafeReference(jsonStrings(safe[key])...); ref != "" {
+				warnings = append(warnings, fmt.Sprintf("%s is ignored: %s references are not allowed in project-local configuration files", key, ref))
+				continue
+			}
+			if lc.values == nil {
+				lc.values = make(map[string]json.RawMessage)
+			}
+			lc.values[key] = safe[key]
+		}
+	}
+	return lc, warnings
+}
+
+// readLocalProfiles returns the profiles of a project-local configuration
+// file, whose JSON object is raw, without the settings in localIgnoredFields.
+func readLocalProfiles(raw json.RawMessage, warnings *[]string) (profiles map[string]Profile) {
+	var values map[string]json.RawMessage
+	json.Unmarshal(raw, &values)
+	for _, name := range sortedKeys(values) {
+		var pValues map[string]json.RawMessage
+		json.Unmarshal(values[name], &pValues)
+		safe := safeLocalValues(fmt.Sprintf("profile %q: ", name), pValues, reflect.TypeOf(Profile{}), warnings)
+		data, _ := json.Marshal(safe)
+		if ref := unsafeReference(jsonStrings(data)...); ref != "" {
+			*warnings = append(*warnings, fmt.Sprintf("profile %q is ignored: %s references are not allowed in project-local configuration files", name, ref))
+			continue
+		}
+		var p Profile
+		if json.Unmarshal(data, &p) != nil {
+			continue
+		}
+		if profiles == nil {
+			profiles = make(map[string]Profile)
+		}
+		profiles[name] = p
+	}
+	return profiles
+}
+
+// safeLocalValues returns values, a JSON object decoded into a struct of type
+// t, without the settings in localIgnoredFields, also in nested objects,
+// adding a warning for each of them. The keys returned are the names of the
+// fields, and the unknown keys are left out.
+func safeLocalValues(prefix string, values map[string]json.RawMessage, t reflect.Type, warnings *[]string) map[string]json.RawMessage {
+	fields := configFields(t)
+	safe := make(map[string]json.RawMessage, len(values))
+	for _, key := range sortedKeys(values) {
+		f, ok := lookupConfigField(fields, key)
+		if !ok {
+			continue
+		}
+		raw := values[key]
+		if reason, ok := localIgnoredFields[f.Name]; ok {
+			*warnings = append(*warnings, prefix+f.Name+" is ignored: "+reason)
+			continue
+		}
+		var nested map[string]json.RawMessage
+		if f.Type.Kind() == reflect.Struct && json.Unmarshal(raw, &nested) == nil && nested != nil {
+			nested = safeLocalValues(prefix+f.Name+".", nested, f.Type, warnings)
+			raw, _ = json.Marshal(nested)
+		}
+		safe[f.Name] = raw
+	}
+	return safe
+}
+
+// jsonStrings returns the strings in the JSON value raw.
+func jsonStrings(raw json.RawMessage) []string {
+	var v interface{}
+	json.Unmarshal(raw, &v)
+	var strs []string
+	var fnWalk func(v interface{})
+	fnWalk = func(v interface{}) {
+		switch v := v.(type) {
+		case string:
+			strs = append(strs, v)
+		case []interface{}:
+			for _, el := range v {
+				fnWalk(el)
+			}
+		case map[string]interface{}:
+			for _, el := range v {
+				fnWalk(el)
+			}
+		}
+	}
+	fnWalk(v)
+	return strs
+}
+
+// Warnings returns the problems found while loading the configuration files
+// which didn't prevent them from being used.
+func (s *Settings) Warnings() []string {
+	return s.warnings
+}
+
+func sameFile(a, b string) bool {
+	fa, errA := os.Stat(a)
+	fb, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(fa, fb)
+}
+
+// ConfigFiles returns the path of claws.json and of the project-local
+// configuration file, if any.
+func (s *Settings) ConfigFiles() (file string, localFile string) {
+	return s.file, s.localFile
+}
+
+// readSettingsFile reads the settings in file, migrating and validating
+// them (see parseSettings). sf.exists is false if the file does not exist, in
+// which case no error is returned.
+func readSettingsFile(file string) (oSet SettingsBase, sf settingsFile, err error) {
+	data, err := os.ReadFile(file)
 	if err != nil {
 		// silently ignore NotExist
 		if os.IsNotExist(err) {
 			err = nil
-			return
 		}
 		return
 	}
-	defer f.Close()
 
-	err = json.NewDecoder(f).Decode(&oSet.SettingsBase)
+	sf, err = parseSettings(data, &oSet)
 	return
 }
 
-// saves settings to ~/.config/claws.json
-func (s *Settings) Save() error {
-	folder, err := getConfigFolder()
+// writeSettingsFile atomically replaces file with the given settings, by
+// writing them to a temporary file which is then renamed. The unknown keys
+// read from the file are kept.
+func writeSettingsFile(file string, oSet *SettingsBase, unknown []unknownKey) (err error) {
+	oSet.Info = settingsInfo
+	if oSet.Version < settingsVersion {
+		oSet.Version = settingsVersion
+	}
+
+	data, err := json.MarshalIndent(oSet, "", "\t")
 	if err != nil {
 		return err
 	}
+	data = append(data, '\n')
+	if len(unknown) > 0 {
+		if data, err = addUnknownKeys(data, unknown); err != nil {
+			return err
+		}
+	}
+
+	// a symlink, as used by dotfile managers, must be kept: the file it
+	// points to is replaced instead
+	if target, err := filepath.EvalSymlinks(file); err == nil {
+		file = target
+	}
 
-	f, err := os.Create(folder + "claws.json")
+	mode := os.FileMode(0644)
+	if fi, err := os.Stat(file); err == nil {
+		mode = fi.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
 	if err != nil {
 		return err
 	}
-	defer f.Close()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
 
-	s.RLock()
-	defer s.RUnlock()
+	if _, err = f.Write(data); err != nil {
+		return err
+	}
+	if err = f.Chmod(mode); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// modifyFile reads the settings in claws.json, calls fn to modify them, and
+// writes them back, while holding the lock on the file, so that concurrent
+// instances of claws don't overwrite each other's changes. If the file does
+// not exist yet, fn is called with the current settings.
+func (s *Settings) modifyFile(fn func(onDisk *SettingsBase)) error {
+	file := s.file
+	if file == "" {
+		var err error
+		if file, err = getConfigFile(); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	unlock, err := lockFile(file)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	onDisk, sf, err := readSettingsFile(file)
+	if err != nil {
+		return fmt.Errorf("reading %s: %w", file, err)
+	}
+	if !sf.exists {
+		onDisk = s.cloneOwn()
+	}
 
-	s.Info = "Claws configuration file; more information can be found at https://howl.moe/claws"
-	e := json.NewEncoder(f)
-	e.SetIndent("", "\t")
-	return e.Encode(s.SettingsBase)
+	fn(&onDisk)
+	return writeSettingsFile(file, &onDisk, sf.unknown)
 }
 
-// applies ONLY specified fields of current settings to claws.json
+// saves all the settings to claws.json
+func (s *Settings) Save() error {
+	oSet := s.cloneOwn()
+	return s.modifyFile(func(onDisk *SettingsBase) {
+		*onDisk = oSet
+	})
+}
+
+// applies ONLY specified fields of current settings to claws.json.
+// The values of the project-local configuration file are written only if
+// they were changed (see cloneOwn).
 func (s *Settings) Update(fields ...string) error {
-	// TODO: rewrite settings.go to make everything 100% atomic and better
-	// structured.
-	s.RLock()
-	defer s.RUnlock()
-	return s.Save()
+	oSet := s.cloneOwn()
+	cur := reflect.ValueOf(&oSet).Elem()
+	for _, field := range fields {
+		if !cur.FieldByName(field).IsValid() {
+			return fmt.Errorf("settings: unknown field %q", field)
+		}
+	}
+
+	return s.modifyFile(func(onDisk *SettingsBase) {
+		dst := reflect.ValueOf(onDisk).Elem()
+		for _, field := range fields {
+			dst.FieldByName(field).Set(cur.FieldByName(field))
+		}
+	})
+}
+
+// defaultHistorySize is the number of items kept in each list of History when
+// HistorySize is 0.
+const defaultHistorySize = 100
+
+// adds an action to the history with the given key, removing its previous
+// occurrences unless HistoryKeepDuplicates is set. The actions added by other
+// instances of claws in the meantime are kept.
+func (s *Settings) PushAction(key, act string) error {
+	oSet := s.Clone()
+	size := oSet.HistorySize
+	switch {
+	case size < 0:
+		return nil
+	case size == 0:
+		size = defaultHistorySize
+	}
+
+	fnPush := func(history map[string][]string) map[string][]string {
+		actions := []string{act}
+		for _, a := range history[key] {
+			if a != act || oSet.HistoryKeepDuplicates {
+				actions = append(actions, a)
+			}
+		}
+		if len(actions) > size {
+			actions = actions[:size]
+		}
+		if history == nil {
+			history = make(map[string][]string)
+		}
+		history[key] = actions
+		return history
+	}
+
+	err := s.modifyFile(func(onDisk *SettingsBase) {
+		onDisk.History = fnPush(onDisk.History)
+
+		s.Lock()
+		if s.History == nil {
+			s.History = make(map[string][]string)
+		}
+		s.History[key] = cloneStrings(onDisk.History[key])
+		s.Unlock()
+	})
+	if err != nil {
+		// keep the action in memory anyway
+		s.Lock()
+		s.History = fnPush(s.History)
+		s.Unlock()
+	}
+	return err
 }
 
-// adds an action to LastActions
-func (s *Settings) PushAction(act string) error {
-	s.Lock()
-	s.LastActions = append([]string{act}, s.LastActions...)
-	if len(s.LastActions) > 100 {
-		s.LastActions = s.LastActions[:100]
+// preParseFlags returns the values of the flags which are needed before
+// loading the settings and parsing the other flags: the configuration file and
+// the profile.
+func preParseFlags() (configFile, profile string) {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var scratch SettingsBase
+	defineFlags(fs, &scratch, &configFile, &profile)
+	// errors are reported by ParseFlags
+	fs.Parse(os.Args[1:])
+	return
+}
+
+// parseCommandFlags parses the flags of a subcommand such as claws bench,
+// which can use the flags of the interactive client. define defines the
+// flags of the subcommand. The settings are returned with the profile
+// applied, together with the URL of the profile.
+func parseCommandFlags(name, usage string, args []string, define func(*flag.FlagSet)) (oSet SettingsBase, fs *flag.FlagSet, profileURL string, err error) {
+	var configFile, profile string
+	pre := flag.NewFlagSet(name, flag.ContinueOnError)
+	pre.SetOutput(io.Discard)
+	var scratch SettingsBase
+	defineFlags(pre, &scratch, &configFile, &profile)
+	define(pre)
+	// errors are reported when parsing the flags again
+	pre.Parse(args)
+
+	set, err := LoadSettings(configFile)
+	if err != nil {
+		return
+	}
+	for _, w := range set.Warnings() {
+		fmt.Fprintln(os.Stderr, "warning:", w)
+	}
+	oSet = set.Clone()
+	if profile != "" {
+		if err = oSet.ApplyProfile(profile); err != nil {
+			return
+		}
+		profileURL = oSet.LastWebsocketURL
 	}
-	s.Unlock()
 
-	return s.Update("LastActions")
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		fs.PrintDefaults()
+	}
+	defineFlags(fs, &oSet, &configFile, &profile)
+	define(fs)
+	err = fs.Parse(args)
+	return
 }
 
 // displays CLI `--help` information
 // writes specified flags/opts into settings
-func (pSet *Settings) ParseFlags() error {
+//
+// If profile is not empty, the profile is applied to a copy of the settings
+// before the flags are, so that they can override its values, and the
+// resulting connection options are returned: like those of a profile chosen
+// when connecting (see State.UseProfile), they are only used by this session,
+// and only the URL is saved.
+func (pSet *Settings) ParseFlags(profile string) (*ConnectionOptions, error) {
 	// Help message
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, cliHelpPrefix)
@@ -140,28 +645,115 @@ func (pSet *Settings) ParseFlags() error {
 		fmt.Fprint(os.Stderr, cliHelpSuffix)
 	}
 
-	flag.BoolVar(&pSet.JSONFormatting, "j", pSet.JSONFormatting, "Start with JSON formatting enabled.")
-	flag.StringVar(&pSet.Timestamp, "t", pSet.Timestamp, "Golang date format for timestamps.\nDisabled when blank.")
-	flag.IntVar(&pSet.PingSeconds, "p", pSet.PingSeconds, "PING interval.\nDisabled when <= 0.")
+	oSet := &pSet.SettingsBase
+	useProfile := profile != ""
+	var profileSet SettingsBase
+	if useProfile {
+		profileSet = pSet.Clone()
+		if err := profileSet.ApplyProfile(profile); err != nil {
+			return nil, err
+		}
+		oSet = &profileSet
+	}
 
+	var configFile string
+	defineFlags(flag.CommandLine, oSet, &configFile, &profile)
 	flag.Parse()
 
 	// Use WebSocket URL if given.
-	sArgs := flag.Args()
-	for _, wsurl := range sArgs {
-		wsurl := strings.TrimSpace(wsurl)
-		if len(wsurl) > 0 {
-			pSet.LastWebsocketURL = wsurl
-			return pSet.Update("LastWebsocketURL")
+	urlArg := false
+	for _, wsurl := range flag.Args() {
+		if wsurl := strings.TrimSpace(wsurl); len(wsurl) > 0 {
+			oSet.LastWebsocketURL = wsurl
+			urlArg = true
+			break
+		}
+	}
+
+	if !useProfile {
+		if urlArg {
+			return nil, pSet.Update("LastWebsocketURL")
 		}
+		return nil, nil
 	}
 
+	pSet.Lock()
+	pSet.JSONFormatting = profileSet.JSONFormatting
+	pSet.Timestamp = profileSet.Timestamp
+	pSet.LastWebsocketURL = profileSet.LastWebsocketURL
+	pSet.Unlock()
+	opts := profileSet.ConnectionOptions
+	return &opts, pSet.Update("LastWebsocketURL")
+}
+
+func defineFlags(fs *flag.FlagSet, pSet *SettingsBase, configFile, profile *string) {
+	fs.StringVar(configFile, "config", "", "Path of the configuration file.\nDefaults to $CLAWS_CONFIG, or claws.json in $XDG_CONFIG_HOME or ~/.config.")
+	fs.StringVar(profile, "P", "", "Name of the profile to use.\nOther options override the values of the profile.")
+	fs.BoolVar(&pSet.JSONFormatting, "j", pSet.JSONFormatting, "Start with JSON formatting enabled.")
+	fs.StringVar(&pSet.Timestamp, "t", pSet.Timestamp, "Golang date format for timestamps.\nDisabled when blank.")
+	fs.IntVar(&pSet.PingSeconds, "p", pSet.PingSeconds, "PING interval.\nDisabled when <= 0.")
+	fs.Var(&stringsFlag{&pSet.Headers, false}, "H", "HTTP header to send when connecting, as \"Name: value\".\nCan be repeated.")
+	fs.Var(&stringsFlag{&pSet.Subprotocols, false}, "protocol", "WebSocket subprotocol to request.\nCan be repeated.")
+	fs.Var(&stringsFlag{&pSet.OnConnect, false}, "on-connect", "Message to send after connecting.\nCan be repeated.")
+	fs.BoolVar(&pSet.TLS.Insecure, "insecure", pSet.TLS.Insecure, "Don't verify the server's TLS certificate.")
+	fs.StringVar(&pSet.TLS.CAFile, "cacert", pSet.TLS.CAFile, "PEM file with the CA certificates used to verify the server.")
+	fs.StringVar(&pSet.TLS.CertFile, "cert", pSet.TLS.CertFile, "PEM file with the TLS client certificate.")
+	fs.StringVar(&pSet.TLS.KeyFile, "key", pSet.TLS.KeyFile, "PEM file with the key of the TLS client certificate.")
+	fs.StringVar(&pSet.Proxy, "proxy", pSet.Proxy, "URL of the http, https or socks5 proxy to connect through.\nTaken from HTTP_PROXY/HTTPS_PROXY when blank; disabled when \"none\".")
+	fs.StringVar(&pSet.UnixSocket, "unix-socket", pSet.UnixSocket, "Path of a Unix domain socket to connect to,\ninstead of the host in the WebSocket URL.")
+	fs.BoolVar(&pSet.Compression, "compress", pSet.Compression, "Request permessage-deflate compression.")
+	fs.IntVar(&pSet.CompressionLevel, "compress-level", pSet.CompressionLevel, "Compression level for sent messages, from -2 to 9.\nDefault level when 0.")
+	fs.StringVar(&pSet.Decompression, "z", pSet.Decompression, "Decompress binary messages.\nOne of: "+strings.Join(decompressionNames(), ", ")+".\nDisabled when blank.")
+	fs.StringVar(&pSet.BinaryDecoder, "b", pSet.BinaryDecoder, "Decoder for binary messages.\nOne of: "+strings.Join(binaryDecoderNames(), ", ")+".")
+	fs.StringVar(&pSet.BinaryEncoder, "e", pSet.BinaryEncoder, "Encode sent messages, written as JSON, as binary messages.\nOne of: "+strings.Join(binaryEncoderNames(), ", ")+".")
+	fs.StringVar(&pSet.Protobuf.DescriptorSet, "proto-descriptors", pSet.Protobuf.DescriptorSet, "Protobuf descriptor set used by the protobuf decoder.")
+	fs.StringVar(&pSet.Protobuf.Message, "proto-message", pSet.Protobuf.Message, "Full name of the Protobuf message type of binary messages.\nDecoded without a schema when blank.")
+	fs.StringVar(&pSet.Protobuf.SendMessage, "proto-send-message", pSet.Protobuf.SendMessage, "Full name of the Protobuf message type of sent messages.")
+	fs.StringVar(&pSet.Protocol, "layer", pSet.Protocol, "Application protocol spoken over the WebSocket.\nOne of: "+strings.Join(protocolLayerNames(), ", ")+".\nMessages are sent as typed when blank.")
+	fs.StringVar(&pSet.SocketIO.Namespace, "sio-namespace", pSet.SocketIO.Namespace, "Socket.IO namespace to connect to.")
+	fs.StringVar(&pSet.SocketIO.Auth, "sio-auth", pSet.SocketIO.Auth, "JSON object sent when connecting to a Socket.IO namespace.")
+	fs.StringVar(&pSet.STOMP.Login, "stomp-login", pSet.STOMP.Login, "Login sent when connecting to a STOMP server.")
+	fs.StringVar(&pSet.STOMP.Passcode, "stomp-passcode", pSet.STOMP.Passcode, "Passcode sent when connecting to a STOMP server.")
+	fs.StringVar(&pSet.STOMP.Host, "stomp-host", pSet.STOMP.Host, "STOMP virtual host.\nThe host of the URL when blank.")
+	fs.StringVar(&pSet.STOMP.HeartBeat, "stomp-heartbeat", pSet.STOMP.HeartBeat, "STOMP heart-beats offered, as SEND_MS,RECEIVE_MS.\n"+stompDefaultHeartBeat+" when blank; disabled when 0,0.")
+	fs.StringVar(&pSet.GraphQL.InitPayload, "graphql-init", pSet.GraphQL.InitPayload, "JSON object sent with the GraphQL connection_init message.")
+	fs.StringVar(&pSet.MQTT.Version, "mqtt-version", pSet.MQTT.Version, "MQTT version: 3.1.1 or 5.\n3.1.1 when blank.")
+	fs.StringVar(&pSet.MQTT.ClientID, "mqtt-client-id", pSet.MQTT.ClientID, "MQTT client identifier.\nRandom when blank.")
+	fs.StringVar(&pSet.MQTT.Username, "mqtt-user", pSet.MQTT.Username, "User name sent when connecting to an MQTT broker.")
+	fs.StringVar(&pSet.MQTT.Password, "mqtt-password", pSet.MQTT.Password, "Password sent when connecting to an MQTT broker.")
+	fs.IntVar(&pSet.MQTT.KeepAlive, "mqtt-keepalive", pSet.MQTT.KeepAlive, "MQTT keep alive interval, in seconds.\n60 when 0; disabled when negative.")
+}
+
+// stringsFlag is a flag which can be repeated. The values passed on the
+// command line replace those in the settings.
+type stringsFlag struct {
+	values *[]string
+	set    bool
+}
+
+func (f *stringsFlag) String() string {
+	if f.values == nil {
+		return ""
+	}
+	return strings.Join(*f.values, ", ")
+}
+
+func (f *stringsFlag) Set(v string) error {
+	if !f.set {
+		*f.values = nil
+		f.set = true
+	}
+	*f.values = append(*f.values, v)
 	return nil
 }
 
 const cliHelpPrefix = `COMMAND
 
   claws [OPTION...] [WEBSOCKET_URL]
+  claws -P PROFILE [OPTION...]
+  claws config check [FILE...]
+  claws bench [OPTION...] WEBSOCKET_URL
+  claws test [OPTION...] FILE...
 
 OPTIONS
 
@@ -173,15 +765,52 @@ USAGE
   Key Action
   --- ---------------------------------------------------------------
   Esc Enter command mode. (<Ctrl-[> also works)
+  b   Set the decoder for binary messages. Prompts for the decoder
+      name (msgpack, cbor or protobuf); protobuf can be followed
+      by an optional descriptor set file and a message name.
+      If nothing is passed, binary messages are not decoded.
+  e   Set the encoder for sent messages, which are written as
+      JSON and sent as binary messages. Prompts for the encoder
+      name (msgpack, cbor or protobuf); protobuf must be followed
+      by a message name, optionally preceded by a descriptor set.
+      If nothing is passed, messages are sent as text.
   c   Create a new connection. Prompts for WebSocket URL.
       If nothing is passed, previous URL will be used.
+      Type @PROFILE to use a profile; <Tab> cycles through them.
   h   View help/welcome screen with quick commands.
   i   Go to insert mode. (<Ins> key also works)
-  j   Toggle auto-detection of JSON in server messages and
-      automatic tab indentation.
+  j   Toggle auto-detection of JSON in messages and automatic
+      tab indentation.
   p   Set ping interval in seconds.  Will prompt for an interval.
       If nothing is passed, pings will be disabled.
   q   Close current connection.
+  s   Show statistics of the current connection.
+  v   Open the message in $VISUAL or $EDITOR, and send it
+      once the editor is closed, unless it is empty.
+  <Enter>
+      Add a new line to the message; this is what most terminals
+      send for <Alt-Enter>. (<Ctrl-J> also works)
+  P   Save the current connection settings as a profile.
+      Prompts for the name of the profile.
+  T   Put a message template in the input field. Prompts for the
+      name of the template; type +NAME to save the last message
+      sent as a template, -NAME to delete it. Sending @NAME sends
+      the template directly.
+  S   Send a message repeatedly over the current connection.
+      Prompts for INTERVAL [xCOUNT] [~JITTER] MESSAGE, where
+      INTERVAL is a duration (5s) or a rate (10/s); type -ID to
+      cancel a schedule, - to cancel all, nothing to list them.
+  w   Watch the messages received: those matching a rule are
+      highlighted, ringing the bell. Prompts for PATTERN, which
+      is /REGEX/, .PATH [== VALUE] or text, optionally followed
+      by actions: | once, | quiet, | run COMMAND, | reply MESSAGE.
+      Type -ID to remove a rule, - to remove all, nothing to
+      list them.
+  L   Set the application protocol spoken over the WebSocket,
+      used from the next connection. Prompts for the protocol
+      name (graphql, graphql-legacy, jsonrpc, mqtt, socketio
+      or stomp). If nothing is passed, messages are sent as
+      they are typed.
   R   Go into replace/overtype mode.
       (can also be done by pressing <Ins> a couple of times)
   t   Toggle timestamps before messages in console.
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// socketIO speaks Socket.IO v5 over Engine.IO v4. Engine.IO frames start
+// with the packet type (0 open, 1 close, 2 ping, 3 pong, 4 message); the
+// messages contain Socket.IO packets, starting with their own type (0
+// connect, 1 disconnect, 2 event, 3 ack, 4 connect error), followed by the
+// namespace, if it isn't "/", and the ack ID:
+//
+//	42/chat,7["message",{"text":"hi"}]
+//
+// The user types commands, which are translated into packets:
+//
+//	emit EVENT [ARGS...]     emit an event, with JSON arguments
+//	emitack EVENT [ARGS...]  emit an event, asking for an ack
+//	ack ID [ARGS...]         acknowledge an event received
+//	join NAMESPACE [AUTH]    connect to a namespace, emitting to it
+//	leave [NAMESPACE]        disconnect from a namespace
+//
+// Anything else is sent as it is.
+type socketIO struct {
+	mu sync.Mutex
+	// namespace events are emitted to
+	namespace string
+	auth      json.RawMessage
+	lastAck   int
+}
+
+func newSocketIO(oSet SettingsBase) (protocolLayer, error) {
+	auth, err := socketIOAuth(oSet.SocketIO.Auth)
+	if err != nil {
+		return nil, err
+	}
+	return &socketIO{
+		namespace: socketIONamespace(oSet.SocketIO.Namespace),
+		auth:      auth,
+	}, nil
+}
+
+func socketIONamespace(ns string) string {
+	if !strings.HasPrefix(ns, "/") {
+		ns = "/" + ns
+	}
+	return ns
+}
+
+func socketIOAuth(auth string) (json.RawMessage, error) {
+	auth = strings.TrimSpace(auth)
+	if auth == "" {
+		return nil, nil
+	}
+	if !json.Valid([]byte(auth)) || auth[0] != '{' {
+		return nil, errors.New("the Socket.IO auth payload must be a JSON object")
+	}
+	return json.RawMessage(auth), nil
+}
+
+// URL adds the Engine.IO path and parameters to the URL, if missing.
+func (sio *socketIO) URL(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	switch pu.Scheme {
+	case "http":
+		pu.Scheme = "ws"
+	case "https":
+		pu.Scheme = "wss"
+	}
+	if pu.Path == "" || pu.Path == "/" {
+		pu.Path = "/socket.io/"
+	}
+	q := pu.Query()
+	if q.Get("EIO") == "" {
+		q.Set("EIO", "4")
+	}
+	if q.Get("transport") == "" {
+		q.Set("transport", "websocket")
+	}
+	pu.RawQuery = q.Encode()
+	return pu.String(), nil
+}
+
+// Open returns no frames: the namespace is joined once the server opens the
+// Engine.IO session.
+func (sio *socketIO) Open() ([]WsMsg, error) {
+	return nil, nil
+}
+
+// socketIOPacket returns a Socket.IO packet, in an Engine.IO message.
+func socketIOPacket(typ byte, ns, id string, data []byte) WsMsg {
+	var sb strings.Builder
+	sb.WriteByte('4')
+	sb.WriteByte(typ)
+	if ns != "/" {
+		sb.WriteString(ns)
+		sb.WriteByte(',')
+	}
+	sb.WriteString(id)
+	sb.Write(data)
+	return textFrame(sb.String())
+}
+
+func (sio *socketIO) Send(msg string) ([]WsMsg, string, error) {
+	sio.mu.Lock()
+	defer sio.mu.Unlock()
+
+	cmd, arg := parsePlaceholder(msg)
+	switch cmd {
+	case "emit", "emitack":
+		event, rest, err := parseEventName(arg)
+		if err != nil {
+			return nil, "", err
+		}
+		name, _ := json.Marshal(event)
+		data, err := json.Marshal(append([]json.RawMessage{name}, parseJSONArgs(rest)...))
+		if err != nil {
+			return nil, "", err
+		}
+		if cmd == "emit" {
+			return []WsMsg{socketIOPacket('2', sio.namespace, "", data)}, "", nil
+		}
+		sio.lastAck++
+		id := strconv.Itoa(sio.lastAck)
+		return []WsMsg{socketIOPacket('2', sio.namespace, id, data)}, "[ack " + id + "] ", nil
+	case "ack":
+		id, rest := parsePlaceholder(arg)
+		if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+			return nil, "", errors.New("usage: ack ID [ARGS...]")
+		}
+		data, err := json.Marshal(append([]json.RawMessage{}, parseJSONArgs(rest)...))
+		if err != nil {
+			return nil, "", err
+		}
+		return []WsMsg{socketIOPacket('3', sio.namespace, id, data)}, "", nil
+	case "join":
+		ns, auth := parsePlaceholder(arg)
+		if ns == "" {
+			return nil, "", errors.New("usage: join NAMESPACE [AUTH]")
+		}
+		data, err := socketIOAuth(auth)
+		if err != nil {
+			return nil, "", err
+		}
+		if data == nil {
+			data = sio.auth
+		}
+		sio.namespace = socketIONamespace(ns)
+		return []WsMsg{socketIOPacket('0', sio.namespace, "", data)}, "", nil
+	case "leave":
+		ns := sio.namespace
+		if arg != "" {
+			ns = socketIONamespace(arg)
+		}
+		if ns == sio.namespace {
+			sio.namespace = "/"
+		}
+		return []WsMsg{socketIOPacket('1', ns, "", nil)}, "", nil
+	}
+	return []WsMsg{textFrame(msg)}, "", nil
+}
+
+// parseEventName splits the name of an event, which can be quoted as a JSON
+// string, from its arguments.
+func parseEventName(s string) (name, rest string, err error) {
+	if strings.HasPrefix(s, `"`) {
+		dec := json.NewDecoder(strings.NewReader(s))
+		if err := dec.Decode(&name); err != nil {
+			return "", "", fmt.Errorf("invalid event name: %w", err)
+		}
+		return name, s[dec.InputOffset():], nil
+	}
+	name, rest = parsePlaceholder(s)
+	if name == "" {
+		return "", "", errors.New("the name of the event is missing")
+	}
+	return name, rest, nil
+}
+
+// parseJSONArgs parses a sequence of JSON values. If s isn't valid JSON, it
+// is a single string.
+func parseJSONArgs(s string) []json.RawMessage {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil
+	}
+	var args []json.RawMessage
+	dec := json.NewDecoder(strings.NewReader(s))
+	for {
+		var raw json.RawMessage
+		err := dec.Decode(&raw)
+		if err == io.EOF {
+			return args
+		}
+		if err != nil {
+			str, _ := json.Marshal(s)
+			return []json.RawMessage{str}
+		}
+		args = append(args, raw)
+	}
+}
+
+// renderArgs returns the arguments of an event, as shown: a single argument
+// is shown by itself, more are shown as an array.
+func renderArgs(args []json.RawMessage) []byte {
+	switch len(args) {
+	case 0:
+		return []byte{}
+	case 1:
+		return args[0]
+	}
+	data, _ := json.Marshal(args)
+	return data
+}
+
+func (sio *socketIO) Receive(msg WsMsg) layerResult {
+	text := string(msg.Msg)
+	if msg.Type != websocket.TextMessage || text == "" {
+		return layerResult{Body: msg.Msg}
+	}
+
+	switch text[0] {
+	case '0':
+		var open struct {
+			Sid          string
+			PingInterval int
+		}
+		json.Unmarshal([]byte(text[1:]), &open)
+		sio.mu.Lock()
+		connect := socketIOPacket('0', sio.namespace, "", sio.auth)
+		sio.mu.Unlock()
+		return layerResult{
+			Info:    fmt.Sprintf("Engine.IO session %s opened (ping interval %dms)", open.Sid, open.PingInterval),
+			Replies: []WsMsg{connect},
+		}
+	case '1':
+		return layerResult{Info: "Engine.IO session closed by the server"}
+	case '2':
+		// heartbeats are answered and hidden
+		return layerResult{Replies: []WsMsg{textFrame("3" + text[1:])}}
+	case '3', '6':
+		return layerResult{}
+	case '4':
+		return sio.receivePacket(text[1:], msg.Msg)
+	}
+	return layerResult{Body: msg.Msg}
+}
+
+// receivePacket decodes the Socket.IO packet p, contained in the frame raw.
+func (sio *socketIO) receivePacket(p string, raw []byte) layerResult {
+	if p == "" {
+		return layerResult{Body: raw}
+	}
+	typ, p := p[0], p[1:]
+	if typ == '5' || typ == '6' {
+		return layerResult{Info: "Binary Socket.IO packets are not supported", Body: raw}
+	}
+
+	ns := "/"
+	if strings.HasPrefix(p, "/") {
+		if i := strings.IndexByte(p, ','); i >= 0 {
+			ns, p = p[:i], p[i+1:]
+		} else {
+			ns, p = p, ""
+		}
+	}
+	i := 0
+	for i < len(p) && p[i] >= '0' && p[i] <= '9' {
+		i++
+	}
+	id, data := p[:i], []byte(p[i:])
+	nsPrefix := ""
+	if ns != "/" {
+		nsPrefix = ns + " "
+	}
+
+	switch typ {
+	case '0':
+		var v struct{ Sid string }
+		json.Unmarshal(data, &v)
+		return layerResult{Info: fmt.Sprintf("Connected to namespace %s (sid %s)", ns, v.Sid)}
+	case '1':
+		return layerResult{Info: "Disconnected from namespace " + ns}
+	case '2':
+		var args []json.RawMessage
+		if err := json.Unmarshal(data, &args); err != nil || len(args) == 0 {
+			return layerResult{Err: errors.New("invalid Socket.IO event"), Body: raw}
+		}
+		var name string
+		if json.Unmarshal(args[0], &name) != nil {
+			name = string(args[0])
+		}
+		header := "[" + nsPrefix + "event " + name
+		if id != "" {
+			header += ", ack " + id
+		}
+		return layerResult{Header: header + "] ", Body: renderArgs(args[1:])}
+	case '3':
+		var args []json.RawMessage
+		if err := json.Unmarshal(data, &args); err != nil {
+			return layerResult{Err: errors.New("invalid Socket.IO ack"), Body: raw}
+		}
+		return layerResult{Header: "[" + nsPrefix + "ack " + id + "] ", Body: renderArgs(args)}
+	case '4':
+		var v struct{ Message string }
+		if json.Unmarshal(data, &v) != nil || v.Message == "" {
+			v.Message = string(data)
+		}
+		return layerResult{Err: fmt.Errorf("namespace %s: connection refused: %s", ns, v.Message)}
+	}
+	return layerResult{Body: raw}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestParseJSONArgs(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+	}{
+		{"", nil},
+		{"  ", nil},
+		{`1`, []string{`1`}},
+		{`{"a": 1} [2] "x" null`, []string{`{"a": 1}`, `[2]`, `"x"`, `null`}},
+		{`hello world`, []string{`"hello world"`}},
+		{`1 two`, []string{`"1 two"`}},
+		{`{"a": `, []string{`"{\"a\":"`}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, raw := range parseJSONArgs(tt.s) {
+			got = append(got, string(raw))
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestParseEventName(t *testing.T) {
+	tests := []struct {
+		s    string
+		name string
+		rest string
+		// the start of the error, if any
+		err string
+	}{
+		{"message", "message", "", ""},
+		{`chat {"text": "hi"}`, "chat", `{"text": "hi"}`, ""},
+		{`"chat message" 1 2`, "chat message", " 1 2", ""},
+		{`"a\"b"`, `a"b`, "", ""},
+		{"", "", "", "the name of the event is missing"},
+		{`"unterminated`, "", "", "invalid event name"},
+	}
+	for _, tt := range tests {
+		name, rest, err := parseEventName(tt.s)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.s, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || name != tt.name || rest != tt.rest {
+			t.Errorf("%q: got %q, %q and error %v, want %q and %q", tt.s, name, rest, err, tt.name, tt.rest)
+		}
+	}
+}
+
+func TestSocketIOSend(t *testing.T) {
+	tests := []struct {
+		msgs []string
+		// the frame sent for the last message, and its header
+		frame  string
+		header string
+		// the start of the error, if any
+		err string
+	}{
+		{msgs: []string{`emit chat {"text": "hi"}`}, frame: `42["chat",{"text":"hi"}]`},
+		{msgs: []string{`emit chat hello there`}, frame: `42["chat","hello there"]`},
+		{msgs: []string{`emit "chat message"`}, frame: `42["chat message"]`},
+		{msgs: []string{`emitack ping`, `emitack ping 1`}, frame: `422["ping",1]`, header: "[ack 2] "},
+		{msgs: []string{`ack 5 "ok"`}, frame: `435["ok"]`},
+		{msgs: []string{`ack 5`}, frame: `435[]`},
+		{msgs: []string{`join chat`}, frame: `40/chat,`},
+		{msgs: []string{`join /chat {"token": "x"}`, `emit hi`}, frame: `42/chat,["hi"]`},
+		{msgs: []string{`join /chat`, `leave`, `emit hi`}, frame: `42["hi"]`},
+		{msgs: []string{`join /chat`, `leave /other`}, frame: `41/other,`},
+		{msgs: []string{`40`}, frame: `40`},
+		{msgs: []string{`emit`}, err: "the name of the event is missing"},
+		{msgs: []string{`ack x`}, err: "usage: ack ID"},
+		{msgs: []string{`join`}, err: "usage: join NAMESPACE"},
+		{msgs: []string{`join /chat [1]`}, err: "the Socket.IO auth payload must be a JSON object"},
+	}
+	for _, tt := range tests {
+		layer, err := newSocketIO(SettingsBase{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frames []WsMsg
+		var header string
+		for _, msg := range tt.msgs {
+			frames, header, err = layer.Send(msg)
+		}
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.msgs, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.msgs, err)
+			continue
+		}
+		if len(frames) != 1 || string(frames[0].Msg) != tt.frame || header != tt.header {
+			t.Errorf("%q: got %q and header %q, want %s and %q", tt.msgs, frames, header, tt.frame, tt.header)
+		}
+	}
+}
+
+func TestSocketIOReceive(t *testing.T) {
+	tests := []struct {
+		frame   string
+		header  string
+		body    string
+		info    string
+		err     string
+		replies []string
+	}{
+		{frame: `0{"sid":"abc","pingInterval":25000}`, info: "Engine.IO session abc opened (ping interval 25000ms)", replies: []string{"40"}},
+		{frame: `2`, replies: []string{"3"}},
+		{frame: `2probe`, replies: []string{"3probe"}},
+		{frame: `3`},
+		{frame: `1`, info: "Engine.IO session closed by the server"},
+		{frame: `40{"sid":"x1"}`, info: "Connected to namespace / (sid x1)"},
+		{frame: `40/chat,{"sid":"x2"}`, info: "Connected to namespace /chat (sid x2)"},
+		{frame: `41/chat,`, info: "Disconnected from namespace /chat"},
+		{frame: `42["message",{"text":"hi"}]`, header: "[event message] ", body: `{"text":"hi"}`},
+		{frame: `42/chat,["message","a","b"]`, header: "[/chat event message] ", body: `["a","b"]`},
+		{frame: `4212["ping"]`, header: "[event ping, ack 12] ", body: ``},
+		{frame: `437["ok"]`, header: "[ack 7] ", body: `"ok"`},
+		{frame: `44{"message":"not authorized"}`, err: "namespace /: connection refused: not authorized"},
+		{frame: `42[]`, err: "invalid Socket.IO event", body: `42[]`},
+		{frame: `43x`, err: "invalid Socket.IO ack", body: `43x`},
+		{frame: `451-["upload",{"_placeholder":true,"num":0}]`, info: "Binary Socket.IO packets are not supported", body: `451-["upload",{"_placeholder":true,"num":0}]`},
+		{frame: `hello`, body: `hello`},
+	}
+	for _, tt := range tests {
+		layer, err := newSocketIO(SettingsBase{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := layer.Receive(WsMsg{Type: websocket.TextMessage, Msg: []byte(tt.frame)})
+		var errText string
+		if res.Err != nil {
+			errText = res.Err.Error()
+		}
+		var replies []string
+		for _, r := range res.Replies {
+			replies = append(replies, string(r.Msg))
+		}
+		if res.Header != tt.header || string(res.Body) != tt.body || res.Info != tt.info || errText != tt.err || !reflect.DeepEqual(replies, tt.replies) {
+			t.Errorf("%s: got header %q, body %q, info %q, error %q and replies %q", tt.frame, res.Header, res.Body, res.Info, errText, replies)
+		}
+	}
+}
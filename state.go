@@ -2,7 +2,7 @@ package main
 
 import (
 	"bytes"
-	"encoding/hex"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
@@ -18,11 +18,34 @@ import (
 
 // State is the central function managing the information of claws.
 type State struct {
+	// last value of {{seq}} in templates; accessed atomically, it must be
+	// the first field for alignment on 32-bit platforms
+	templateSeq int64
+
 	// important to running the application as a whole
 	ActionIndex       int
 	Mode              UIMode
 	ConnectionStarted time.Time
 	wsConn            WebSocket
+	// URL of the current connection, as in the settings, used to keep the
+	// history of each endpoint; guarded by layerLock
+	endpoint string
+	// reverse search through the history, when active
+	search *historySearch
+	// message waiting for the values of its prompts, and the last values
+	// typed for each prompt
+	pending      *pendingMessage
+	promptValues map[string]string
+	// rules matching the messages received
+	watches watchList
+	// protocol spoken over the current connection, if any
+	layer     protocolLayer
+	layerLock sync.Mutex
+	// connection options used instead of those in the settings when
+	// connecting using a profile, which are never saved, and the binary
+	// decoder chosen for the current endpoint, if any; guarded by layerLock
+	options *ConnectionOptions
+	decoder *decoderChoice
 
 	Writer     io.Writer
 	writerLock sync.RWMutex
@@ -39,18 +62,36 @@ type State struct {
 	Settings Settings
 }
 
-// PushAction adds an action to LastActions
+// PushAction adds an action to the history of the current mode.
 func (s *State) PushAction(act string) error {
-	return s.Settings.PushAction(act)
+	return s.Settings.PushAction(s.historyKey(), act)
+}
+
+// historyKey returns the key in Settings.History of the history of the
+// current mode: the URL of the connection when sending messages, and
+// "mode:" followed by the name of the mode for the commands of the other
+// modes, such as "mode:CON" for the URLs typed when connecting.
+func (s *State) historyKey() string {
+	if s.Mode == modeInsert || s.Mode == modeOverwrite {
+		return s.currentEndpoint()
+	}
+	return "mode:" + modeChars[s.Mode].Descr
+}
+
+// Actions returns the history of the current mode, most recent first.
+func (s *State) Actions() []string {
+	s.Settings.RLock()
+	defer s.Settings.RUnlock()
+	return cloneStrings(s.Settings.History[s.historyKey()])
 }
 
 // BrowseActions changes the ActionIndex and returns the value at the specified index.
 // move is the number of elements to move (negatives go into more recent history,
 // 0 returns the current element, positives go into older history)
 func (s *State) BrowseActions(move int) string {
-	oSet := s.Settings.Clone()
+	actions := s.Actions()
 
-	nActions := len(oSet.LastActions)
+	nActions := len(actions)
 	s.ActionIndex += move
 	if s.ActionIndex >= nActions {
 		s.ActionIndex = nActions - 1
@@ -63,10 +104,11 @@ func (s *State) BrowseActions(move int) string {
 		return ""
 	}
 
-	return oSet.LastActions[s.ActionIndex]
+	return actions[s.ActionIndex]
 }
 
-// StartConnection begins a WebSocket connection to url.
+// StartConnection begins a WebSocket connection to url. If url is in the form
+// @NAME, the profile with the given name is used.
 func (s *State) StartConnection(url string) {
 	var err error
 	defer func() {
@@ -76,7 +118,12 @@ func (s *State) StartConnection(url string) {
 	}()
 
 	url = strings.TrimSpace(url)
-	if len(url) > 0 {
+	if strings.HasPrefix(url, "@") {
+		if err = s.UseProfile(url[1:]); err != nil {
+			return
+		}
+	} else if len(url) > 0 {
+		s.setOptions(nil)
 		s.Settings.LastWebsocketURL = url
 		s.Settings.Update("LastWebsocketURL")
 	}
@@ -99,26 +146,241 @@ func (s *State) StartConnection(url string) {
 		}
 	}
 
-	oSet := s.Settings.Clone()
-	sErrs := s.wsConn.WsOpen(
-		s.Settings.LastWebsocketURL,
-		oSet.PingSeconds,
-		fnWsReadmsg,
-	)
+	s.setEndpoint(s.Settings.Clone().LastWebsocketURL)
+	oSet := s.connSettings()
+	endpoint := oSet.LastWebsocketURL
+	if err = interpolateSettings(&oSet); err != nil {
+		return
+	}
+	opts, err := oSet.WsOptions()
+	if err != nil {
+		return
+	}
+	layer, err := newProtocolLayer(oSet)
+	if err != nil {
+		return
+	}
+	url = oSet.LastWebsocketURL
+	if layer != nil {
+		if url, err = layer.URL(url); err != nil {
+			return
+		}
+		if ls, ok := layer.(layerSubprotocols); ok && len(opts.Subprotocols) == 0 {
+			opts.Subprotocols = ls.Subprotocols()
+		}
+	}
+	s.setLayer(layer)
+
+	opts.DisplayURL = endpoint
+	sErrs := s.wsConn.WsOpen(url, opts, fnWsReadmsg)
 	for _, err := range sErrs {
 		s.PrintError(err)
 	}
 
 	s.ConnectionStarted = time.Now()
+
+	if len(sErrs) == 0 {
+		if layer != nil {
+			frames, err := layer.Open()
+			if err != nil {
+				s.PrintError(err)
+				return
+			}
+			s.writeFrames(frames)
+		}
+		for _, msg := range oSet.OnConnect {
+			s.SendMessage(msg)
+		}
+	}
+}
+
+// UseProfile uses the URL and the connection options of the profile with the
+// given name for the next connections, until a URL is connected to. Only the
+// URL is saved to the settings.
+func (s *State) UseProfile(name string) error {
+	oSet := s.Settings.Clone()
+	if err := oSet.ApplyProfile(name); err != nil {
+		return err
+	}
+	s.setOptions(&oSet.ConnectionOptions)
+
+	s.PrintDebug("Using profile " + name)
+	s.Settings.Lock()
+	s.Settings.LastWebsocketURL = oSet.LastWebsocketURL
+	s.Settings.Unlock()
+	return s.Settings.Update("LastWebsocketURL")
+}
+
+// SaveProfile saves the current connection settings as the profile with the
+// given name.
+func (s *State) SaveProfile(name string) error {
+	oSet := s.connSettings()
+	if err := oSet.SaveProfile(name); err != nil {
+		return err
+	}
+
+	s.Settings.Lock()
+	if s.Settings.Profiles == nil {
+		s.Settings.Profiles = make(map[string]Profile)
+	}
+	s.Settings.Profiles[name] = oSet.Profiles[name]
+	s.Settings.Unlock()
+	return s.Settings.Update("Profiles")
+}
+
+func (s *State) setOptions(opts *ConnectionOptions) {
+	s.layerLock.Lock()
+	defer s.layerLock.Unlock()
+	s.options = opts
+}
+
+// connSettings returns a copy of the settings, with the connection options
+// of the profile in use, if any.
+func (s *State) connSettings() SettingsBase {
+	oSet := s.Settings.Clone()
+	s.layerLock.Lock()
+	defer s.layerLock.Unlock()
+	if s.options != nil {
+		oSet.ConnectionOptions = s.options.Clone()
+	}
+	if d := s.decoder; d != nil {
+		oSet.BinaryDecoder = d.name
+		oSet.Protobuf.DescriptorSet, oSet.Protobuf.Message = d.descriptorSet, d.message
+	}
+	return oSet
+}
+
+// setOption changes connection options using fn: those of the profile in
+// use, only for the current session, or those in the settings, saving the
+// given fields.
+func (s *State) setOption(fn func(o *ConnectionOptions), fields ...string) error {
+	s.layerLock.Lock()
+	if s.options != nil {
+		fn(s.options)
+		s.layerLock.Unlock()
+		return nil
+	}
+	s.layerLock.Unlock()
+
+	s.Settings.Lock()
+	fn(&s.Settings.ConnectionOptions)
+	s.Settings.Unlock()
+	return s.Settings.Update(fields...)
 }
 
 func (s *State) SetPingInterval(nSecs int) {
-	s.Settings.PingSeconds = nSecs
-	s.Settings.Update("PingSeconds")
+	s.setOption(func(o *ConnectionOptions) {
+		o.PingSeconds = nSecs
+	}, "PingSeconds")
 
 	s.wsConn.SetPingInterval(nSecs)
 }
 
+// decoderChoice is a binary decoder chosen by the user, with the Protobuf
+// schema, if any.
+type decoderChoice struct {
+	name          string
+	descriptorSet string
+	message       string
+}
+
+// setEndpoint sets the URL of the current connection. The binary decoder
+// chosen is kept only while connecting to the same endpoint.
+func (s *State) setEndpoint(endpoint string) {
+	s.layerLock.Lock()
+	defer s.layerLock.Unlock()
+	if s.endpoint != "" && endpoint != s.endpoint {
+		s.decoder = nil
+	}
+	s.endpoint = endpoint
+}
+
+func (s *State) currentEndpoint() string {
+	s.layerLock.Lock()
+	defer s.layerLock.Unlock()
+	return s.endpoint
+}
+
+func (s *State) setDecoder(d *decoderChoice) {
+	s.layerLock.Lock()
+	defer s.layerLock.Unlock()
+	s.decoder = d
+}
+
+// SetBinaryDecoder sets the decoder used for binary messages received from
+// the current endpoint, without saving it to the settings. For protobuf, args
+// can contain the descriptor set and the message name, or only the message
+// name; if empty, messages are decoded without a schema.
+func (s *State) SetBinaryDecoder(name string, args []string) {
+	oSet := s.connSettings()
+	d := &decoderChoice{
+		name:          name,
+		descriptorSet: oSet.Protobuf.DescriptorSet,
+		message:       oSet.Protobuf.Message,
+	}
+	if name == "protobuf" {
+		switch len(args) {
+		case 0:
+			d.message = ""
+		case 1:
+			d.message = args[0]
+		default:
+			d.descriptorSet = args[0]
+			d.message = args[1]
+		}
+	}
+	s.setDecoder(d)
+}
+
+// SetBinaryEncoder sets the encoder used for sent messages. For protobuf,
+// args can contain the descriptor set and the message name, or only the
+// message name.
+func (s *State) SetBinaryEncoder(name string, args []string) {
+	s.setOption(func(o *ConnectionOptions) {
+		o.BinaryEncoder = name
+		if name == "protobuf" {
+			switch len(args) {
+			case 0:
+			case 1:
+				o.Protobuf.SendMessage = args[0]
+			default:
+				o.Protobuf.DescriptorSet = args[0]
+				o.Protobuf.SendMessage = args[1]
+			}
+		}
+	}, "BinaryEncoder", "Protobuf")
+}
+
+// SendMessage sends msg to the WebSocket and prints it, encoding it if a
+// binary encoder is set.
+func (s *State) SendMessage(msg string) {
+	if layer := s.currentLayer(); layer != nil {
+		frames, header, err := layer.Send(msg)
+		if err != nil {
+			s.PrintError(err)
+			return
+		}
+		s.PrintEncodedFromUser(msg, header)
+		s.writeFrames(frames)
+		return
+	}
+
+	oSet := s.connSettings()
+	if enc, ok := binaryEncoders[oSet.BinaryEncoder]; ok {
+		data, err := enc([]byte(msg), oSet)
+		if err != nil {
+			s.PrintError(err)
+			return
+		}
+		s.PrintEncodedFromUser(msg, fmt.Sprintf("[%s, %d bytes] ", oSet.BinaryEncoder, len(data)))
+		s.WsSendBinary(data)
+		return
+	}
+
+	s.PrintFromUser(msg)
+	s.WsSendMsg(msg)
+}
+
 func (s *State) WsSendMsg(msg string) bool {
 	return s.wsConn.Write(WsMsg{
 		Type: websocket.TextMessage,
@@ -126,6 +388,13 @@ func (s *State) WsSendMsg(msg string) bool {
 	})
 }
 
+func (s *State) WsSendBinary(msg []byte) bool {
+	return s.wsConn.Write(WsMsg{
+		Type: websocket.BinaryMessage,
+		Msg:  msg,
+	})
+}
+
 type WsInfo struct {
 	IsOpen   bool
 	Url      string
@@ -136,7 +405,7 @@ func (s *State) GetWsInfo() WsInfo {
 	return WsInfo{
 		IsOpen:   s.wsConn.IsOpen(),
 		Url:      s.wsConn.URL(),
-		Settings: s.Settings.Clone(),
+		Settings: s.connSettings(),
 	}
 }
 
@@ -144,6 +413,20 @@ func (s *State) WsClose() []error {
 	return s.wsConn.WsClose()
 }
 
+// PrintStats prints the statistics of the current connection.
+func (s *State) PrintStats() {
+	stats := s.wsConn.Stats()
+	if stats == nil {
+		s.PrintDebug("Not connected")
+		return
+	}
+	str := stats.String()
+	if stats.Compression {
+		str += " permessage-deflate enabled."
+	}
+	s.PrintDebug(str)
+}
+
 var (
 	printDebug  = color.New(color.FgCyan).Fprint
 	printError  = color.New(color.FgRed).Fprint
@@ -165,7 +448,13 @@ func (s *State) PrintError(x error) {
 
 // prints user-provided messages to the Writer, using green.
 func (s *State) PrintFromUser(x string) {
-	oSet := s.Settings.Clone()
+	s.PrintEncodedFromUser(x, "")
+}
+
+// prints user-provided messages which are sent after being encoded, prefixed
+// by header, which describes the encoding.
+func (s *State) PrintEncodedFromUser(x string, header string) {
+	oSet := s.connSettings()
 
 	res, err := s.pipe([]byte(x), "out", oSet.Pipe.Out)
 	if err != nil {
@@ -175,7 +464,7 @@ func (s *State) PrintFromUser(x string) {
 		}
 	}
 
-	s.printToOut(string(res), s.getTimestamp("=>"), true, printUser)
+	s.printToOut(header+formatText(res, oSet), s.getTimestamp("=>"), true, printUser)
 }
 
 // prints server-returned messages to the Writer, using white.
@@ -194,7 +483,56 @@ func (s *State) PrintFromPeer(msg WsMsg) {
 
 	// TODO: cmdline flags for HTTP headers to send with websocket connect
 	// TODO: persistent pipes?
-	oSet := s.Settings.Clone()
+	oSet := s.connSettings()
+
+	// decompression is done before piping, so that pipes receive the
+	// actual message
+	var header string
+	if msg.Type == websocket.BinaryMessage {
+		var err error
+		msg.Msg, header, err = decompressMessage(msg.Msg, oSet)
+		if err != nil {
+			s.PrintError(err)
+		}
+	}
+
+	layer := s.currentLayer()
+	if layer == nil {
+		s.printPeerMessage(msg, header, oSet)
+		return
+	}
+	res := layer.Receive(msg)
+	for _, r := range append([]layerResult{res}, res.Next...) {
+		s.writeFrames(r.Replies)
+		if r.Info != "" {
+			s.PrintDebug(r.Info)
+		}
+		if r.Err != nil {
+			s.PrintError(r.Err)
+		}
+		if r.Heartbeat > 0 {
+			s.startHeartbeat(layer, r.Heartbeat, r.HeartbeatFrame)
+		}
+		if r.Body == nil {
+			continue
+		}
+		shown := WsMsg{Type: msg.Type, Msg: r.Body}
+		if r.Type != 0 {
+			shown.Type = r.Type
+		}
+		s.printPeerMessage(shown, header+r.Header, oSet)
+	}
+}
+
+// printPeerMessage prints a message received, after running the watch rules
+// and the input pipe.
+func (s *State) printPeerMessage(msg WsMsg, header string, oSet SettingsBase) {
+	matches := s.watches.match(msg.Msg)
+	fnPrint := printServer
+	if len(matches) > 0 {
+		fnPrint = printMatch
+	}
+
 	res, err := s.pipe(msg.Msg, "in", oSet.Pipe.In)
 	if err != nil {
 		s.PrintError(err)
@@ -203,19 +541,10 @@ func (s *State) PrintFromPeer(msg WsMsg) {
 		}
 	}
 
-	var szText string
-	switch msg.Type {
-	case websocket.BinaryMessage:
-		szText = strings.TrimSuffix(hex.Dump(res), "\n")
-
-	case websocket.TextMessage:
-		if oSet.JSONFormatting {
-			res = attemptJSONFormatting(res)
-		}
-		szText = strings.TrimSuffix(string(res), "\n")
+	s.printToOut(header+formatMessage(res, msg.Type, oSet), s.getTimestamp("<="), true, fnPrint)
+	if len(matches) > 0 {
+		s.runWatches(msg.Msg, matches)
 	}
-
-	s.printToOut(szText, s.getTimestamp("<="), true, printServer)
 }
 
 // getTimestamp returns the settings' timestamp,
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// stomp speaks STOMP 1.0 to 1.2. Each WebSocket message contains a frame:
+// the command, the headers, an empty line and the body, terminated by a NUL
+// byte. The client connects with CONNECT, negotiating the version and the
+// heart-beats; the user types commands, which are translated into frames:
+//
+//	subscribe DESTINATION [HEADER:VALUE...]        subscribe, acking automatically
+//	unsubscribe ID|DESTINATION                      remove a subscription
+//	send DESTINATION [HEADER:VALUE...] [BODY]       send a message
+//	ack ID, nack ID                                 (n)ack a message received
+//	disconnect                                      disconnect gracefully
+//
+// Frames typed in full, starting with their command in upper case, are sent
+// as they are.
+type stomp struct {
+	mu sync.Mutex
+
+	login, passcode string
+	host            string
+	heartBeat       string
+
+	// version negotiated, or "" until the server sends CONNECTED
+	version string
+	subs    []stompSubscription
+	lastSub int
+	// description of the frames whose receipt is awaited, by receipt ID
+	receipts    map[string]string
+	lastReceipt int
+	// subscriptions of the messages to ack, by message ID, for STOMP 1.0
+	// and 1.1, where ACK must specify it
+	toAck map[string]string
+}
+
+type stompSubscription struct {
+	ID          string
+	Destination string
+	// ack mode: auto, client or client-individual
+	Ack string
+}
+
+// stompDefaultHeartBeat is the heart-beat requested to the server when it
+// isn't set: a heart-beat every 10 seconds, in both directions.
+const stompDefaultHeartBeat = "10000,10000"
+
+// stompMaxToAck is the maximum number of messages waiting to be acked which
+// are remembered.
+const stompMaxToAck = 1000
+
+func newSTOMP(oSet SettingsBase) (protocolLayer, error) {
+	hb := oSet.STOMP.HeartBeat
+	if hb == "" {
+		hb = stompDefaultHeartBeat
+	}
+	if _, _, err := parseHeartBeat(hb); err != nil {
+		return nil, err
+	}
+	return &stomp{
+		login:     oSet.STOMP.Login,
+		passcode:  oSet.STOMP.Passcode,
+		host:      oSet.STOMP.Host,
+		heartBeat: hb,
+		receipts:  make(map[string]string),
+		toAck:     make(map[string]string),
+	}, nil
+}
+
+// parseHeartBeat parses the value of a heart-beat header, "CX,CY", where CX
+// and CY are intervals in milliseconds.
+func parseHeartBeat(s string) (cx, cy time.Duration, err error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid STOMP heart-beat %q: use SEND_MS,RECEIVE_MS", s)
+	}
+	var ms [2]int
+	for i, p := range parts {
+		if ms[i], err = strconv.Atoi(strings.TrimSpace(p)); err != nil || ms[i] < 0 {
+			return 0, 0, fmt.Errorf("invalid STOMP heart-beat %q: use SEND_MS,RECEIVE_MS", s)
+		}
+	}
+	return time.Duration(ms[0]) * time.Millisecond, time.Duration(ms[1]) * time.Millisecond, nil
+}
+
+// URL uses the host of the URL as the virtual host, unless it is set.
+func (st *stomp) URL(u string) (string, error) {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	st.mu.Lock()
+	if st.host == "" {
+		st.host = pu.Hostname()
+	}
+	st.mu.Unlock()
+	return u, nil
+}
+
+// Subprotocols returns the subprotocols of the versions of STOMP supported.
+func (st *stomp) Subprotocols() []string {
+	return []string{"v12.stomp", "v11.stomp", "v10.stomp"}
+}
+
+// Open connects to the server.
+func (st *stomp) Open() ([]WsMsg, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	headers := [][2]string{
+		{"accept-version", "1.0,1.1,1.2"},
+		{"host", st.host},
+		{"heart-beat", st.heartBeat},
+	}
+	if st.login != "" {
+		headers = append(headers, [2]string{"login", st.login})
+	}
+	if st.passcode != "" {
+		headers = append(headers, [2]string{"passcode", st.passcode})
+	}
+	return []WsMsg{st.frame("CONNECT", headers, nil)}, nil
+}
+
+// stompFrame returns a frame. The values of the headers are escaped if escape
+// is set, except in CONNECT frames.
+func stompFrame(command string, headers [][2]string, body []byte, escape bool) WsMsg {
+	var sb strings.Builder
+	sb.WriteString(command)
+	sb.WriteByte('\n')
+	for _, h := range headers {
+		if !escape || command == "CONNECT" {
+			sb.WriteString(h[0] + ":" + h[1] + "\n")
+			continue
+		}
+		sb.WriteString(stompEscaper.Replace(h[0]) + ":" + stompEscaper.Replace(h[1]) + "\n")
+	}
+	sb.WriteByte('\n')
+	sb.Write(body)
+	sb.WriteByte(0)
+	return textFrame(sb.String())
+}
+
+// frame returns a frame to send, escaping its headers unless the version
+// negotiated is 1.0, which has no escapes.
+func (st *stomp) frame(command string, headers [][2]string, body []byte) WsMsg {
+	return stompFrame(command, headers, body, st.version != "1.0")
+}
+
+var (
+	stompEscaper   = strings.NewReplacer(`\`, `\\`, "\r", `\r`, "\n", `\n`, ":", `\c`)
+	stompUnescaper = strings.NewReplacer(`\\`, `\`, `\r`, "\r", `\n`, "\n", `\c`, ":")
+)
+
+// stompCommandRe matches the command of a frame typed in full.
+var stompCommandRe = regexp.MustCompile(`^[A-Z]+$`)
+
+// stompHeaderRe matches the headers typed before the body of a message.
+var stompHeaderRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]*:\S*$`)
+
+// parseSTOMPHeaders splits the headers at the start of s, written as
+// NAME:VALUE, from the rest of s.
+func parseSTOMPHeaders(s string) (headers [][2]string, rest string) {
+	rest = strings.TrimSpace(s)
+	for rest != "" {
+		field, after := parsePlaceholder(rest)
+		if !stompHeaderRe.MatchString(field) {
+			break
+		}
+		i := strings.IndexByte(field, ':')
+		headers = append(headers, [2]string{field[:i], field[i+1:]})
+		rest = after
+	}
+	return headers, rest
+}
+
+// setDefaultHeader adds a header to headers, unless it is already there.
+func setDefaultHeader(headers [][2]string, name, value string) [][2]string {
+	for _, h := range headers {
+		if h[0] == name {
+			return headers
+		}
+	}
+	return append(headers, [2]string{name, value})
+}
+
+func headerValue(headers [][2]string, name string) string {
+	for _, h := range headers {
+		if h[0] == name {
+			return h[1]
+		}
+	}
+	return ""
+}
+
+// receipt returns a new receipt ID, for a frame described by desc.
+func (st *stomp) receipt(desc string) string {
+	st.lastReceipt++
+	id := "rcpt-" + strconv.Itoa(st.lastReceipt)
+	st.receipts[id] = desc
+	return id
+}
+
+func (st *stomp) Send(msg string) ([]WsMsg, string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	cmd, arg := parsePlaceholder(msg)
+	switch cmd {
+	case "subscribe":
+		dest, rest := parsePlaceholder(arg)
+		if dest == "" {
+			return nil, "", errors.New("usage: subscribe DESTINATION [HEADER:VALUE...]")
+		}
+		headers, rest := parseSTOMPHeaders(rest)
+		if rest != "" {
+			return nil, "", fmt.Errorf("invalid header %q: use NAME:VALUE", rest)
+		}
+		st.lastSub++
+		headers = append([][2]string{{"destination", dest}}, headers...)
+		headers = setDefaultHeader(headers, "id", "sub-"+strconv.Itoa(st.lastSub))
+		headers = setDefaultHeader(headers, "ack", "auto")
+		sub := stompSubscription{
+			ID:          headerValue(headers, "id"),
+			Destination: dest,
+			Ack:         headerValue(headers, "ack"),
+		}
+		headers = append(headers, [2]string{"receipt", st.receipt("subscription " + sub.ID + " to " + dest)})
+		st.subs = append(st.subs, sub)
+		return []WsMsg{st.frame("SUBSCRIBE", headers, nil)}, "[" + sub.ID + "] ", nil
+	case "unsubscribe":
+		for i, sub := range st.subs {
+			if arg != sub.ID && arg != sub.Destination {
+				continue
+			}
+			st.subs = append(st.subs[:i], st.subs[i+1:]...)
+			headers := [][2]string{
+				{"id", sub.ID},
+				{"receipt", st.receipt("removal of subscription " + sub.ID)},
+			}
+			return []WsMsg{st.frame("UNSUBSCRIBE", headers, nil)}, "", nil
+		}
+		return nil, "", fmt.Errorf("no subscription with ID or destination %q", arg)
+	case "send":
+		dest, rest := parsePlaceholder(arg)
+		if dest == "" {
+			return nil, "", errors.New("usage: send DESTINATION [HEADER:VALUE...] [BODY]")
+		}
+		headers, body := parseSTOMPHeaders(rest)
+		headers = append([][2]string{{"destination", dest}}, headers...)
+		if body != "" && json.Valid([]byte(body)) && (body[0] == '{' || body[0] == '[') {
+			headers = setDefaultHeader(headers, "content-type", "application/json")
+		}
+		headers = setDefaultHeader(headers, "content-length", strconv.Itoa(len(body)))
+		return []WsMsg{st.frame("SEND", headers, []byte(body))}, "", nil
+	case "ack", "nack":
+		if arg == "" || strings.ContainsAny(arg, " \t") {
+			return nil, "", fmt.Errorf("usage: %s ID", cmd)
+		}
+		if cmd == "nack" && st.version == "1.0" {
+			return nil, "", errors.New("NACK is not supported by STOMP 1.0")
+		}
+		var headers [][2]string
+		if st.version == "1.2" {
+			headers = [][2]string{{"id", arg}}
+		} else {
+			headers = [][2]string{{"message-id", arg}}
+			if sub := st.toAck[arg]; sub != "" {
+				headers = append(headers, [2]string{"subscription", sub})
+			}
+		}
+		delete(st.toAck, arg)
+		return []WsMsg{st.frame(strings.ToUpper(cmd), headers, nil)}, "", nil
+	case "disconnect":
+		headers := [][2]string{{"receipt", st.receipt("disconnection")}}
+		return []WsMsg{st.frame("DISCONNECT", headers, nil)}, "", nil
+	}
+
+	if line, _, _ := strings.Cut(msg, "\n"); stompCommandRe.MatchString(strings.TrimSpace(line)) {
+		frame := msg
+		if !strings.Contains(frame, "\n\n") {
+			frame = strings.TrimRight(frame, "\n") + "\n\n"
+		}
+		if !strings.HasSuffix(frame, "\x00") {
+			frame += "\x00"
+		}
+		return []WsMsg{textFrame(frame)}, "", nil
+	}
+	return nil, "", fmt.Errorf("unknown STOMP command %q; use subscribe, unsubscribe, send, ack, nack, disconnect, or type a frame", cmd)
+}
+
+// parseSTOMPFrame parses a frame, returning its command, headers and body.
+// The values of the headers are unescaped if unescape is set, except in
+// CONNECTED frames.
+func parseSTOMPFrame(data []byte, unescape bool) (command string, headers [][2]string, body []byte, err error) {
+	// heart-beats can precede the frame
+	data = bytes.TrimLeft(data, "\r\n")
+	// the headers end at the first empty line, whose lines can end with
+	// either LF or CRLF
+	var head, line []byte
+	for pos := 0; ; pos += len(line) + 1 {
+		i := bytes.IndexByte(data[pos:], '\n')
+		if i < 0 {
+			return "", nil, nil, errors.New("invalid STOMP frame: the end of the headers is missing")
+		}
+		line = data[pos : pos+i]
+		if len(line) == 0 || string(line) == "\r" {
+			// without the end of the last header
+			head = bytes.TrimSuffix(bytes.TrimSuffix(data[:pos], []byte("\n")), []byte("\r"))
+			body = data[pos+i+1:]
+			break
+		}
+	}
+	lines := strings.Split(strings.ReplaceAll(string(head), "\r\n", "\n"), "\n")
+	command = lines[0]
+	for _, line := range lines[1:] {
+		i := strings.IndexByte(line, ':')
+		if i < 0 {
+			return "", nil, nil, fmt.Errorf("invalid STOMP header %q", line)
+		}
+		name, value := line[:i], line[i+1:]
+		if unescape && command != "CONNECTED" {
+			name, value = stompUnescaper.Replace(name), stompUnescaper.Replace(value)
+		}
+		headers = append(headers, [2]string{name, value})
+	}
+
+	if n, err := strconv.Atoi(headerValue(headers, "content-length")); err == nil && n >= 0 && n <= len(body) {
+		body = body[:n]
+	} else if i := bytes.IndexByte(body, 0); i >= 0 {
+		body = body[:i]
+	}
+	return command, headers, body, nil
+}
+
+// formatSTOMPHeaders returns the command and the headers of a frame, as
+// shown before its body.
+func formatSTOMPHeaders(command string, headers [][2]string) string {
+	var sb strings.Builder
+	sb.WriteString("[" + command)
+	sep := " "
+	for _, h := range headers {
+		if h[0] == "content-length" {
+			continue
+		}
+		sb.WriteString(sep + h[0] + ": " + h[1])
+		sep = ", "
+	}
+	return sb.String() + "] "
+}
+
+func (st *stomp) Receive(msg WsMsg) layerResult {
+	if msg.Type != websocket.TextMessage && msg.Type != websocket.BinaryMessage {
+		return layerResult{Body: msg.Msg}
+	}
+	if len(bytes.Trim(msg.Msg, "\r\n")) == 0 {
+		// heart-beats are hidden
+		return layerResult{}
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	command, headers, body, err := parseSTOMPFrame(msg.Msg, st.version != "1.0")
+	if err != nil {
+		return layerResult{Err: err, Body: msg.Msg}
+	}
+
+	switch command {
+	case "CONNECTED":
+		return st.connected(headers)
+	case "MESSAGE":
+		if ack := headerValue(headers, "ack"); ack == "" && st.version != "1.2" {
+			st.rememberAck(headerValue(headers, "message-id"), headerValue(headers, "subscription"))
+		}
+		return layerResult{Header: formatSTOMPHeaders(command, headers), Body: body}
+	case "RECEIPT":
+		id := headerValue(headers, "receipt-id")
+		desc, ok := st.receipts[id]
+		if !ok {
+			return layerResult{Info: "STOMP receipt " + id}
+		}
+		delete(st.receipts, id)
+		return layerResult{Info: "STOMP receipt for the " + desc}
+	case "ERROR":
+		text := headerValue(headers, "message")
+		if text == "" {
+			text = string(bytes.TrimSpace(body))
+		}
+		res := layerResult{Err: errors.New("STOMP error: " + text)}
+		if len(bytes.TrimSpace(body)) > 0 {
+			res.Header, res.Body = formatSTOMPHeaders(command, headers), body
+		}
+		return res
+	}
+	return layerResult{Header: formatSTOMPHeaders(command, headers), Body: body}
+}
+
+// connected handles the CONNECTED frame, negotiating the heart-beats: the
+// client sends them at the larger of the interval it offered and the one the
+// server asked for, if both are set.
+func (st *stomp) connected(headers [][2]string) layerResult {
+	st.version = headerValue(headers, "version")
+	if st.version == "" {
+		st.version = "1.0"
+	}
+	info := "Connected to STOMP " + st.version
+	if server := headerValue(headers, "server"); server != "" {
+		info += " server " + server
+	}
+
+	var res layerResult
+	cx, _, _ := parseHeartBeat(st.heartBeat)
+	_, sy, err := parseHeartBeat(headerValue(headers, "heart-beat"))
+	if err == nil && cx > 0 && sy > 0 {
+		if sy > cx {
+			cx = sy
+		}
+		res.Heartbeat, res.HeartbeatFrame = cx, textFrame("\n")
+		info += fmt.Sprintf(" (heart-beat every %v)", cx)
+	}
+	res.Info = info
+	return res
+}
+
+// rememberAck remembers the subscription of a message, if it must be acked.
+func (st *stomp) rememberAck(messageID, subID string) {
+	for _, sub := range st.subs {
+		if sub.ID != subID || sub.Ack == "auto" {
+			continue
+		}
+		if len(st.toAck) >= stompMaxToAck {
+			for id := range st.toAck {
+				delete(st.toAck, id)
+				break
+			}
+		}
+		st.toAck[messageID] = subID
+		return
+	}
+}
+
+// Status lists the active subscriptions.
+func (st *stomp) Status() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if len(st.subs) == 0 {
+		return "STOMP: no subscriptions"
+	}
+	dests := make([]string, len(st.subs))
+	for i, sub := range st.subs {
+		dests[i] = sub.Destination
+	}
+	sort.Strings(dests)
+	return fmt.Sprintf("STOMP: %d subscription(s): %s", len(dests), strings.Join(dests, ", "))
+}
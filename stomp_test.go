@@ -0,0 +1,174 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSTOMPHeaderEscaping(t *testing.T) {
+	tests := []struct {
+		command string
+		headers [][2]string
+		// the headers as written in the frame
+		raw string
+	}{
+		{"SEND", [][2]string{{"destination", "/queue/a"}}, "SEND\ndestination:/queue/a\n\n\x00"},
+		{"SEND", [][2]string{{"key", "a:b"}}, "SEND\nkey:a\\cb\n\n\x00"},
+		{"SEND", [][2]string{{"key", "line\nbreak\r"}}, "SEND\nkey:line\\nbreak\\r\n\n\x00"},
+		{"SEND", [][2]string{{"key", `back\slash`}}, "SEND\nkey:back\\\\slash\n\n\x00"},
+		{"SEND", [][2]string{{"a:b", `\c`}}, "SEND\na\\cb:\\\\c\n\n\x00"},
+		// the headers of CONNECT and CONNECTED frames are not escaped
+		{"CONNECT", [][2]string{{"passcode", `p\c`}}, "CONNECT\npasscode:p\\c\n\n\x00"},
+	}
+	for _, tt := range tests {
+		frame := stompFrame(tt.command, tt.headers, nil, true)
+		if got := string(frame.Msg); got != tt.raw {
+			t.Errorf("%v: got frame %q, want %q", tt.headers, got, tt.raw)
+		}
+		if tt.command == "CONNECT" {
+			continue
+		}
+		command, headers, body, err := parseSTOMPFrame(frame.Msg, true)
+		if err != nil {
+			t.Errorf("%v: %v", tt.headers, err)
+			continue
+		}
+		if command != tt.command || !reflect.DeepEqual(headers, tt.headers) || len(body) != 0 {
+			t.Errorf("%v: parsed as %s %v %q", tt.headers, command, headers, body)
+		}
+	}
+}
+
+func TestSTOMP10HeadersNotEscaped(t *testing.T) {
+	frame := stompFrame("SEND", [][2]string{{"key", `a:b\c`}}, nil, false)
+	if got, want := string(frame.Msg), "SEND\nkey:a:b\\c\n\n\x00"; got != want {
+		t.Errorf("got frame %q, want %q", got, want)
+	}
+}
+
+func TestParseSTOMPFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		command string
+		headers [][2]string
+		body    string
+		wantErr bool
+		// STOMP 1.0, without escapes
+		v10 bool
+	}{
+		{
+			name:    "body up to the NUL",
+			data:    "MESSAGE\ndestination:/topic/a\n\nhello\x00\n",
+			command: "MESSAGE",
+			headers: [][2]string{{"destination", "/topic/a"}},
+			body:    "hello",
+		},
+		{
+			name:    "content-length with NUL in the body",
+			data:    "MESSAGE\ncontent-length:5\n\na\x00b\x00c\x00",
+			command: "MESSAGE",
+			headers: [][2]string{{"content-length", "5"}},
+			body:    "a\x00b\x00c",
+		},
+		{
+			name:    "content-length shorter than the body",
+			data:    "MESSAGE\ncontent-length:2\n\nabc\x00",
+			command: "MESSAGE",
+			headers: [][2]string{{"content-length", "2"}},
+			body:    "ab",
+		},
+		{
+			name:    "content-length longer than the frame",
+			data:    "MESSAGE\ncontent-length:99\n\nabc\x00",
+			command: "MESSAGE",
+			headers: [][2]string{{"content-length", "99"}},
+			body:    "abc",
+		},
+		{
+			name:    "heart-beats and CRLF",
+			data:    "\n\r\nRECEIPT\r\nreceipt-id:1\r\n\r\n\x00",
+			command: "RECEIPT",
+			headers: [][2]string{{"receipt-id", "1"}},
+			body:    "",
+		},
+		{
+			name:    "CONNECTED headers are not unescaped",
+			data:    "CONNECTED\nserver:a\\cb\n\n\x00",
+			command: "CONNECTED",
+			headers: [][2]string{{"server", `a\cb`}},
+			body:    "",
+		},
+		{
+			name:    "CRLF headers with LF LF in the body",
+			data:    "MESSAGE\r\ndestination:/a\r\n\r\nx\n\ny\x00",
+			command: "MESSAGE",
+			headers: [][2]string{{"destination", "/a"}},
+			body:    "x\n\ny",
+		},
+		{
+			name:    "LF headers with CRLF CRLF in the body",
+			data:    "MESSAGE\ndestination:/a\n\nx\r\n\r\ny\x00",
+			command: "MESSAGE",
+			headers: [][2]string{{"destination", "/a"}},
+			body:    "x\r\n\r\ny",
+		},
+		{
+			name:    "LF then CRLF",
+			data:    "MESSAGE\ndestination:/a\r\n\r\nx\x00",
+			command: "MESSAGE",
+			headers: [][2]string{{"destination", "/a"}},
+			body:    "x",
+		},
+		{
+			name:    "STOMP 1.0 headers are not unescaped",
+			data:    "MESSAGE\ndestination:/a\\cb\n\n\x00",
+			command: "MESSAGE",
+			headers: [][2]string{{"destination", `/a\cb`}},
+			body:    "",
+			v10:     true,
+		},
+		{
+			name:    "end of the headers missing",
+			data:    "MESSAGE\ndestination:/a\n",
+			wantErr: true,
+		},
+		{
+			name:    "invalid header",
+			data:    "MESSAGE\nno colon\n\n\x00",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		command, headers, body, err := parseSTOMPFrame([]byte(tt.data), !tt.v10)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if tt.wantErr {
+			continue
+		}
+		if command != tt.command || !reflect.DeepEqual(headers, tt.headers) || string(body) != tt.body {
+			t.Errorf("%s: got %s %v %q, want %s %v %q", tt.name, command, headers, body, tt.command, tt.headers, tt.body)
+		}
+	}
+}
+
+func TestParseSTOMPHeaders(t *testing.T) {
+	tests := []struct {
+		s       string
+		headers [][2]string
+		rest    string
+	}{
+		{"/queue/a", nil, "/queue/a"},
+		{"persistent:true priority:9 hello world", [][2]string{{"persistent", "true"}, {"priority", "9"}}, "hello world"},
+		{"a:b", [][2]string{{"a", "b"}}, ""},
+		{`{"a":1}`, nil, `{"a":1}`},
+	}
+	for _, tt := range tests {
+		headers, rest := parseSTOMPHeaders(tt.s)
+		if !reflect.DeepEqual(headers, tt.headers) || rest != tt.rest {
+			t.Errorf("%q: got %v and %q, want %v and %q", tt.s, headers, rest, tt.headers, tt.rest)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jroimartin/gocui"
+)
+
+// Messages can contain placeholders in the form {{NAME ARGS...}}, which are
+// replaced when they are sent:
+//
+//	{{uuid}}          a random UUID (version 4)
+//	{{now}}           the current time, in RFC 3339 format
+//	{{now unix}}      the current Unix time, in seconds (unixms: milliseconds)
+//	{{now LAYOUT}}    the current time, in the given Go layout
+//	{{seq}}           a number increased for each message using it
+//	{{env.NAME}}      the value of an environment variable
+//	{{random A B}}    a random integer between A and B, inclusive
+//	{{prompt NAME}}   a value typed by the user before sending the message
+//	{{var.NAME}}      a variable captured by claws test
+//
+// Text between {{ and }} which is not a placeholder is left unchanged, and
+// \{{ is replaced with a literal {{, so that placeholders can be sent as they
+// are.
+
+// templateExpander replaces the placeholders in messages.
+type templateExpander struct {
+	// returns the next value of {{seq}}
+	seq func() int64
+	// values of {{prompt NAME}} and {{var.NAME}}
+	prompts map[string]string
+	vars    map[string]string
+}
+
+// expand replaces the placeholders in text.
+func (te *templateExpander) expand(text string) (string, error) {
+	var res strings.Builder
+	var seq string
+	for {
+		start, end, ok := nextPlaceholder(text)
+		if !ok {
+			res.WriteString(text)
+			return res.String(), nil
+		}
+		if escapedPlaceholder(text, start) {
+			res.WriteString(text[:start-1] + "{{")
+			text = text[start+2:]
+			continue
+		}
+		res.WriteString(text[:start])
+
+		name, args := parsePlaceholder(text[start+2 : end])
+		var val string
+		var err error
+		switch {
+		case name == "uuid":
+			val, err = newUUID()
+		case name == "now":
+			val = formatNow(args)
+		case name == "seq":
+			// all the occurrences in a message have the same value
+			if seq == "" {
+				seq = strconv.FormatInt(te.seq(), 10)
+			}
+			val = seq
+		case strings.HasPrefix(name, "env."):
+			var ok bool
+			if val, ok = os.LookupEnv(name[4:]); !ok {
+				err = errors.New("environment variable is not set")
+			}
+		case strings.HasPrefix(name, "var.") && te.vars != nil:
+			var ok bool
+			if val, ok = te.vars[name[4:]]; !ok {
+				err = errors.New("variable has not been captured")
+			}
+		case name == "random":
+			val, err = randomInt(args)
+		case name == "prompt" && args != "":
+			val = te.prompts[args]
+		default:
+			val = text[start : end+2]
+		}
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", text[start:end+2], err)
+		}
+		res.WriteString(val)
+		text = text[end+2:]
+	}
+}
+
+// nextPlaceholder returns the position of the next {{ in text and of the }}
+// closing it.
+func nextPlaceholder(text string) (start, end int, ok bool) {
+	start = strings.Index(text, "{{")
+	if start < 0 {
+		return 0, 0, false
+	}
+	end = strings.Index(text[start+2:], "}}")
+	if end < 0 {
+		return 0, 0, false
+	}
+	return start, start + 2 + end, true
+}
+
+// escapedPlaceholder reports whether the {{ at start in text is preceded by a
+// backslash, which makes it literal.
+func escapedPlaceholder(text string, start int) bool {
+	return start > 0 && text[start-1] == '\\'
+}
+
+// parsePlaceholder splits the text inside {{ }} into the name of the
+// placeholder and its arguments.
+func parsePlaceholder(s string) (name, args string) {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexAny(s, " \t"); i >= 0 {
+		return s[:i], strings.TrimSpace(s[i:])
+	}
+	return s, ""
+}
+
+// templatePrompts returns the names of the {{prompt NAME}} placeholders in
+// text, in order of appearance and without duplicates.
+func templatePrompts(text string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	for {
+		start, end, ok := nextPlaceholder(text)
+		if !ok {
+			return names
+		}
+		if escapedPlaceholder(text, start) {
+			text = text[start+2:]
+			continue
+		}
+		name, args := parsePlaceholder(text[start+2 : end])
+		if name == "prompt" && args != "" && !seen[args] {
+			seen[args] = true
+			names = append(names, args)
+		}
+		text = text[end+2:]
+	}
+}
+
+func newUUID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func formatNow(layout string) string {
+	now := time.Now()
+	switch layout {
+	case "":
+		return now.Format(time.RFC3339)
+	case "unix":
+		return strconv.FormatInt(now.Unix(), 10)
+	case "unixms":
+		return strconv.FormatInt(now.UnixNano()/int64(time.Millisecond), 10)
+	}
+	return now.Format(layout)
+}
+
+func randomInt(args string) (string, error) {
+	fields := strings.Fields(args)
+	if len(fields) != 2 {
+		return "", errors.New("expected two integers")
+	}
+	min, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	max, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return "", err
+	}
+	if max < min {
+		return "", errors.New("the maximum is lower than the minimum")
+	}
+	// max-min+1 may not fit in an int64
+	bound := new(big.Int).Sub(big.NewInt(max), big.NewInt(min))
+	n, err := rand.Int(rand.Reader, bound.Add(bound, big.NewInt(1)))
+	if err != nil {
+		return "", err
+	}
+	return n.Add(n, big.NewInt(min)).String(), nil
+}
+
+// TemplateNames returns the names of the templates, sorted.
+func (s *SettingsBase) TemplateNames() []string {
+	names := make([]string, 0, len(s.Templates))
+	for name := range s.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Template returns the text of the template with the given name.
+func (s *SettingsBase) Template(name string) (string, error) {
+	text, ok := s.Templates[name]
+	if !ok {
+		if len(s.Templates) == 0 {
+			return "", fmt.Errorf("template %q does not exist; no templates have been saved", name)
+		}
+		return "", fmt.Errorf("template %q does not exist; available templates: %s", name, strings.Join(s.TemplateNames(), ", "))
+	}
+	return text, nil
+}
+
+// SaveTemplate saves text as the template with the given name.
+func (s *SettingsBase) SaveTemplate(name, text string) error {
+	if name == "" || strings.ContainsAny(name, " \t") {
+		return errors.New("template names must not be empty or contain spaces")
+	}
+	if s.Templates == nil {
+		s.Templates = make(map[string]string)
+	}
+	s.Templates[name] = text
+	return nil
+}
+
+// pendingMessage is a message waiting for the user to type the values of its
+// {{prompt NAME}} placeholders.
+type pendingMessage struct {
+	text    string
+	prompts []string
+	values  map[string]string
+}
+
+// SendTemplate sends msg, replacing its placeholders. If msg is in the form
+// @NAME, the template with the given name is sent. If the message contains
+// prompts, the user is asked for their values first (see SetPromptValue).
+func (s *State) SendTemplate(msg string) {
+	msg = s.resolveTemplate(msg)
+	if prompts := templatePrompts(msg); len(prompts) > 0 {
+		s.pending = &pendingMessage{
+			text:    msg,
+			prompts: prompts,
+			values:  make(map[string]string, len(prompts)),
+		}
+		s.promptNext()
+		return
+	}
+	s.sendExpanded(msg, nil)
+}
+
+// promptNext asks for the value of the next prompt of the pending message,
+// suggesting the last value which was typed.
+func (s *State) promptNext() {
+	p := s.pending
+	name := p.prompts[len(p.values)]
+	s.Mode = modePrompt
+	s.PrintDebug(fmt.Sprintf("Value of %s (%d/%d):", name, len(p.values)+1, len(p.prompts)))
+	if last := s.promptValues[name]; last != "" {
+		s.ExecuteFunc(func(g *gocui.Gui) error {
+			if v, err := g.View("cmd"); err == nil {
+				setText(v, last)
+			}
+			return nil
+		})
+	}
+}
+
+// SetPromptValue sets the value of the current prompt of the pending message,
+// which is sent once all the values have been typed.
+func (s *State) SetPromptValue(val string) {
+	p := s.pending
+	if p == nil {
+		s.Mode = modeInsert
+		return
+	}
+	name := p.prompts[len(p.values)]
+	p.values[name] = val
+	if s.promptValues == nil {
+		s.promptValues = make(map[string]string)
+	}
+	s.promptValues[name] = val
+	if len(p.values) < len(p.prompts) {
+		s.promptNext()
+		return
+	}
+
+	s.pending = nil
+	s.Mode = modeInsert
+	s.sendExpanded(p.text, p.values)
+}
+
+// CancelPending discards the message waiting for the values of its prompts.
+func (s *State) CancelPending() {
+	if s.pending != nil {
+		s.pending = nil
+		s.PrintDebug("Message not sent.")
+	}
+}
+
+// resolveTemplate returns the text of the template NAME if msg is in the form
+// @NAME, or msg.
+func (s *State) resolveTemplate(msg string) string {
+	if name := strings.TrimSpace(msg); strings.HasPrefix(name, "@") {
+		oSet := s.Settings.Clone()
+		if text, ok := oSet.Templates[name[1:]]; ok {
+			return text
+		}
+	}
+	return msg
+}
+
+// expander returns the templateExpander used for the messages sent.
+func (s *State) expander() templateExpander {
+	return templateExpander{
+		seq: func() int64 {
+			return atomic.AddInt64(&s.templateSeq, 1)
+		},
+	}
+}
+
+// expandMessage replaces the placeholders in msg.
+func (s *State) expandMessage(msg string, prompts map[string]string) (string, error) {
+	te := s.expander()
+	te.prompts = prompts
+	return te.expand(msg)
+}
+
+func (s *State) sendExpanded(msg string, prompts map[string]string) {
+	msg, err := s.expandMessage(msg, prompts)
+	if err != nil {
+		s.PrintError(err)
+		return
+	}
+	s.SendMessage(msg)
+}
+
+// SaveTemplate saves the last message sent to the current connection as the
+// template with the given name.
+func (s *State) SaveTemplate(name string) error {
+	endpoint := s.currentEndpoint()
+	s.Settings.Lock()
+	var err error
+	if actions := s.Settings.History[endpoint]; len(actions) == 0 {
+		err = errors.New("no messages have been sent to this connection yet")
+	} else {
+		text := actions[0]
+		// @NAME sends the template NAME
+		if ref := strings.TrimSpace(text); strings.HasPrefix(ref, "@") {
+			if t, ok := s.Settings.Templates[ref[1:]]; ok {
+				text = t
+			} else if t, ok := s.Settings.local.templates[ref[1:]]; ok {
+				text = t
+			}
+		}
+		err = s.Settings.SaveTemplate(name, text)
+	}
+	s.Settings.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.Settings.Update("Templates")
+}
+
+// DeleteTemplate deletes the template with the given name.
+func (s *State) DeleteTemplate(name string) error {
+	s.Settings.Lock()
+	_, ok := s.Settings.Templates[name]
+	delete(s.Settings.Templates, name)
+	_, isLocal := s.Settings.local.templates[name]
+	s.Settings.Unlock()
+	if !ok && isLocal {
+		return fmt.Errorf("template %q is defined in %s and can't be deleted", name, localConfigName)
+	}
+	if !ok {
+		return fmt.Errorf("template %q does not exist", name)
+	}
+
+	return s.Settings.Update("Templates")
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestExpander returns a templateExpander whose {{seq}} starts from 1.
+func newTestExpander() *templateExpander {
+	var n int64
+	return &templateExpander{seq: func() int64 {
+		n++
+		return n
+	}}
+}
+
+func TestTemplateExpand(t *testing.T) {
+	t.Setenv("CLAWS_TEST_NAME", "claws")
+	tests := []struct {
+		text string
+		want string
+		// the start of the error, if any
+		err string
+	}{
+		{"no placeholders", "no placeholders", ""},
+		{`{"id": {{seq}}, "again": {{seq}}}`, `{"id": 1, "again": 1}`, ""},
+		{"hello {{env.CLAWS_TEST_NAME}}!", "hello claws!", ""},
+		{"{{ env.CLAWS_TEST_NAME }}", "claws", ""},
+		{"{{env.CLAWS_TEST_UNSET}}", "", "{{env.CLAWS_TEST_UNSET}}: environment variable is not set"},
+		{"{{random 5 5}}", "5", ""},
+		{"{{random -7 -7}}", "-7", ""},
+		{"{{random 2 1}}", "", "{{random 2 1}}: the maximum is lower than the minimum"},
+		{"{{random 1}}", "", "{{random 1}}: expected two integers"},
+		{"{{random a 1}}", "", "{{random a 1}}: "},
+		{"{{host}}:{{prompt port}}", "{{host}}:80", ""},
+		{"{{prompt}} {{ }} {{unknown x}}", "{{prompt}} {{ }} {{unknown x}}", ""},
+		{"{{seq", "{{seq", ""},
+		{"}}{{seq}}}}", "}}1}}", ""},
+		{`\{{seq}} {{seq}}`, "{{seq}} 1", ""},
+		{`{"tpl": "\{{env.CLAWS_TEST_UNSET}}"}`, `{"tpl": "{{env.CLAWS_TEST_UNSET}}"}`, ""},
+		{`\{{`, `\{{`, ""},
+	}
+	for _, tt := range tests {
+		te := newTestExpander()
+		te.prompts = map[string]string{"port": "80"}
+		got, err := te.expand(tt.text)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.text, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.text, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateSeq(t *testing.T) {
+	te := newTestExpander()
+	for i := 1; i <= 3; i++ {
+		got, err := te.expand("{{seq}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := strconv.Itoa(i); got != want {
+			t.Errorf("message %d: got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestTemplateUUID(t *testing.T) {
+	uuidRe := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	got, err := newTestExpander().expand("{{uuid}} {{uuid}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uuids := strings.Fields(got)
+	if len(uuids) != 2 || !uuidRe.MatchString(uuids[0]) || !uuidRe.MatchString(uuids[1]) {
+		t.Fatalf("got %q, want two version 4 UUIDs", got)
+	}
+	if uuids[0] == uuids[1] {
+		t.Errorf("got the same UUID twice: %s", uuids[0])
+	}
+}
+
+func TestTemplateRandom(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 1000; i++ {
+		got, err := newTestExpander().expand("{{random -2 2}}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.ParseInt(got, 10, 64)
+		if err != nil || n < -2 || n > 2 {
+			t.Fatalf("got %q, want an integer between -2 and 2", got)
+		}
+		seen[n] = true
+	}
+	if len(seen) != 5 {
+		t.Errorf("got the values %v in 1000 tries, want all the ones between -2 and 2", seen)
+	}
+}
+
+func TestTemplateRandomEdges(t *testing.T) {
+	tests := []struct {
+		text     string
+		min, max int64
+	}{
+		{"{{random -1 9223372036854775807}}", -1, math.MaxInt64},
+		{"{{random -9223372036854775808 9223372036854775807}}", math.MinInt64, math.MaxInt64},
+		{"{{random -9223372036854775808 -9223372036854775808}}", math.MinInt64, math.MinInt64},
+		{"{{random 9223372036854775807 9223372036854775807}}", math.MaxInt64, math.MaxInt64},
+		{"{{random 9223372036854775806 9223372036854775807}}", math.MaxInt64 - 1, math.MaxInt64},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			got, err := newTestExpander().expand(tt.text)
+			if err != nil {
+				t.Fatalf("%s: %v", tt.text, err)
+			}
+			if n, err := strconv.ParseInt(got, 10, 64); err != nil || n < tt.min || n > tt.max {
+				t.Fatalf("%s: got %q, want an integer between %d and %d", tt.text, got, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestTemplateNow(t *testing.T) {
+	before := time.Now().Unix()
+	got, err := newTestExpander().expand("{{now unix}}|{{now 2006}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix, year, _ := strings.Cut(got, "|")
+	if n, err := strconv.ParseInt(unix, 10, 64); err != nil || n < before || n > time.Now().Unix() {
+		t.Errorf("got Unix time %q, want the current time", unix)
+	}
+	if want := time.Now().Format("2006"); year != want {
+		t.Errorf("got year %q, want %q", year, want)
+	}
+}
+
+func TestTemplatePrompts(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"no prompts {{seq}}", nil},
+		{"{{prompt host}}:{{prompt port}}/{{prompt host}}", []string{"host", "port"}},
+		{"{{prompt}} {{ prompt  user }}", []string{"user"}},
+		{`\{{prompt host}} {{prompt port}}`, []string{"port"}},
+	}
+	for _, tt := range tests {
+		if got := templatePrompts(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,701 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// claws test runs test files, made of steps which send messages and check
+// the messages received, one per line:
+//
+//	# comment
+//	url wss://example.com/ws
+//	test login
+//	send {"op":"login","user":"{{env.USER}}"}
+//	expect json {"ok":true}
+//	capture token .data.token
+//	expect_within 2s regex ^pong
+//	sleep 500ms
+//	expect_close 1008
+//
+// Each test opens a new connection; the steps before the first test belong
+// to a test named after the file. The steps of a test stop at the first one
+// which fails.
+
+const testHelpPrefix = `COMMAND
+
+  claws test [OPTION...] FILE...
+
+Runs the tests in the given files, printing the result of each step, and
+exits with a non-zero status if any of them fails. The connection options
+are taken from the configuration file, the profile and the flags, like for
+the interactive client.
+
+OPTIONS
+
+`
+
+// testMatchers are the ways of matching the messages received.
+var testMatchers = map[string]bool{
+	"exact":  true,
+	"regex":  true,
+	"json":   true,
+	"schema": true,
+}
+
+// testCase is a test in a test file.
+type testCase struct {
+	name  string
+	file  string
+	url   string
+	steps []testStep
+}
+
+// testStep is a step of a test.
+type testStep struct {
+	line int
+	// the step, as written in the file
+	text string
+	kind string
+	arg  string
+	// for expect and expect_within
+	matcher string
+	timeout time.Duration
+	schema  interface{}
+	// for expect_close; -1 if any code is accepted
+	code int
+	// for capture
+	name string
+	path []interface{}
+}
+
+func (s testStep) String() string {
+	return s.text
+}
+
+// parseTestFile parses the tests in file.
+func parseTestFile(file string) ([]*testCase, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cases []*testCase
+	var cur *testCase
+	var url string
+	base := filepath.Base(file)
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		kind, arg := parsePlaceholder(line)
+		step := testStep{line: i + 1, text: line, kind: kind, arg: arg}
+		if err := parseTestStep(&step, filepath.Dir(file)); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", file, i+1, err)
+		}
+
+		switch kind {
+		case "url":
+			url = arg
+			if cur != nil {
+				cur.url = arg
+			}
+			continue
+		case "test":
+			cur = &testCase{name: arg, file: file, url: url}
+			cases = append(cases, cur)
+			continue
+		}
+		if cur == nil {
+			cur = &testCase{name: strings.TrimSuffix(base, filepath.Ext(base)), file: file, url: url}
+			cases = append(cases, cur)
+		}
+		cur.steps = append(cur.steps, step)
+	}
+	if len(cases) == 0 {
+		return nil, fmt.Errorf("%s: no tests", file)
+	}
+	return cases, nil
+}
+
+// parseTestStep parses the arguments of a step. dir is the directory of the
+// test file, which relative paths refer to.
+func parseTestStep(step *testStep, dir string) error {
+	arg := step.arg
+	switch step.kind {
+	case "url", "test":
+		if arg == "" {
+			return fmt.Errorf("%s: missing argument", step.kind)
+		}
+	case "send":
+	case "sleep":
+		d, err := time.ParseDuration(arg)
+		if err != nil {
+			return err
+		}
+		step.timeout = d
+	case "expect_within":
+		tok, rest := parsePlaceholder(arg)
+		d, err := time.ParseDuration(tok)
+		if err != nil {
+			return err
+		}
+		step.timeout, arg = d, rest
+		fallthrough
+	case "expect":
+		step.matcher = "exact"
+		if m, rest := parsePlaceholder(arg); testMatchers[m] {
+			step.matcher, arg = m, rest
+		}
+		step.arg = arg
+		switch step.matcher {
+		case "regex":
+			if !strings.Contains(arg, "{{") {
+				if _, err := regexp.Compile(arg); err != nil {
+					return err
+				}
+			}
+		case "schema":
+			data := []byte(arg)
+			if strings.HasPrefix(arg, "@") {
+				file := arg[1:]
+				if !filepath.IsAbs(file) {
+					file = filepath.Join(dir, file)
+				}
+				var err error
+				if data, err = os.ReadFile(file); err != nil {
+					return err
+				}
+			}
+			if err := json.Unmarshal(data, &step.schema); err != nil {
+				return fmt.Errorf("invalid schema: %w", err)
+			}
+		}
+	case "expect_close":
+		step.code = -1
+		if arg != "" {
+			code, err := strconv.Atoi(arg)
+			if err != nil {
+				return fmt.Errorf("invalid close code %q", arg)
+			}
+			step.code = code
+		}
+	case "capture":
+		name, path := parsePlaceholder(arg)
+		if name == "" {
+			return errors.New("capture: missing variable name")
+		}
+		if path == "" {
+			path = "."
+		}
+		var err error
+		step.name = name
+		if step.path, err = parseValuePath(path); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown step %q", step.kind)
+	}
+	return nil
+}
+
+// parseValuePath parses the path of a value in a JSON message, such as
+// .data.items[0].id, where . is the whole message.
+func parseValuePath(s string) ([]interface{}, error) {
+	if s == "." {
+		return nil, nil
+	}
+	var path []interface{}
+	for rest := s; rest != ""; {
+		switch rest[0] {
+		case '.':
+			rest = rest[1:]
+			i := strings.IndexAny(rest, ".[")
+			if i < 0 {
+				i = len(rest)
+			}
+			if i == 0 {
+				return nil, fmt.Errorf("invalid path %q", s)
+			}
+			path = append(path, rest[:i])
+			rest = rest[i:]
+		case '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid path %q", s)
+			}
+			n, err := strconv.Atoi(rest[1:end])
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid index in path %q", s)
+			}
+			path = append(path, n)
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path %q: it must start with . or [", s)
+		}
+	}
+	return path, nil
+}
+
+// lookupValue returns the value at the given path.
+func lookupValue(v interface{}, path []interface{}) (interface{}, error) {
+	for i, el := range path {
+		switch el := el.(type) {
+		case string:
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not an object", describePath(path[:i]))
+			}
+			if v, ok = obj[el]; !ok {
+				return nil, fmt.Errorf("%s does not exist", describePath(path[:i+1]))
+			}
+		case int:
+			arr, ok := v.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s is not an array", describePath(path[:i]))
+			}
+			if el >= len(arr) {
+				return nil, fmt.Errorf("%s does not exist", describePath(path[:i+1]))
+			}
+			v = arr[el]
+		}
+	}
+	return v, nil
+}
+
+// testConn is the connection of a test.
+type testConn struct {
+	ws     WebSocket
+	chMsgs chan WsMsg
+	// closed when the connection is closed, with the error reading from it
+	chClosed  chan struct{}
+	closeOnce sync.Once
+	err       error
+	// the last message received
+	last *WsMsg
+}
+
+func (c *testConn) open(url string, opts WsOptions) error {
+	c.chMsgs = make(chan WsMsg, 1024)
+	c.chClosed = make(chan struct{})
+	fnRdr := func(msg *WsMsg, err error) {
+		if err != nil {
+			c.closeOnce.Do(func() {
+				c.err = err
+				close(c.chClosed)
+			})
+			return
+		}
+		c.chMsgs <- *msg
+	}
+	if errs := c.ws.WsOpen(url, opts, fnRdr); len(errs) > 0 {
+		return errs[0]
+	}
+	return nil
+}
+
+// next returns the next message received, waiting for it up to timeout.
+func (c *testConn) next(timeout time.Duration) (WsMsg, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case msg := <-c.chMsgs:
+		return msg, nil
+	case <-c.chClosed:
+		// the messages received before closing come first
+		select {
+		case msg := <-c.chMsgs:
+			return msg, nil
+		default:
+		}
+		return WsMsg{}, fmt.Errorf("connection closed: %v", c.err)
+	case <-timer.C:
+		return WsMsg{}, fmt.Errorf("no message received within %v", timeout)
+	}
+}
+
+// waitClose waits up to timeout for the connection to be closed, and
+// returns the close code. Receiving messages before the connection is closed
+// is an error.
+func (c *testConn) waitClose(timeout time.Duration) (int, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	closed := false
+	select {
+	case <-c.chClosed:
+		closed = true
+	case <-timer.C:
+	}
+
+	// all the messages received before closing are queued by now
+	var msgs []WsMsg
+drain:
+	for len(msgs) < cap(c.chMsgs) {
+		select {
+		case msg := <-c.chMsgs:
+			msgs = append(msgs, msg)
+		default:
+			break drain
+		}
+	}
+	switch {
+	case len(msgs) == 1:
+		return 0, fmt.Errorf("unexpected message %s", quoteMessage(msgs[0].Msg))
+	case len(msgs) > 1:
+		return 0, fmt.Errorf("%d unexpected messages, the first being %s", len(msgs), quoteMessage(msgs[0].Msg))
+	case !closed:
+		return 0, fmt.Errorf("connection still open after %v", timeout)
+	}
+
+	var closeErr *websocket.CloseError
+	if errors.As(c.err, &closeErr) {
+		return closeErr.Code, nil
+	}
+	return websocket.CloseAbnormalClosure, nil
+}
+
+// quoteMessage quotes a message for errors, shortening it.
+func quoteMessage(msg []byte) string {
+	s := string(msg)
+	if len(s) > 200 {
+		s = s[:197] + "..."
+	}
+	return strconv.Quote(s)
+}
+
+// testRunner runs the tests.
+type testRunner struct {
+	oSet    SettingsBase
+	url     string
+	timeout time.Duration
+	junit   string
+	seq     int64
+}
+
+// testResult is the result of a test.
+type testResult struct {
+	tc      *testCase
+	failure string
+	elapsed time.Duration
+	// the results of the steps, as printed
+	log []string
+}
+
+// TestCommand runs `claws test`.
+func TestCommand(args []string) error {
+	var r testRunner
+	oSet, fs, profileURL, err := parseCommandFlags("claws test", testHelpPrefix, args, func(fs *flag.FlagSet) {
+		fs.StringVar(&r.url, "url", "", "WebSocket URL to run the tests against,\ninstead of the one in the test files.")
+		fs.DurationVar(&r.timeout, "timeout", 5*time.Second, "Time to wait for expected messages,\nunless expect_within is used.")
+		fs.StringVar(&r.junit, "junit", "", "Write a JUnit XML report to the given file.")
+	})
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: claws test [OPTION...] FILE...")
+	}
+	r.oSet = oSet
+	if r.url == "" {
+		r.url = profileURL
+	}
+
+	// all the files are parsed first, so that errors are reported before
+	// running any test
+	files := make([][]*testCase, fs.NArg())
+	for i, file := range fs.Args() {
+		if files[i], err = parseTestFile(file); err != nil {
+			return err
+		}
+	}
+
+	var results [][]testResult
+	total, failed := 0, 0
+	for _, cases := range files {
+		// variables are shared by the tests of a file
+		vars := make(map[string]string)
+		var res []testResult
+		for _, tc := range cases {
+			tr := r.runCase(tc, vars)
+			if tr.failure != "" {
+				failed++
+			}
+			res = append(res, tr)
+		}
+		total += len(cases)
+		results = append(results, res)
+	}
+
+	if r.junit != "" {
+		if err := writeJUnit(r.junit, results); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("\n%d tests, %d passed, %d failed\n", total, total-failed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d tests failed", failed)
+	}
+	return nil
+}
+
+// runCase runs a test, printing the result of each step.
+func (r *testRunner) runCase(tc *testCase, vars map[string]string) (res testResult) {
+	res.tc = tc
+	start := time.Now()
+	fmt.Printf("=== RUN   %s (%s)\n", tc.name, tc.file)
+	defer func() {
+		res.elapsed = time.Since(start)
+		status := "PASS"
+		if res.failure != "" {
+			status = "FAIL"
+		}
+		fmt.Printf("--- %s: %s (%.2fs)\n", status, tc.name, res.elapsed.Seconds())
+	}()
+	fnLog := func(status, text string) {
+		line := fmt.Sprintf("%-4s  %s", status, text)
+		fmt.Println("    " + line)
+		res.log = append(res.log, line)
+	}
+
+	var c testConn
+	if err := r.connect(&c, tc); err != nil {
+		res.failure = "connecting: " + err.Error()
+		fnLog("FAIL", res.failure)
+		return
+	}
+	defer c.ws.WsClose()
+
+	for _, step := range tc.steps {
+		pos := fmt.Sprintf("%s:%d: %s", filepath.Base(tc.file), step.line, step)
+		if res.failure != "" {
+			fnLog("skip", pos)
+			continue
+		}
+		stepStart := time.Now()
+		if err := r.runStep(&c, step, vars); err != nil {
+			res.failure = fmt.Sprintf("%s: %v", pos, err)
+			fnLog("FAIL", res.failure)
+			continue
+		}
+		fnLog("ok", fmt.Sprintf("%s (%v)", pos, time.Since(stepStart).Round(time.Microsecond)))
+	}
+	return
+}
+
+func (r *testRunner) connect(c *testConn, tc *testCase) error {
+	oSet := r.oSet.Clone()
+	oSet.LastWebsocketURL = tc.url
+	if r.url != "" {
+		oSet.LastWebsocketURL = r.url
+	}
+	if oSet.LastWebsocketURL == "" {
+		return errors.New("no URL; add a url line to the file, or use -url")
+	}
+	endpoint := oSet.LastWebsocketURL
+	if err := interpolateSettings(&oSet); err != nil {
+		return err
+	}
+	opts, err := oSet.WsOptions()
+	if err != nil {
+		return err
+	}
+	opts.DisplayURL = endpoint
+	return c.open(oSet.LastWebsocketURL, opts)
+}
+
+func (r *testRunner) runStep(c *testConn, step testStep, vars map[string]string) error {
+	te := templateExpander{
+		seq: func() int64 {
+			r.seq++
+			return r.seq
+		},
+		vars: vars,
+	}
+
+	switch step.kind {
+	case "send":
+		text, err := te.expand(step.arg)
+		if err != nil {
+			return err
+		}
+		if !c.ws.Write(WsMsg{Type: websocket.TextMessage, Msg: []byte(text)}) {
+			return errors.New("not connected")
+		}
+	case "sleep":
+		time.Sleep(step.timeout)
+	case "expect", "expect_within":
+		timeout := step.timeout
+		if timeout == 0 {
+			timeout = r.timeout
+		}
+		msg, err := c.next(timeout)
+		if err != nil {
+			return err
+		}
+		c.last = &msg
+		if err := matchMessage(step, msg.Msg, &te, vars); err != nil {
+			return fmt.Errorf("%v; received %s", err, quoteMessage(msg.Msg))
+		}
+	case "expect_close":
+		code, err := c.waitClose(r.timeout)
+		if err != nil {
+			return err
+		}
+		if step.code >= 0 && code != step.code {
+			return fmt.Errorf("closed with code %d, expected %d", code, step.code)
+		}
+	case "capture":
+		if c.last == nil {
+			return errors.New("no messages have been received")
+		}
+		var v interface{}
+		if err := json.Unmarshal(c.last.Msg, &v); err != nil {
+			if len(step.path) > 0 {
+				return fmt.Errorf("the last message is not valid JSON: %v", err)
+			}
+			// the whole message
+			vars[step.name] = string(c.last.Msg)
+			return nil
+		}
+		v, err := lookupValue(v, step.path)
+		if err != nil {
+			return err
+		}
+		if s, ok := v.(string); ok {
+			vars[step.name] = s
+		} else {
+			data, _ := json.Marshal(v)
+			vars[step.name] = string(data)
+		}
+	}
+	return nil
+}
+
+// matchMessage checks that msg matches the expectation of step. The named
+// groups of regular expressions are captured as variables.
+func matchMessage(step testStep, msg []byte, te *templateExpander, vars map[string]string) error {
+	if step.matcher == "schema" {
+		var v interface{}
+		if err := json.Unmarshal(msg, &v); err != nil {
+			return fmt.Errorf("not valid JSON: %v", err)
+		}
+		return validateSchema(nil, step.schema, v)
+	}
+
+	expected, err := te.expand(step.arg)
+	if err != nil {
+		return err
+	}
+	switch step.matcher {
+	case "regex":
+		re, err := regexp.Compile(expected)
+		if err != nil {
+			return err
+		}
+		m := re.FindSubmatch(msg)
+		if m == nil {
+			return fmt.Errorf("does not match %s", expected)
+		}
+		for i, name := range re.SubexpNames() {
+			if name != "" && m[i] != nil {
+				vars[name] = string(m[i])
+			}
+		}
+	case "json":
+		var exp, act interface{}
+		if err := json.Unmarshal([]byte(expected), &exp); err != nil {
+			return fmt.Errorf("the expected value is not valid JSON: %v", err)
+		}
+		if err := json.Unmarshal(msg, &act); err != nil {
+			return fmt.Errorf("not valid JSON: %v", err)
+		}
+		return jsonSubset(nil, exp, act)
+	default:
+		if string(msg) != expected {
+			return fmt.Errorf("expected %s", quoteMessage([]byte(expected)))
+		}
+	}
+	return nil
+}
+
+// JUnit XML report, as understood by most CI systems.
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Time     float64      `xml:"time,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// writeJUnit writes the results, by file, as a JUnit XML report.
+func writeJUnit(file string, results [][]testResult) error {
+	var suites junitSuites
+	for _, res := range results {
+		suite := junitSuite{Name: res[0].tc.file}
+		for _, tr := range res {
+			jc := junitCase{
+				Name:      tr.tc.name,
+				Classname: strings.TrimSuffix(filepath.Base(tr.tc.file), filepath.Ext(tr.tc.file)),
+				Time:      tr.elapsed.Seconds(),
+			}
+			// the failure contains the results of the steps
+			if log := strings.Join(tr.log, "\n"); tr.failure != "" {
+				jc.Failure = &junitFailure{Message: tr.failure, Text: log}
+				suite.Failures++
+			} else {
+				jc.SystemOut = log
+			}
+			suite.Cases = append(suite.Cases, jc)
+			suite.Time += jc.Time
+		}
+		suite.Tests = len(suite.Cases)
+		suites.Suites = append(suites.Suites, suite)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Time += suite.Time
+	}
+
+	data, err := xml.MarshalIndent(suites, "", "\t")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append([]byte(xml.Header), append(data, '\n')...), 0644)
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+)
+
+// parseUnixURL parses URLs in the form ws+unix://SOCKET:PATH (or wss+unix),
+// returning the URL to use for the WebSocket handshake and the path of the
+// Unix domain socket. ok is false if url is not in this form.
+//
+// For instance, ws+unix:///run/app.sock:/ws?a=b is converted into
+// ws://localhost/ws?a=b, connecting to /run/app.sock.
+func parseUnixURL(url string) (wsURL string, socket string, ok bool) {
+	scheme, rest, found := strings.Cut(url, "+unix://")
+	if !found || (scheme != "ws" && scheme != "wss") {
+		return "", "", false
+	}
+
+	socket, path, found := strings.Cut(rest, ":")
+	if !found || !strings.HasPrefix(path, "/") {
+		// no path, but there may be a query string
+		socket, path, _ = strings.Cut(rest, "?")
+		if path != "" {
+			path = "?" + path
+		}
+		path = "/" + path
+	}
+	return scheme + "://localhost" + path, socket, true
+}
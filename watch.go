@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/fatih/color"
+	"github.com/jroimartin/gocui"
+)
+
+// Watch rules match the messages received, which are highlighted, ringing
+// the terminal bell. They are written as
+//
+//	PATTERN [| ACTION]...
+//
+// where PATTERN is /REGEX/, a JSON path optionally compared to a value
+// (.status == error, .code != 0, .data.items[0] exists), or text contained
+// in the message, and the actions are:
+//
+//	once            remove the rule after the first match
+//	quiet           don't ring the bell
+//	run COMMAND...  run a command, with the message on its stdin
+//	reply MESSAGE   send a message, which can contain placeholders; the
+//	                named groups of regular expressions are {{var.NAME}}
+
+var printMatch = color.New(color.FgYellow, color.Bold).Fprint
+
+// watchRule is a rule matching the messages received.
+type watchRule struct {
+	ID   int
+	Spec string
+
+	// the pattern: a regular expression, a JSON path, or text
+	re       *regexp.Regexp
+	jsonPath bool
+	path     []interface{}
+	// "==", "!=", or "" if the value at the path must exist
+	op    string
+	value interface{}
+	text  string
+
+	once    bool
+	quiet   bool
+	command []string
+	reply   string
+}
+
+// parseWatchRule parses a rule, as described above.
+func parseWatchRule(spec string) (*watchRule, error) {
+	w := &watchRule{Spec: strings.TrimSpace(spec)}
+
+	pattern, actions := splitWatchRule(spec)
+	switch {
+	case pattern == "":
+		return nil, errors.New("the pattern is missing")
+	case len(pattern) > 1 && pattern[0] == '/' && pattern[len(pattern)-1] == '/':
+		re, err := regexp.Compile(pattern[1 : len(pattern)-1])
+		if err != nil {
+			return nil, err
+		}
+		w.re = re
+	case pattern[0] == '.' || pattern[0] == '[':
+		fields := strings.SplitN(pattern, " ", 3)
+		path, err := parseValuePath(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		w.jsonPath, w.path = true, path
+		switch {
+		case len(fields) == 1, len(fields) == 2 && fields[1] == "exists":
+		case len(fields) == 3 && (fields[1] == "==" || fields[1] == "!="):
+			w.op = fields[1]
+			// values which aren't JSON are strings
+			if err := json.Unmarshal([]byte(fields[2]), &w.value); err != nil {
+				w.value = fields[2]
+			}
+		default:
+			return nil, fmt.Errorf("invalid condition %q: use PATH, PATH == VALUE or PATH != VALUE", pattern)
+		}
+	default:
+		w.text = pattern
+	}
+
+	for _, action := range actions {
+		name, arg := parsePlaceholder(action)
+		switch name {
+		case "once":
+			w.once = true
+		case "quiet":
+			w.quiet = true
+		case "run":
+			if w.command = strings.Fields(arg); len(w.command) == 0 {
+				return nil, errors.New("run: the command is missing")
+			}
+		case "reply":
+			if arg == "" {
+				return nil, errors.New("reply: the message is missing")
+			}
+			w.reply = arg
+		default:
+			return nil, fmt.Errorf("unknown action %q; use once, quiet, run or reply", name)
+		}
+	}
+	return w, nil
+}
+
+// splitWatchRule splits a rule into its pattern and its actions, separated by
+// " | ". A regular expression ends at the first unescaped / followed by the
+// end of the rule or by " | ", so that it can contain " | ".
+func splitWatchRule(spec string) (pattern string, actions []string) {
+	if re := strings.TrimSpace(spec); strings.HasPrefix(re, "/") {
+		for i := 1; i < len(re); i++ {
+			switch re[i] {
+			case '\\':
+				i++
+			case '/':
+				if rest := re[i+1:]; rest == "" || strings.HasPrefix(rest, " | ") {
+					if rest != "" {
+						actions = strings.Split(rest, " | ")[1:]
+					}
+					return re[:i+1], actions
+				}
+			}
+		}
+	}
+	parts := strings.Split(spec, " | ")
+	return strings.TrimSpace(parts[0]), parts[1:]
+}
+
+// match reports whether msg matches the rule, returning the named groups of
+// the regular expression. decoded is the message decoded as JSON, or nil.
+func (w *watchRule) match(msg []byte, decoded interface{}) (map[string]string, bool) {
+	switch {
+	case w.re != nil:
+		m := w.re.FindSubmatch(msg)
+		if m == nil {
+			return nil, false
+		}
+		vars := make(map[string]string)
+		for i, name := range w.re.SubexpNames() {
+			if name != "" && m[i] != nil {
+				vars[name] = string(m[i])
+			}
+		}
+		return vars, true
+	case w.jsonPath:
+		if decoded == nil {
+			return nil, false
+		}
+		v, err := lookupValue(decoded, w.path)
+		if err != nil {
+			return nil, false
+		}
+		switch w.op {
+		case "==":
+			return nil, reflect.DeepEqual(v, w.value)
+		case "!=":
+			return nil, !reflect.DeepEqual(v, w.value)
+		}
+		return nil, true
+	}
+	return nil, bytes.Contains(msg, []byte(w.text))
+}
+
+// watchList contains the watch rules of the session.
+type watchList struct {
+	mu     sync.Mutex
+	rules  []*watchRule
+	lastID int
+}
+
+func (wl *watchList) add(w *watchRule) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	wl.lastID++
+	w.ID = wl.lastID
+	wl.rules = append(wl.rules, w)
+}
+
+// remove removes the rule with the given ID, or all of them if id is 0, and
+// returns the number of rules removed.
+func (wl *watchList) remove(id int) int {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if id == 0 {
+		n := len(wl.rules)
+		wl.rules = nil
+		return n
+	}
+	for i, w := range wl.rules {
+		if w.ID == id {
+			wl.rules = append(wl.rules[:i], wl.rules[i+1:]...)
+			return 1
+		}
+	}
+	return 0
+}
+
+func (wl *watchList) list() []*watchRule {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	return append([]*watchRule(nil), wl.rules...)
+}
+
+// watchMatch is a rule matching a message.
+type watchMatch struct {
+	rule *watchRule
+	vars map[string]string
+}
+
+// match returns the rules matching msg, removing those which are only used
+// once.
+func (wl *watchList) match(msg []byte) []watchMatch {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if len(wl.rules) == 0 {
+		return nil
+	}
+
+	var decoded interface{}
+	if json.Unmarshal(msg, &decoded) != nil {
+		decoded = nil
+	}
+	var matches []watchMatch
+	keep := wl.rules[:0]
+	for _, w := range wl.rules {
+		vars, ok := w.match(msg, decoded)
+		if ok {
+			matches = append(matches, watchMatch{w, vars})
+		}
+		if !ok || !w.once {
+			keep = append(keep, w)
+		}
+	}
+	for i := len(keep); i < len(wl.rules); i++ {
+		wl.rules[i] = nil
+	}
+	wl.rules = keep
+	return matches
+}
+
+// AddWatch adds a watch rule, as described by spec.
+func (s *State) AddWatch(spec string) (*watchRule, error) {
+	w, err := parseWatchRule(spec)
+	if err != nil {
+		return nil, err
+	}
+	s.watches.add(w)
+	return w, nil
+}
+
+// RemoveWatch removes the watch rule with the given ID, or all of them if id
+// is 0, and returns the number of rules removed.
+func (s *State) RemoveWatch(id int) int {
+	return s.watches.remove(id)
+}
+
+// PrintWatches prints the watch rules.
+func (s *State) PrintWatches() {
+	rules := s.watches.list()
+	if len(rules) == 0 {
+		s.PrintDebug("No watch rules.")
+		return
+	}
+	for _, w := range rules {
+		s.PrintDebug(fmt.Sprintf("Watch #%d: %s", w.ID, w.Spec))
+	}
+}
+
+// runWatches runs the actions of the rules matching a message received.
+func (s *State) runWatches(msg []byte, matches []watchMatch) {
+	bell := false
+	for _, m := range matches {
+		w := m.rule
+		str := fmt.Sprintf("Watch #%d matched: %s", w.ID, w.Spec)
+		if w.once {
+			str += " (removed)"
+		}
+		s.PrintDebug(str)
+		bell = bell || !w.quiet
+
+		if w.command != nil {
+			go s.runWatchCommand(w, msg)
+		}
+		if w.reply != "" {
+			te := s.expander()
+			te.vars = m.vars
+			reply, err := te.expand(w.reply)
+			if err != nil {
+				s.PrintError(fmt.Errorf("watch #%d: %w", w.ID, err))
+				continue
+			}
+			s.SendMessage(reply)
+		}
+	}
+	if bell {
+		// termbox owns the terminal, which may not be stdout
+		s.ExecuteFunc(func(*gocui.Gui) error {
+			ringBell()
+			return nil
+		})
+	}
+}
+
+// ringBell rings the bell of the terminal termbox draws on.
+func ringBell() {
+	name := "/dev/tty"
+	if runtime.GOOS == "windows" {
+		name = "CONOUT$"
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	f.WriteString("\a")
+	f.Close()
+}
+
+// runWatchCommand runs the command of a rule, printing its output.
+func (s *State) runWatchCommand(w *watchRule, msg []byte) {
+	c := exec.Command(w.command[0], w.command[1:]...)
+	c.Env = append(
+		os.Environ(),
+		"CLAWS_WATCH="+strconv.Itoa(w.ID),
+		"CLAWS_WS_URL="+s.wsConn.URL(),
+	)
+	c.Stdin = bytes.NewReader(msg)
+	out, err := c.Output()
+	if out := strings.TrimRight(string(out), "\n"); out != "" {
+		s.PrintDebug(fmt.Sprintf("Watch #%d: %s", w.ID, out))
+	}
+	if err != nil {
+		s.PrintError(fmt.Errorf("watch #%d: %s: %w", w.ID, w.command[0], err))
+	}
+}
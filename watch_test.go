@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseWatchRule(t *testing.T) {
+	tests := []struct {
+		spec string
+		// the pattern, as "re:REGEX", "path:OP VALUE" or "text:TEXT"
+		pattern string
+		once    bool
+		quiet   bool
+		command []string
+		reply   string
+		// the start of the error, if any
+		err string
+	}{
+		{spec: "error", pattern: "text:error"},
+		{spec: "  disk full  ", pattern: "text:disk full"},
+		{spec: "/^ERR (?P<code>\\d+)/", pattern: `re:^ERR (?P<code>\d+)`},
+		{spec: "/", pattern: "text:/"},
+		{spec: ".status == error", pattern: `path:== "error"`},
+		{spec: ".code != 0", pattern: "path:!= 0"},
+		{spec: ".ok == true", pattern: "path:== true"},
+		{spec: ".data.items[0]", pattern: "path: null"},
+		{spec: ".data exists", pattern: "path: null"},
+		{spec: "error | once | quiet", pattern: "text:error", once: true, quiet: true},
+		{spec: "alert | run notify-send claws alert", pattern: "text:alert", command: []string{"notify-send", "claws", "alert"}},
+		{spec: `/ping (?P<id>\d+)/ | reply {"pong": {{var.id}}}`, pattern: `re:ping (?P<id>\d+)`, reply: `{"pong": {{var.id}}}`},
+		{spec: "/a | b/ | once", pattern: "re:a | b", once: true},
+		{spec: `/x\/ | quiet/`, pattern: `re:x\/ | quiet`},
+		{spec: "", err: "the pattern is missing"},
+		{spec: " | once", err: "the pattern is missing"},
+		{spec: "/(/", err: "error parsing regexp"},
+		{spec: ".a..b", err: "invalid path"},
+		{spec: ".code > 1", err: "invalid condition"},
+		{spec: ".code ==", err: "invalid condition"},
+		{spec: "error | run", err: "run: the command is missing"},
+		{spec: "error | reply", err: "reply: the message is missing"},
+		{spec: "error | beep", err: `unknown action "beep"`},
+	}
+	for _, tt := range tests {
+		w, err := parseWatchRule(tt.spec)
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%q: got error %v, want %q", tt.spec, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.spec, err)
+			continue
+		}
+		var pattern string
+		switch {
+		case w.re != nil:
+			pattern = "re:" + w.re.String()
+		case w.jsonPath:
+			value, _ := json.Marshal(w.value)
+			pattern = "path:" + w.op + " " + string(value)
+		default:
+			pattern = "text:" + w.text
+		}
+		if pattern != tt.pattern || w.once != tt.once || w.quiet != tt.quiet ||
+			!reflect.DeepEqual(w.command, tt.command) || w.reply != tt.reply {
+			t.Errorf("%q: got %s once=%v quiet=%v run=%q reply=%q", tt.spec, pattern, w.once, w.quiet, w.command, w.reply)
+		}
+	}
+}
+
+func TestSplitWatchRule(t *testing.T) {
+	tests := []struct {
+		spec    string
+		pattern string
+		actions []string
+	}{
+		{"error", "error", nil},
+		{"error | once | run cat", "error", []string{"once", "run cat"}},
+		{"a|b", "a|b", nil},
+		{"/a|b/", "/a|b/", nil},
+		{"/a | b/", "/a | b/", nil},
+		{"/a | b/ | quiet", "/a | b/", []string{"quiet"}},
+		{"/a/b/ | once", "/a/b/", []string{"once"}},
+		{`/a\/ | b/ | once`, `/a\/ | b/`, []string{"once"}},
+		{"/a | b", "/a", []string{"b"}},
+		{"/unterminated", "/unterminated", nil},
+		{"  /a | b/ | once ", "/a | b/", []string{"once"}},
+		{" | once", "", []string{"once"}},
+	}
+	for _, tt := range tests {
+		pattern, actions := splitWatchRule(tt.spec)
+		if pattern != tt.pattern || len(actions) != len(tt.actions) || len(actions) > 0 && !reflect.DeepEqual(actions, tt.actions) {
+			t.Errorf("%q: got %q and %q, want %q and %q", tt.spec, pattern, actions, tt.pattern, tt.actions)
+		}
+	}
+}
+
+func TestWatchListMatch(t *testing.T) {
+	tests := []struct {
+		spec  string
+		msg   string
+		match bool
+		vars  map[string]string
+	}{
+		{"error", "an error occurred", true, nil},
+		{"error", "all good", false, nil},
+		{`/code=(?P<code>\d+)/`, "code=42 text=x", true, map[string]string{"code": "42"}},
+		{`/code=(?P<code>\d+)/`, "code=x", false, nil},
+		{".status == error", `{"status": "error"}`, true, nil},
+		{".status == error", `{"status": "ok"}`, false, nil},
+		{".status == error", `status error`, false, nil},
+		{".code != 0", `{"code": 3}`, true, nil},
+		{".code != 0", `{"code": 0}`, false, nil},
+		{".code != 0", `{}`, false, nil},
+		{".items[1].id == 7", `{"items": [{}, {"id": 7}]}`, true, nil},
+		{".items[1] exists", `{"items": [1]}`, false, nil},
+		{".items[1] exists", `{"items": [1, null]}`, true, nil},
+	}
+	for _, tt := range tests {
+		w, err := parseWatchRule(tt.spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wl watchList
+		wl.add(w)
+		matches := wl.match([]byte(tt.msg))
+		if (len(matches) == 1) != tt.match {
+			t.Errorf("%q on %q: got %d matches", tt.spec, tt.msg, len(matches))
+			continue
+		}
+		if tt.vars != nil && !reflect.DeepEqual(matches[0].vars, tt.vars) {
+			t.Errorf("%q on %q: got variables %v, want %v", tt.spec, tt.msg, matches[0].vars, tt.vars)
+		}
+	}
+}
+
+func TestWatchListOnce(t *testing.T) {
+	var wl watchList
+	for _, spec := range []string{"a | once", "a", "b | once"} {
+		w, err := parseWatchRule(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wl.add(w)
+	}
+	if n := len(wl.match([]byte("a"))); n != 2 {
+		t.Errorf("got %d matches, want 2", n)
+	}
+	var specs []string
+	for _, w := range wl.list() {
+		specs = append(specs, w.Spec)
+	}
+	if want := []string{"a", "b | once"}; !reflect.DeepEqual(specs, want) {
+		t.Errorf("got rules %q after the first match, want %q", specs, want)
+	}
+	if n := wl.remove(0); n != 2 || len(wl.list()) != 0 {
+		t.Errorf("removed %d rules, want 2", n)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -17,6 +21,8 @@ type WebSocket struct {
 	pingTicker   *time.Ticker
 	pingInterval time.Duration
 	url          string
+	stats        *WsStats
+	sched        *scheduler
 	sync.RWMutex // NOTE: for update private props
 	// Used for reporting debug messages.
 	FnDebug func(string)
@@ -63,9 +69,78 @@ type WsMsg struct {
 	Type int
 }
 
+// WsOptions contains the options used when opening a WebSocket connection.
+type WsOptions struct {
+	PingSeconds  int
+	Header       http.Header
+	Subprotocols []string
+	// TLSConfig is the TLS configuration; if nil, the default one is used.
+	TLSConfig *tls.Config
+	// Compression requests the negotiation of permessage-deflate;
+	// CompressionLevel is the level used for compressing sent messages,
+	// where 0 is the default level.
+	Compression      bool
+	CompressionLevel int
+	// Proxy is the URL of the proxy; see proxyFunc.
+	Proxy string
+	// UnixSocket is the path of a Unix domain socket to connect to, instead
+	// of the host in the URL.
+	UnixSocket string
+	// DisplayURL is the URL shown and returned by URL, instead of the one
+	// connected to, which can contain secrets resolved from references.
+	DisplayURL string
+}
+
+// WsStats contains the statistics of a WebSocket connection.
+// NOTE: the counters must be accessed atomically, and are kept at the start of
+// the struct to be 64-bit aligned on 32-bit platforms.
+type WsStats struct {
+	MsgsSent  int64
+	MsgsRecv  int64
+	BytesSent int64 // message payloads
+	BytesRecv int64
+	WireSent  int64 // bytes written to/read from the network connection
+	WireRecv  int64
+
+	// Whether permessage-deflate was negotiated with the server.
+	Compression bool
+}
+
+func (s *WsStats) String() string {
+	fnDir := func(msgs, bytes, wire *int64) string {
+		b := atomic.LoadInt64(bytes)
+		str := fmt.Sprintf("%d messages, %d bytes", atomic.LoadInt64(msgs), b)
+		if w := atomic.LoadInt64(wire); b > 0 {
+			str += fmt.Sprintf(" (%d on the wire, %.1f%%)", w, 100*float64(w)/float64(b))
+		}
+		return str
+	}
+	return fmt.Sprintf("Sent: %s. Received: %s.",
+		fnDir(&s.MsgsSent, &s.BytesSent, &s.WireSent),
+		fnDir(&s.MsgsRecv, &s.BytesRecv, &s.WireRecv))
+}
+
+// countingConn is a net.Conn which counts the bytes read and written.
+type countingConn struct {
+	net.Conn
+	read, written *int64
+}
+
+func (c countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(c.read, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(c.written, int64(n))
+	return n, err
+}
+
 type WsReaderFunc func(*WsMsg, error)
 
-func readPump(pConn *websocket.Conn, fnRdr WsReaderFunc) error {
+func readPump(pConn *websocket.Conn, stats *WsStats, fnRdr WsReaderFunc) error {
 	var err error
 
 	for {
@@ -80,6 +155,8 @@ func readPump(pConn *websocket.Conn, fnRdr WsReaderFunc) error {
 			break
 		}
 
+		atomic.AddInt64(&stats.MsgsRecv, 1)
+		atomic.AddInt64(&stats.BytesRecv, int64(len(msg.Msg)))
 		fnRdr(&msg, nil)
 
 		if msg.Type == websocket.CloseMessage {
@@ -91,7 +168,7 @@ func readPump(pConn *websocket.Conn, fnRdr WsReaderFunc) error {
 }
 
 // NOTE: closing chWrite terminates the inner goroutine
-func goWritePump(pConn *websocket.Conn, chPing <-chan time.Time) (
+func goWritePump(pConn *websocket.Conn, stats *WsStats, chPing <-chan time.Time, sched *scheduler) (
 	chWrite chan WsMsg, chExit chan error,
 ) {
 	chWrite = make(chan WsMsg, 128)
@@ -100,9 +177,25 @@ func goWritePump(pConn *websocket.Conn, chPing <-chan time.Time) (
 	go func() {
 		var err error
 		defer func() {
+			sched.stop()
 			chExit <- err
 		}()
 
+		// timer for the next scheduled message
+		timer := time.NewTimer(time.Hour)
+		fnResetTimer := func() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			if next, ok := sched.nextDue(); ok {
+				timer.Reset(time.Until(next))
+			}
+		}
+		fnResetTimer()
+
 		for {
 			select {
 			case msg, open := <-chWrite:
@@ -112,11 +205,19 @@ func goWritePump(pConn *websocket.Conn, chPing <-chan time.Time) (
 				if err = pConn.WriteMessage(msg.Type, msg.Msg); err != nil {
 					return
 				}
+				atomic.AddInt64(&stats.MsgsSent, 1)
+				atomic.AddInt64(&stats.BytesSent, int64(len(msg.Msg)))
 
 			case <-chPing:
 				if err = pConn.WriteMessage(websocket.PingMessage, nil); err != nil {
 					return
 				}
+
+			case <-sched.chChanged:
+				fnResetTimer()
+			case now := <-timer.C:
+				sched.fire(now)
+				fnResetTimer()
 			}
 		}
 	}()
@@ -124,6 +225,14 @@ func goWritePump(pConn *websocket.Conn, chPing <-chan time.Time) (
 	return
 }
 
+// Stats returns the statistics of the current connection, or nil if there is
+// no connection.
+func (pWs *WebSocket) Stats() *WsStats {
+	pWs.RLock()
+	defer pWs.RUnlock()
+	return pWs.stats
+}
+
 func (pWs *WebSocket) IsOpen() bool {
 	pWs.RLock()
 	defer pWs.RUnlock()
@@ -173,6 +282,8 @@ func (pWs *WebSocket) closeAndClear() []error {
 		pWs.writeChan = nil
 		pWs.pingInterval = 0
 		pWs.url = ""
+		pWs.stats = nil
+		pWs.sched = nil
 		pWs.chWriEnd = nil
 	}
 
@@ -191,7 +302,7 @@ func (w WebSocketResponseError) Error() string {
 }
 
 // opens a new WebSocket connection to `url`.
-func (pWs *WebSocket) WsOpen(url string, nPingSeconds int, fnRdr WsReaderFunc) []error {
+func (pWs *WebSocket) WsOpen(url string, opts WsOptions, fnRdr WsReaderFunc) []error {
 	pWs.Lock()
 	defer pWs.Unlock()
 
@@ -204,8 +315,57 @@ func (pWs *WebSocket) WsOpen(url string, nPingSeconds int, fnRdr WsReaderFunc) [
 		}
 	}
 
-	pWs.Debug("Starting WebSocket connection to " + url)
-	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	dialURL := url
+	if u, socket, ok := parseUnixURL(url); ok {
+		dialURL, opts.UnixSocket = u, socket
+	}
+
+	fnProxy, err := proxyFunc(opts.Proxy)
+	if err != nil {
+		return []error{err}
+	}
+	if opts.UnixSocket != "" {
+		fnProxy = nil
+	}
+
+	stats := new(WsStats)
+	dialer := *websocket.DefaultDialer
+	dialer.EnableCompression = opts.Compression
+	dialer.Subprotocols = opts.Subprotocols
+	dialer.TLSClientConfig = opts.TLSConfig
+
+	// address of the https proxy in use, if any
+	var httpsProxyAddr string
+	if fnProxy != nil {
+		dialer.Proxy = dialerProxy(fnProxy, pWs.Debug, &httpsProxyAddr)
+	} else {
+		dialer.Proxy = nil
+	}
+
+	dialer.NetDial = func(network, addr string) (net.Conn, error) {
+		if opts.UnixSocket != "" {
+			network, addr = "unix", opts.UnixSocket
+		}
+		c, err := net.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+		c = countingConn{Conn: c, read: &stats.WireRecv, written: &stats.WireSent}
+		if addr == httpsProxyAddr {
+			return dialHTTPSProxy(c, addr)
+		}
+		return c, nil
+	}
+
+	displayURL := url
+	if opts.DisplayURL != "" {
+		displayURL = opts.DisplayURL
+	}
+	pWs.Debug("Starting WebSocket connection to " + displayURL)
+	if opts.UnixSocket != "" {
+		pWs.Debug("Using Unix domain socket " + opts.UnixSocket)
+	}
+	conn, resp, err := dialer.Dial(dialURL, opts.Header)
 	if err != nil {
 		return []error{WebSocketResponseError{
 			Err:  err,
@@ -213,11 +373,31 @@ func (pWs *WebSocket) WsOpen(url string, nPingSeconds int, fnRdr WsReaderFunc) [
 		}}
 	}
 	pWs.conn = conn
-	pWs.url = url
+	pWs.url = displayURL
+	pWs.stats = stats
+
+	if p := conn.Subprotocol(); p != "" {
+		pWs.Debug("Subprotocol: " + p)
+	} else if len(opts.Subprotocols) > 0 {
+		pWs.Debug("No subprotocol was negotiated by the server")
+	}
+	if opts.Compression {
+		stats.Compression = strings.Contains(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate")
+		if stats.Compression {
+			pWs.Debug("permessage-deflate negotiated")
+			if opts.CompressionLevel != 0 {
+				if err := conn.SetCompressionLevel(opts.CompressionLevel); err != nil {
+					pWs.Debug(fmt.Sprintf("Could not set compression level %d: %v", opts.CompressionLevel, err))
+				}
+			}
+		} else {
+			pWs.Debug("permessage-deflate was not negotiated by the server")
+		}
+	}
 
 	// READ PUMP
 	go func() {
-		if e := readPump(conn, fnRdr); e != nil {
+		if e := readPump(conn, stats, fnRdr); e != nil {
 			fnRdr(nil, e)
 		}
 
@@ -229,11 +409,49 @@ func (pWs *WebSocket) WsOpen(url string, nPingSeconds int, fnRdr WsReaderFunc) [
 	}()
 
 	// WRITE PUMP
-	pWs.setPingTicker(nPingSeconds)
-	pWs.writeChan, pWs.chWriEnd = goWritePump(conn, pWs.pingTicker.C)
+	pWs.setPingTicker(opts.PingSeconds)
+	pWs.sched = newScheduler()
+	pWs.writeChan, pWs.chWriEnd = goWritePump(conn, stats, pWs.pingTicker.C, pWs.sched)
 	return nil
 }
 
+// AddSchedule adds a message to send repeatedly over the connection, and
+// returns its ID. Schedules are cancelled when the connection is closed.
+func (pWs *WebSocket) AddSchedule(s Schedule) (int, error) {
+	pWs.RLock()
+	defer pWs.RUnlock()
+	if pWs.sched == nil {
+		return 0, errors.New("not connected")
+	}
+	return pWs.sched.add(s), nil
+}
+
+// CancelSchedule cancels the schedule with the given ID, or all of them if id
+// is 0, and returns the number of schedules cancelled.
+func (pWs *WebSocket) CancelSchedule(id int) int {
+	pWs.RLock()
+	defer pWs.RUnlock()
+	switch {
+	case pWs.sched == nil:
+		return 0
+	case id == 0:
+		return pWs.sched.cancelAll()
+	case pWs.sched.cancel(id):
+		return 1
+	}
+	return 0
+}
+
+// Schedules returns the active schedules of the connection.
+func (pWs *WebSocket) Schedules() []Schedule {
+	pWs.RLock()
+	defer pWs.RUnlock()
+	if pWs.sched == nil {
+		return nil
+	}
+	return pWs.sched.list()
+}
+
 // NOTE: must be mutexed by caller
 func (pWs *WebSocket) setPingTicker(secs int) {
 	if pWs.pingTicker == nil {